@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
@@ -15,6 +16,7 @@ import (
 
 var (
 	gatewayAddress string
+	addEndpoints   []string
 )
 
 var addCmd = &cobra.Command{
@@ -26,6 +28,7 @@ var addCmd = &cobra.Command{
 
 func init() {
 	addCmd.Flags().StringVar(&gatewayAddress, "gateway-address", "https://127.0.0.1:8443", "kube-gateway 服务的公共访问地址 (IP或域名)")
+	addCmd.Flags().StringSliceVar(&addEndpoints, "endpoint", nil, "集群的其他 API Server 地址 (例如多个控制平面节点)，可多次指定，网关会在这些地址之间转发并自动切换")
 	rootCmd.AddCommand(addCmd)
 }
 
@@ -45,12 +48,30 @@ func runAdd(cmd *cobra.Command, args []string) {
 	if _, err := os.Stat(clusterDir); !os.IsNotExist(err) {
 		log.Fatalf("错误: 名为 '%s' 的集群已存在于 %s", clusterName, clusterDir)
 	}
+	if _, err := os.Stat(filepath.Join(home, ".kube-gateway", "aliases", clusterName)); err == nil {
+		log.Fatalf("错误: 已存在名为 '%s' 的别名，集群不能与别名同名", clusterName)
+	}
+	if len(addEndpoints) > 0 {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", sourceKubeconfigPath)
+		if err != nil {
+			log.Fatalf("错误: 无法加载 kubeconfig 文件: %v", err)
+		}
+		if _, err := clusterEndpointURLs(restConfig.Host, addEndpoints); err != nil {
+			log.Fatalf("错误: %v", err)
+		}
+	}
 	if err := os.MkdirAll(clusterDir, 0755); err != nil {
 		log.Fatalf("错误: 创建集群目录失败: %v", err)
 	}
 	if err := copyFile(sourceKubeconfigPath, filepath.Join(clusterDir, "config")); err != nil {
 		log.Fatalf("错误: 复制 kubeconfig 文件失败: %v", err)
 	}
+	if len(addEndpoints) > 0 {
+		content := "# 除 config 中的地址外，该集群的其他 API Server 地址，每行一个\n" + strings.Join(addEndpoints, "\n") + "\n"
+		if err := os.WriteFile(filepath.Join(clusterDir, "endpoints"), []byte(content), 0644); err != nil {
+			log.Fatalf("错误: 写入 endpoints 文件失败: %v", err)
+		}
+	}
 	newToken := uuid.New().String()
 	if err := os.WriteFile(filepath.Join(clusterDir, "token"), []byte(newToken), 0644); err != nil {
 		log.Fatalf("错误: 写入 token 文件失败: %v", err)
@@ -60,6 +81,9 @@ func runAdd(cmd *cobra.Command, args []string) {
 	fmt.Printf("   集群名称: %s\n", clusterName)
 	fmt.Printf("   配置位置: %s\n", clusterDir)
 	fmt.Printf("   生成的 Token: %s\n", newToken)
+	if len(addEndpoints) > 0 {
+		fmt.Printf("   其他 API Server 地址: %s\n", strings.Join(addEndpoints, ", "))
+	}
 
 	// =========================================================
 	//  2. 客户端 kubeconfig 自动更新
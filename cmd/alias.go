@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+)
+
+var clusterAliasInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "cluster_alias_info",
+	Help:      "Cluster aliases currently in effect, with the cluster each alias points to.",
+}, []string{"alias", "cluster"})
+
+func init() {
+	metricsRegistry.MustRegister(clusterAliasInfo)
+}
+
+var aliasCmd = &cobra.Command{
+	Use:   "alias",
+	Short: "Manage cluster aliases that can be switched between clusters without changing client kubeconfigs",
+}
+
+var aliasSetCmd = &cobra.Command{
+	Use:   "set [alias] [cluster-name]",
+	Short: "Create an alias or point an existing alias to another cluster",
+	Args:  cobra.ExactArgs(2),
+	Run:   runAliasSet,
+}
+
+var aliasListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List cluster aliases and the clusters they point to",
+	Run:   runAliasList,
+}
+
+var aliasRemoveCmd = &cobra.Command{
+	Use:   "remove [alias]",
+	Short: "Remove a cluster alias and automatically clean local kubeconfig",
+	Args:  cobra.ExactArgs(1),
+	Run:   runAliasRemove,
+}
+
+func init() {
+	aliasSetCmd.Flags().StringVar(&gatewayAddress, "gateway-address", "https://127.0.0.1:8443", "kube-gateway 服务的公共访问地址 (IP或域名)，仅在创建别名时用于更新本地 kubeconfig")
+	aliasCmd.AddCommand(aliasSetCmd, aliasListCmd, aliasRemoveCmd)
+	rootCmd.AddCommand(aliasCmd)
+}
+
+// clusterAlias 是 ~/.kube-gateway/aliases/<别名>/ 下的一个别名: target 文件中是当前指向的集群，
+// token 文件中是别名自己的 Token。别名切换时 Token 保持不变，客户端无需更新 kubeconfig
+type clusterAlias struct {
+	name   string
+	target string
+	token  string
+}
+
+func aliasesDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("无法获取用户主目录: %w", err)
+	}
+	return filepath.Join(home, ".kube-gateway", "aliases"), nil
+}
+
+// readClusterAliases 读取所有别名，目录不存在时返回空列表
+func readClusterAliases(dir string) ([]clusterAlias, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var aliases []clusterAlias
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		alias, err := readClusterAlias(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			log.Printf("警告: 无法读取别名 %s: %v. 已跳过.", entry.Name(), err)
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+func readClusterAlias(path string) (clusterAlias, error) {
+	alias := clusterAlias{name: filepath.Base(path)}
+	target, err := os.ReadFile(filepath.Join(path, "target"))
+	if err != nil {
+		return alias, err
+	}
+	token, err := os.ReadFile(filepath.Join(path, "token"))
+	if err != nil {
+		return alias, err
+	}
+	alias.target = strings.TrimSpace(string(target))
+	alias.token = strings.TrimSpace(string(token))
+	if alias.target == "" || alias.token == "" {
+		return alias, fmt.Errorf("target 或 token 文件为空")
+	}
+	return alias, nil
+}
+
+// resolveClusterAliases 返回可以生效的别名，clusterTokens 是已加载的 "集群名称 -> Token"。
+// 与集群同名或指向不存在的集群的别名会被跳过
+func resolveClusterAliases(aliases []clusterAlias, clusterTokens map[string]string) []clusterAlias {
+	var resolved []clusterAlias
+	for _, alias := range aliases {
+		if _, ok := clusterTokens[alias.name]; ok {
+			log.Printf("警告: 别名 %s 与已有的集群同名. 已跳过.", alias.name)
+			continue
+		}
+		if _, ok := clusterTokens[alias.target]; !ok {
+			log.Printf("警告: 别名 %s 指向的集群 %s 不存在. 已跳过.", alias.name, alias.target)
+			continue
+		}
+		resolved = append(resolved, alias)
+		log.Printf("别名 %s -> %s", alias.name, alias.target)
+	}
+	return resolved
+}
+
+// setClusterAliasInfo 在新的别名生效后更新 cluster_alias_info 指标
+func setClusterAliasInfo(aliases []clusterAlias) {
+	clusterAliasInfo.Reset()
+	for _, alias := range aliases {
+		clusterAliasInfo.WithLabelValues(alias.name, alias.target).Set(1)
+	}
+}
+
+// configuredAliasNames 返回 ~/.kube-gateway/aliases 下所有别名的名称，每个别名有自己的 Token，Token 名称即别名
+func configuredAliasNames() ([]string, error) {
+	dir, err := aliasesDir()
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := readClusterAliases(dir)
+	if err != nil {
+		return nil, fmt.Errorf("读取别名目录时出错: %w", err)
+	}
+	var names []string
+	for _, alias := range aliases {
+		names = append(names, alias.name)
+	}
+	return names, nil
+}
+
+func runAliasSet(cmd *cobra.Command, args []string) {
+	aliasName, clusterName := args[0], args[1]
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("错误: 无法获取用户主目录: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".kube-gateway", "clusters", aliasName)); err == nil {
+		log.Fatalf("错误: 已存在名为 '%s' 的集群，别名不能与集群同名", aliasName)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".kube-gateway", "clusters", clusterName, "token")); os.IsNotExist(err) {
+		log.Fatalf("错误: 找不到名为 '%s' 的集群配置。", clusterName)
+	}
+	dir, err := aliasesDir()
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	aliasDir := filepath.Join(dir, aliasName)
+
+	// 只有 token 文件不存在时才生成新的 Token，target 文件缺失或损坏时保留已经发给客户端的 Token
+	tokenPath := filepath.Join(aliasDir, "token")
+	tokenBytes, err := os.ReadFile(tokenPath)
+	created := os.IsNotExist(err)
+	if err != nil && !created {
+		log.Fatalf("错误: 无法读取别名 '%s' 的 token 文件: %v", aliasName, err)
+	}
+	existing := clusterAlias{name: aliasName, token: strings.TrimSpace(string(tokenBytes))}
+	if target, err := os.ReadFile(filepath.Join(aliasDir, "target")); err == nil {
+		existing.target = strings.TrimSpace(string(target))
+	}
+	if created {
+		if err := os.MkdirAll(aliasDir, 0755); err != nil {
+			log.Fatalf("错误: 创建别名目录失败: %v", err)
+		}
+		existing.token = uuid.New().String()
+		if err := os.WriteFile(tokenPath, []byte(existing.token), 0644); err != nil {
+			log.Fatalf("错误: 写入 token 文件失败: %v", err)
+		}
+	} else if existing.token == "" {
+		log.Fatalf("错误: 别名 '%s' 的 token 文件为空", aliasName)
+	}
+
+	// 先写入临时文件再重命名，正在运行的网关在 reload 时只会读到完整的旧值或新值
+	targetPath := filepath.Join(aliasDir, "target")
+	if err := os.WriteFile(targetPath+".tmp", []byte(clusterName+"\n"), 0644); err != nil {
+		log.Fatalf("错误: 写入 target 文件失败: %v", err)
+	}
+	if err := os.Rename(targetPath+".tmp", targetPath); err != nil {
+		log.Fatalf("错误: 写入 target 文件失败: %v", err)
+	}
+
+	if !created {
+		if existing.target == "" {
+			fmt.Printf("✅ 别名 '%s' 已指向集群 '%s'。\n", aliasName, clusterName)
+		} else {
+			fmt.Printf("✅ 别名 '%s' 已从集群 '%s' 切换到 '%s'。\n", aliasName, existing.target, clusterName)
+		}
+		fmt.Println("   别名的 Token 保持不变，客户端无需更新 kubeconfig。")
+		fmt.Println("\n💡 如果服务正在运行，请执行 'kube-gateway reload' 来应用变更。")
+		return
+	}
+
+	fmt.Println("✅ 别名已成功添加！")
+	fmt.Printf("   别名: %s -> %s\n", aliasName, clusterName)
+	fmt.Printf("   生成的 Token: %s\n", existing.token)
+
+	fmt.Println("\n🔄 正在自动更新本地 kubeconfig...")
+	if err := updateKubeconfig(aliasName, existing.token, gatewayAddress); err != nil {
+		fmt.Printf("   ❌ 自动更新 kubeconfig 失败: %v\n", err)
+		fmt.Println("   请手动配置你的 ~/.kube/config 文件。")
+	} else {
+		fmt.Println("   ✅ 本地 kubeconfig 更新成功！")
+		fmt.Printf("   已添加新的上下文 '%s' 并设为当前上下文。\n", "gateway-"+aliasName)
+	}
+
+	fmt.Println("\n💡 如果服务正在运行，请执行 'kube-gateway reload' 来应用变更。")
+}
+
+func runAliasList(cmd *cobra.Command, args []string) {
+	dir, err := aliasesDir()
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	aliases, err := readClusterAliases(dir)
+	if err != nil {
+		log.Fatalf("错误: 读取别名目录时出错: %v", err)
+	}
+	if len(aliases) == 0 {
+		fmt.Println("没有找到任何别名。请使用 'kube-gateway alias set' 命令添加一个。")
+		return
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].name < aliases[j].name })
+
+	headerFormat := "%-25s %-25s %s\n"
+	fmt.Printf(headerFormat, "别名 (Alias)", "指向的集群 (Cluster)", "Token 后缀 (Token Suffix)")
+	fmt.Printf(headerFormat, strings.Repeat("-", 25), strings.Repeat("-", 25), strings.Repeat("-", 25))
+	for _, alias := range aliases {
+		suffix := alias.token
+		if len(suffix) > 8 {
+			suffix = "..." + suffix[len(suffix)-8:]
+		}
+		fmt.Printf(headerFormat, alias.name, alias.target, suffix)
+	}
+}
+
+func runAliasRemove(cmd *cobra.Command, args []string) {
+	aliasName := args[0]
+
+	dir, err := aliasesDir()
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	aliasDir := filepath.Join(dir, aliasName)
+	if _, err := os.Stat(aliasDir); os.IsNotExist(err) {
+		fmt.Printf("✅ 别名 '%s' 不存在，无需清理。\n", aliasName)
+	} else {
+		if err := os.RemoveAll(aliasDir); err != nil {
+			log.Fatalf("错误: 移除别名目录失败: %v", err)
+		}
+		fmt.Printf("✅ 别名 '%s' 已成功移除。\n", aliasName)
+	}
+
+	fmt.Println("\n🔄 正在自动清理本地 kubeconfig...")
+	if err := cleanupKubeconfig(aliasName); err != nil {
+		fmt.Printf("   ❌ 自动清理 kubeconfig 失败: %v\n", err)
+		fmt.Println("   可能需要你手动编辑 ~/.kube/config 文件。")
+	} else {
+		fmt.Println("   ✅ 本地 kubeconfig 清理成功！")
+	}
+
+	fmt.Println("\n💡 如果服务正在运行，请执行 'kube-gateway reload' 来应用变更。")
+}
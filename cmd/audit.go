@@ -0,0 +1,447 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// auditFormatJSON 是最初的扁平 JSON 格式，每行一条 logrus 日志
+	auditFormatJSON = "json"
+	// auditFormatEvent 输出 audit.k8s.io/v1 的 Event 对象，可直接被现有的 K8s 审计工具消费
+	auditFormatEvent = "k8s-event"
+)
+
+var (
+	auditLogFormat         string
+	auditLogPath           string
+	auditLogMaxSize        int
+	auditLogMaxAge         int
+	auditLogMaxBackups     int
+	auditLogCompress       bool
+	auditLogRotateInterval time.Duration
+
+	// auditLogWriter 是当前使用的审计日志文件，收到 SIGUSR1 时会被重新打开
+	auditLogWriter *lumberjack.Logger
+)
+
+// auditEvent 与 audit.k8s.io/v1 中的 Event 保持相同的 JSON 结构
+type auditEvent struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Level                    string                     `json:"level"`
+	AuditID                  string                     `json:"auditID"`
+	Stage                    string                     `json:"stage"`
+	RequestURI               string                     `json:"requestURI"`
+	Verb                     string                     `json:"verb"`
+	User                     authenticationv1.UserInfo  `json:"user"`
+	ImpersonatedUser         *authenticationv1.UserInfo `json:"impersonatedUser,omitempty"`
+	SourceIPs                []string                   `json:"sourceIPs,omitempty"`
+	UserAgent                string                     `json:"userAgent,omitempty"`
+	ObjectRef                *auditObjectReference      `json:"objectRef,omitempty"`
+	ResponseStatus           *metav1.Status             `json:"responseStatus,omitempty"`
+	RequestReceivedTimestamp metav1.MicroTime           `json:"requestReceivedTimestamp"`
+	StageTimestamp           metav1.MicroTime           `json:"stageTimestamp"`
+	Annotations              map[string]string          `json:"annotations,omitempty"`
+	RequestObject            json.RawMessage            `json:"requestObject,omitempty"`
+	ResponseObject           json.RawMessage            `json:"responseObject,omitempty"`
+
+	// method 是原始的 HTTP 方法，仅用于 json 格式
+	method string
+}
+
+// auditObjectReference 与 audit.k8s.io/v1 中的 ObjectReference 保持相同的 JSON 结构
+type auditObjectReference struct {
+	Resource    string `json:"resource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name,omitempty"`
+	APIGroup    string `json:"apiGroup,omitempty"`
+	APIVersion  string `json:"apiVersion,omitempty"`
+	Subresource string `json:"subresource,omitempty"`
+}
+
+// 网关在审计事件的 annotations 中记录的附加信息
+const (
+	auditAnnotationCluster        = "kube-gateway.io/cluster"
+	auditAnnotationToken          = "kube-gateway.io/token"
+	auditAnnotationKubectlCommand = "kube-gateway.io/kubectl-command"
+	auditAnnotationBackendAuditID = "kube-gateway.io/backend-audit-id"
+	auditAnnotationLatency        = "kube-gateway.io/latency-ms"
+	auditAnnotationRequestOmit    = "kube-gateway.io/request-object-omitted"
+	auditAnnotationResponseOmit   = "kube-gateway.io/response-object-omitted"
+	auditAnnotationSessionID      = "kube-gateway.io/session-id"
+)
+
+// gatewayUserName 返回 Token 持有者的身份，与 add 命令写入 kubeconfig 的用户名保持一致
+func gatewayUserName(tokenName string) string {
+	if tokenName == "" {
+		return "system:anonymous"
+	}
+	return "user-for-" + tokenName
+}
+
+// newAuditEvent 根据已处理完成的请求构建审计事件
+func newAuditEvent(c *gin.Context, level string, startTime time.Time, latency time.Duration) *auditEvent {
+	info := requestInfoFor(c)
+	clusterName := c.GetString("targetCluster")
+	tokenName := c.GetString("tokenName")
+
+	event := &auditEvent{
+		TypeMeta:                 metav1.TypeMeta{Kind: "Event", APIVersion: "audit.k8s.io/v1"},
+		Level:                    level,
+		AuditID:                  uuid.New().String(),
+		Stage:                    "ResponseComplete",
+		RequestURI:               c.Request.URL.RequestURI(),
+		Verb:                     info.Verb,
+		User:                     authenticationv1.UserInfo{Username: gatewayUserName(tokenName)},
+		SourceIPs:                []string{c.ClientIP()},
+		UserAgent:                c.Request.UserAgent(),
+		ResponseStatus:           &metav1.Status{Code: int32(c.Writer.Status())},
+		RequestReceivedTimestamp: metav1.NewMicroTime(startTime),
+		StageTimestamp:           metav1.NewMicroTime(startTime.Add(latency)),
+		Annotations: map[string]string{
+			auditAnnotationCluster: clusterName,
+			auditAnnotationToken:   tokenName,
+			auditAnnotationLatency: fmt.Sprintf("%d", latency.Milliseconds()),
+		},
+		method: c.Request.Method,
+	}
+	if tokenName != "" {
+		event.User.Groups = []string{"system:authenticated"}
+	}
+	if impersonated := c.Request.Header.Get("Impersonate-User"); impersonated != "" {
+		event.ImpersonatedUser = &authenticationv1.UserInfo{
+			Username: impersonated,
+			Groups:   c.Request.Header.Values("Impersonate-Group"),
+		}
+	}
+	if info.IsResourceRequest {
+		event.ObjectRef = &auditObjectReference{
+			Resource:    info.Resource,
+			Namespace:   info.Namespace,
+			Name:        info.Name,
+			APIGroup:    info.APIGroup,
+			APIVersion:  info.APIVersion,
+			Subresource: info.Subresource,
+		}
+	}
+	if command := c.Request.Header.Get("Kubectl-Command"); command != "" {
+		event.Annotations[auditAnnotationKubectlCommand] = command
+	}
+	// 后端 API Server 的审计 ID，可用于和后端集群的审计日志关联
+	if backendAuditID := c.Writer.Header().Get("Audit-Id"); backendAuditID != "" {
+		event.Annotations[auditAnnotationBackendAuditID] = backendAuditID
+	}
+	// exec/attach 会话的录像，可使用 'session play <id>' 回放
+	if sessionID := c.GetString("sessionID"); sessionID != "" {
+		event.Annotations[auditAnnotationSessionID] = sessionID
+	}
+	return event
+}
+
+// formatAuditEvent 将审计事件按照指定格式编码为一行日志
+func formatAuditEvent(event *auditEvent, format string) ([]byte, error) {
+	if format == auditFormatEvent {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+
+	fields := logrus.Fields{
+		"timestamp":   event.RequestReceivedTimestamp.Format(time.RFC3339),
+		"source_ip":   strings.Join(event.SourceIPs, ","),
+		"method":      event.method,
+		"path":        strings.SplitN(event.RequestURI, "?", 2)[0],
+		"status_code": event.ResponseStatus.Code,
+		"latency_ms":  event.StageTimestamp.Sub(event.RequestReceivedTimestamp.Time).Milliseconds(),
+		"cluster":     event.Annotations[auditAnnotationCluster],
+		"audit_id":    event.AuditID,
+		"verb":        event.Verb,
+		"user":        event.User.Username,
+		"token":       event.Annotations[auditAnnotationToken],
+		"user_agent":  event.UserAgent,
+		"audit_level": event.Level,
+	}
+	if ref := event.ObjectRef; ref != nil {
+		fields["api_group"] = ref.APIGroup
+		fields["api_version"] = ref.APIVersion
+		fields["resource"] = ref.Resource
+		fields["subresource"] = ref.Subresource
+		fields["namespace"] = ref.Namespace
+		fields["name"] = ref.Name
+	}
+	if event.ImpersonatedUser != nil {
+		fields["impersonated_user"] = event.ImpersonatedUser.Username
+	}
+	if command, ok := event.Annotations[auditAnnotationKubectlCommand]; ok {
+		fields["kubectl_command"] = command
+	}
+	if backendAuditID, ok := event.Annotations[auditAnnotationBackendAuditID]; ok {
+		fields["backend_audit_id"] = backendAuditID
+	}
+	if sessionID, ok := event.Annotations[auditAnnotationSessionID]; ok {
+		fields["session_id"] = sessionID
+	}
+	if event.RequestObject != nil {
+		fields["request_object"] = event.RequestObject
+	}
+	if reason, ok := event.Annotations[auditAnnotationRequestOmit]; ok {
+		fields["request_object_omitted"] = reason
+	}
+	if event.ResponseObject != nil {
+		fields["response_object"] = event.ResponseObject
+	}
+	if reason, ok := event.Annotations[auditAnnotationResponseOmit]; ok {
+		fields["response_object_omitted"] = reason
+	}
+
+	entry := &logrus.Entry{
+		Data:    fields,
+		Time:    event.StageTimestamp.Time,
+		Level:   logrus.InfoLevel,
+		Message: "API request processed",
+	}
+	return (&logrus.JSONFormatter{}).Format(entry)
+}
+
+func AuditLogMiddleware() gin.HandlerFunc {
+	switch auditLogFormat {
+	case auditFormatJSON, auditFormatEvent:
+	default:
+		log.Fatalf("错误: 不支持的审计日志格式 '%s'，可选值为 %s 或 %s", auditLogFormat, auditFormatJSON, auditFormatEvent)
+	}
+
+	// 创建审计输出，任何一个输出无法打开时直接退出，而不是悄悄地丢弃审计事件
+	sinks, err := newAuditSinks()
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	// 管理端口开启时，额外将事件推送给 /audit/stream 的订阅者。
+	// 推送的内容包括完整的审计事件，管理端口以明文 HTTP 监听非回环地址时不提供该接口
+	if adminAddress != "" {
+		if auditStreamAllowed() {
+			sinks = append(sinks, auditStream)
+			auditStreamEnabled.Store(true)
+		} else {
+			log.Printf("警告: 管理端口 %s 未启用 --admin-tls 且不是本地回环地址，/audit/stream 已禁用", adminAddress)
+		}
+	}
+	dispatcher := newAuditDispatcher(sinks, auditBufferSize)
+
+	if err := reloadAuditPolicy(); err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	if auditPolicyFile != "" {
+		log.Printf("已加载审计策略文件 %s", auditPolicyFile)
+	}
+
+	return func(c *gin.Context) {
+		startTime := time.Now()
+
+		// 只记录通过代理的 K8s API 请求
+		if !strings.HasPrefix(c.Request.URL.Path, "/api") && !strings.HasPrefix(c.Request.URL.Path, "/apis") {
+			c.Next()
+			return
+		}
+
+		// 在转发之前确定审计级别，以便按需捕获请求体和响应体
+		info := requestInfoFor(c)
+		level := auditLevelFor(clusterForRequest(c.Request), info)
+		if level == auditLevelNone {
+			c.Next()
+			return
+		}
+
+		var requestCapture, responseCapture *auditBodyCapture
+		if auditLevelAtLeast(level, auditLevelRequest) && c.Request.Body != nil && c.Request.Body != http.NoBody {
+			requestCapture = &auditBodyCapture{limit: auditMaxBodyBytes}
+			c.Request.Body = &auditCapturingBody{ReadCloser: c.Request.Body, capture: requestCapture}
+		}
+		// watch 和 exec 等长连接请求的响应是一个持续的流，不记录响应体
+		if auditLevelAtLeast(level, auditLevelRequestResponse) && info.Verb != "watch" && c.GetHeader("Upgrade") == "" {
+			responseCapture = &auditBodyCapture{limit: auditMaxBodyBytes}
+			c.Writer = &auditCapturingWriter{ResponseWriter: c.Writer, capture: responseCapture}
+		}
+
+		// 先执行请求处理
+		c.Next()
+
+		// 请求处理完成后记录日志
+		latency := time.Since(startTime)
+
+		event := newAuditEvent(c, level, startTime, latency)
+		if requestCapture != nil {
+			event.RequestObject = requestCapture.object(info, event.Annotations, auditAnnotationRequestOmit)
+		}
+		if responseCapture != nil {
+			event.ResponseObject = responseCapture.object(info, event.Annotations, auditAnnotationResponseOmit)
+		}
+		line, err := formatAuditEvent(event, auditLogFormat)
+		if err != nil {
+			log.Printf("错误: 编码审计事件失败: %v", err)
+			return
+		}
+		dispatcher.emit(line)
+	}
+}
+
+// auditBodyCapture 保存请求体或响应体的前 limit 个字节
+type auditBodyCapture struct {
+	limit     int64
+	buf       bytes.Buffer
+	total     int64
+	truncated bool
+}
+
+func (b *auditBodyCapture) write(p []byte) {
+	b.total += int64(len(p))
+	if b.truncated {
+		return
+	}
+	if remaining := b.limit - int64(b.buf.Len()); int64(len(p)) > remaining {
+		b.buf.Write(p[:remaining])
+		b.truncated = true
+		return
+	}
+	b.buf.Write(p)
+}
+
+// object 返回可以嵌入审计事件的对象，无法记录时在 annotations 中注明原因
+func (b *auditBodyCapture) object(info *RequestInfo, annotations map[string]string, omitAnnotation string) json.RawMessage {
+	if b.truncated {
+		annotations[omitAnnotation] = fmt.Sprintf("truncated: %d bytes exceeds limit of %d", b.total, b.limit)
+		return nil
+	}
+	object, reason := prepareAuditBody(b.buf.Bytes(), info)
+	if reason != "" {
+		annotations[omitAnnotation] = reason
+	}
+	return object
+}
+
+// auditCapturingBody 在请求体被转发给后端的同时捕获其内容
+type auditCapturingBody struct {
+	io.ReadCloser
+	capture *auditBodyCapture
+}
+
+func (r *auditCapturingBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.capture.write(p[:n])
+	}
+	return n, err
+}
+
+// auditCapturingWriter 在响应写回客户端的同时捕获其内容
+type auditCapturingWriter struct {
+	gin.ResponseWriter
+	capture *auditBodyCapture
+}
+
+func (w *auditCapturingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if n > 0 {
+		w.capture.write(p[:n])
+	}
+	return n, err
+}
+
+func (w *auditCapturingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// openAuditLogFile 打开审计日志文件并按大小和时间进行轮转
+func openAuditLogFile() (*lumberjack.Logger, error) {
+	logFile := auditLogPath
+	if logFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("无法获取用户主目录以设置审计日志: %w", err)
+		}
+		logFile = filepath.Join(home, ".kube-gateway", "logs", "audit.log")
+	}
+	logDir := filepath.Dir(logFile)
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		return nil, fmt.Errorf("无法创建审计日志目录 %s: %w", logDir, err)
+	}
+	// MkdirAll 不会修改已有目录的权限。默认目录由网关自己管理，直接收紧为 0700；
+	// 通过 --audit-log-path 指定的目录可能与其他程序共用，只给出警告
+	info, err := os.Stat(logDir)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取审计日志目录 %s: %w", logDir, err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		if auditLogPath == "" {
+			if err := os.Chmod(logDir, 0700); err != nil {
+				return nil, fmt.Errorf("无法修改审计日志目录 %s 的权限: %w", logDir, err)
+			}
+		} else {
+			log.Printf("警告: 审计日志目录 %s 的权限为 %04o，同组或其他用户可以访问，建议修改为 0700", logDir, info.Mode().Perm())
+		}
+	}
+
+	// 预先打开一次文件，确保启动时就能发现权限等问题；同时收紧旧版本以 0666 创建的文件的权限
+	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开审计日志文件 %s: %w", logFile, err)
+	}
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("无法修改审计日志文件 %s 的权限: %w", logFile, err)
+	}
+	file.Close()
+
+	// lumberjack 新建的文件 (包括轮转后的备份) 权限均为 0600
+	auditLogWriter = &lumberjack.Logger{
+		Filename:   logFile,
+		MaxSize:    auditLogMaxSize,
+		MaxAge:     auditLogMaxAge,
+		MaxBackups: auditLogMaxBackups,
+		Compress:   auditLogCompress,
+		LocalTime:  true,
+	}
+
+	if auditLogRotateInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(auditLogRotateInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := auditLogWriter.Rotate(); err != nil {
+					log.Printf("错误: 定时轮转审计日志失败: %v", err)
+				}
+			}
+		}()
+	}
+	return auditLogWriter, nil
+}
+
+// reopenAuditLog 关闭当前的审计日志文件，下一次写入时会重新打开，
+// 配合外部的 logrotate 使用
+func reopenAuditLog() {
+	if auditLogWriter == nil {
+		return
+	}
+	if err := auditLogWriter.Close(); err != nil {
+		log.Printf("错误: 关闭审计日志文件失败: %v", err)
+		return
+	}
+	log.Printf("审计日志文件 %s 将在下一次写入时重新打开。", auditLogWriter.Filename)
+}
@@ -0,0 +1,498 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	auditHashChain bool
+	auditSignChain bool
+)
+
+// auditChainMarker 是追加在每条审计记录末尾的链字段的起始标记
+var auditChainMarker = []byte(`,"chain":{`)
+
+// auditChainLink 记录了一条审计记录在哈希链中的位置。
+// hash = SHA-256(seq + "\n" + prev + "\n" + 原始记录)，sig 是对 hash 的 Ed25519 签名
+type auditChainLink struct {
+	Seq  uint64 `json:"seq"`
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+	Sig  string `json:"sig,omitempty"`
+}
+
+// computeAuditChainHash 计算一条记录在链中的哈希
+func computeAuditChainHash(seq uint64, prev string, record []byte) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s", seq, prev)
+	h.Write([]byte("\n"))
+	h.Write(record)
+	return h.Sum(nil)
+}
+
+// splitAuditChainLine 将一行审计日志拆分为原始记录和链字段，没有链字段时 link 为 nil
+func splitAuditChainLine(line []byte) (record []byte, link *auditChainLink, err error) {
+	line = bytes.TrimSpace(line)
+	idx := bytes.LastIndex(line, auditChainMarker)
+	if idx < 0 {
+		return line, nil, nil
+	}
+	if !bytes.HasSuffix(line, []byte("}}")) {
+		return nil, nil, fmt.Errorf("链字段格式错误")
+	}
+	link = &auditChainLink{}
+	if err := json.Unmarshal(line[idx+len(`,"chain":`):len(line)-1], link); err != nil {
+		return nil, nil, fmt.Errorf("无法解析链字段: %w", err)
+	}
+	record = append(append([]byte{}, line[:idx]...), '}')
+	return record, link, nil
+}
+
+// auditChainCheckpoint 记录某个日志文件的第一条记录。按保留策略清理旧文件后，链从剩余最早的文件开头继续，
+// 校验时只有与检查点一致的起点才被视为正常清理，否则说明开头的记录被删除了。
+// sig 是对 computeAuditCheckpointDigest 的 Ed25519 签名
+type auditChainCheckpoint struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+	Sig  string `json:"sig,omitempty"`
+}
+
+// computeAuditCheckpointDigest 计算检查点的签名内容，与记录本身的签名区分开，不能用记录的签名伪造检查点
+func computeAuditCheckpointDigest(seq uint64, hash string) []byte {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("file-start\n%d\n%s", seq, hash)))
+	return digest[:]
+}
+
+// auditChainCheckpointPath 返回检查点文件的路径，例如 audit.log.checkpoints。
+// 该文件不会被当作审计日志读取，也不应被 logrotate 轮转
+func auditChainCheckpointPath(logFile string) string {
+	return logFile + ".checkpoints"
+}
+
+// appendAuditChainCheckpoint 将 link 所在的记录作为一个日志文件的开头追加到检查点文件
+func appendAuditChainCheckpoint(path string, link auditChainLink, signingKey ed25519.PrivateKey) error {
+	checkpoint := auditChainCheckpoint{Seq: link.Seq, Hash: link.Hash}
+	if signingKey != nil {
+		checkpoint.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, computeAuditCheckpointDigest(link.Seq, link.Hash)))
+	}
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// loadAuditChainCheckpoints 按 seq 读取检查点文件，文件不存在时返回 nil
+func loadAuditChainCheckpoints(path string) (map[uint64]auditChainCheckpoint, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无法打开检查点文件 %s: %w", path, err)
+	}
+	defer file.Close()
+	checkpoints := make(map[uint64]auditChainCheckpoint)
+	scanner := newAuditLogScanner(file)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var checkpoint auditChainCheckpoint
+		if err := json.Unmarshal(scanner.Bytes(), &checkpoint); err != nil {
+			return nil, fmt.Errorf("检查点文件 %s 格式错误: %w", path, err)
+		}
+		checkpoints[checkpoint.Seq] = checkpoint
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取检查点文件 %s 失败: %w", path, err)
+	}
+	return checkpoints, nil
+}
+
+// hashChainAuditSink 在写入文件之前为每条记录追加哈希链字段
+type hashChainAuditSink struct {
+	inner      auditSink
+	signingKey ed25519.PrivateKey
+	seq        uint64
+	prev       string
+
+	// logFile 是当前写入的文件，写入后文件大小等于这条记录的长度时，说明它是新文件 (轮转之后) 的第一条记录
+	logFile        string
+	checkpointFile string
+}
+
+// newHashChainAuditSink 包装文件输出，并从现有日志的最后一条记录恢复链的状态，
+// 以便重启和日志轮转之后链仍然是连续的
+func newHashChainAuditSink(inner auditSink, logFile string, signingKey ed25519.PrivateKey) (*hashChainAuditSink, error) {
+	sink := &hashChainAuditSink{inner: inner, signingKey: signingKey, logFile: logFile, checkpointFile: auditChainCheckpointPath(logFile)}
+	files, err := auditLogFiles(logFile)
+	if err != nil {
+		return nil, err
+	}
+	// 从最新的文件开始向前查找最后一条带链字段的记录
+	for i := len(files) - 1; i >= 0; i-- {
+		link, err := lastAuditChainLink(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if link != nil {
+			sink.seq = link.Seq
+			sink.prev = link.Hash
+			break
+		}
+	}
+	if sink.seq > 0 {
+		if err := sink.ensureCheckpoints(files); err != nil {
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+// ensureCheckpoints 为没有检查点文件的已有哈希链 (由旧版本写入) 补充起点，
+// 把现有日志中第一条带链字段的记录作为起点
+func (s *hashChainAuditSink) ensureCheckpoints(files []string) error {
+	if _, err := os.Stat(s.checkpointFile); !os.IsNotExist(err) {
+		return err
+	}
+	for _, path := range files {
+		link, err := firstAuditChainLink(path)
+		if err != nil {
+			return err
+		}
+		if link == nil {
+			continue
+		}
+		if err := appendAuditChainCheckpoint(s.checkpointFile, *link, s.signingKey); err != nil {
+			return fmt.Errorf("无法写入检查点文件 %s: %w", s.checkpointFile, err)
+		}
+		log.Printf("警告: 检查点文件 %s 不存在，已将现有日志中的记录 #%d 作为哈希链的起点", s.checkpointFile, link.Seq)
+		return nil
+	}
+	return nil
+}
+
+func (s *hashChainAuditSink) name() string { return s.inner.name() }
+
+func (s *hashChainAuditSink) write(line []byte) error {
+	record := bytes.TrimSpace(line)
+	if len(record) < 2 || record[len(record)-1] != '}' {
+		return fmt.Errorf("审计记录不是 JSON 对象，无法加入哈希链")
+	}
+	seq := s.seq + 1
+	hash := computeAuditChainHash(seq, s.prev, record)
+	link := auditChainLink{Seq: seq, Prev: s.prev, Hash: hex.EncodeToString(hash)}
+	if s.signingKey != nil {
+		link.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(s.signingKey, hash))
+	}
+	linkJSON, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(record[:len(record)-1])
+	buf.WriteString(`,"chain":`)
+	buf.Write(linkJSON)
+	buf.WriteString("}\n")
+	if err := s.inner.write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.seq = link.Seq
+	s.prev = link.Hash
+	if info, err := os.Stat(s.logFile); err == nil && info.Size() == int64(buf.Len()) {
+		if err := appendAuditChainCheckpoint(s.checkpointFile, link, s.signingKey); err != nil {
+			log.Printf("错误: 无法写入检查点文件 %s: %v", s.checkpointFile, err)
+		}
+	}
+	return nil
+}
+
+// auditLogFiles 按时间顺序返回审计日志及其轮转后的备份，最后一个是当前正在写入的文件。
+// 备份包括外部 logrotate 轮转出的 audit.log.N[.gz] (N 越大越早) 和 lumberjack 轮转出的带时间戳的文件
+func auditLogFiles(logFile string) ([]string, error) {
+	rotated, err := filepath.Glob(logFile + ".*")
+	if err != nil {
+		return nil, err
+	}
+	numbered := make(map[string]int)
+	for _, path := range rotated {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(path, logFile+"."), ".gz")
+		if n, err := strconv.Atoi(suffix); err == nil && n >= 0 {
+			numbered[path] = n
+		}
+	}
+	var files []string
+	for path := range numbered {
+		files = append(files, path)
+	}
+	sort.Slice(files, func(i, j int) bool { return numbered[files[i]] > numbered[files[j]] })
+
+	ext := filepath.Ext(logFile)
+	prefix := strings.TrimSuffix(logFile, ext) + "-"
+	backups, err := filepath.Glob(prefix + "*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+	// lumberjack 的备份文件名中带有时间戳，按名称排序即为时间顺序
+	sort.Strings(backups)
+	for _, backup := range backups {
+		if strings.HasSuffix(backup, ext) || strings.HasSuffix(backup, ext+".gz") {
+			files = append(files, backup)
+		}
+	}
+	if _, err := os.Stat(logFile); err == nil {
+		files = append(files, logFile)
+	}
+	return files, nil
+}
+
+// openAuditLogReader 打开一个审计日志文件，自动处理 gzip 压缩的备份
+func openAuditLogReader(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("无法解压 %s: %w", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, file}, nil
+}
+
+// newAuditLogScanner 创建逐行读取审计日志的 Scanner，允许较长的记录 (包含请求体和响应体)
+func newAuditLogScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	return scanner
+}
+
+// lastAuditChainLink 返回文件中最后一条记录的链字段
+func lastAuditChainLink(path string) (*auditChainLink, error) {
+	return scanAuditChainLinks(path, false)
+}
+
+// firstAuditChainLink 返回文件中第一条带链字段的记录的链字段
+func firstAuditChainLink(path string) (*auditChainLink, error) {
+	return scanAuditChainLinks(path, true)
+}
+
+func scanAuditChainLinks(path string, first bool) (*auditChainLink, error) {
+	reader, err := openAuditLogReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开审计日志 %s: %w", path, err)
+	}
+	defer reader.Close()
+
+	var found *auditChainLink
+	scanner := newAuditLogScanner(reader)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if _, link, err := splitAuditChainLine(scanner.Bytes()); err == nil && link != nil {
+			found = link
+			if first {
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取审计日志 %s 失败: %w", path, err)
+	}
+	return found, nil
+}
+
+// auditChainProblem 描述校验过程中发现的一个问题
+type auditChainProblem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+// auditChainReport 是一次校验的结果
+type auditChainReport struct {
+	Records   int
+	Unchained int
+	FirstSeq  uint64
+	LastSeq   uint64
+	LastHash  string
+	Problems  []auditChainProblem
+}
+
+// verifyAuditChain 按顺序校验所有文件中的哈希链，publicKey 为 nil 时不校验签名。
+// 链不从记录 #1 开始时，起点必须是某个文件的第一条记录并且与 checkpointFile 中的检查点一致，
+// 即之前的记录是随整个文件按保留策略清理的
+func verifyAuditChain(files []string, checkpointFile string, publicKey ed25519.PublicKey) (*auditChainReport, error) {
+	checkpoints, err := loadAuditChainCheckpoints(checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+	report := &auditChainReport{}
+	var prevLink *auditChainLink
+
+	for _, path := range files {
+		reader, err := openAuditLogReader(path)
+		if err != nil {
+			return nil, fmt.Errorf("无法打开审计日志 %s: %w", path, err)
+		}
+		scanner := newAuditLogScanner(reader)
+		lineNo := 0
+		// fileRecords 是本文件中已读取的记录数，unchainedLines 是链开始之前本文件中没有链字段的记录所在的行
+		fileRecords := 0
+		var unchainedLines []int
+		for scanner.Scan() {
+			lineNo++
+			line := scanner.Bytes()
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			report.Records++
+			fileRecords++
+			problem := func(format string, args ...interface{}) {
+				report.Problems = append(report.Problems, auditChainProblem{File: path, Line: lineNo, Message: fmt.Sprintf(format, args...)})
+			}
+
+			record, link, err := splitAuditChainLine(line)
+			if err != nil {
+				problem("%v", err)
+				continue
+			}
+			if link == nil {
+				// 启用哈希链之前写入的记录
+				report.Unchained++
+				if prevLink != nil {
+					problem("在哈希链中间出现了没有链字段的记录")
+				} else {
+					unchainedLines = append(unchainedLines, lineNo)
+				}
+				continue
+			}
+
+			hash := computeAuditChainHash(link.Seq, link.Prev, record)
+			if hex.EncodeToString(hash) != link.Hash {
+				problem("记录 #%d 的内容已被修改 (哈希不匹配)", link.Seq)
+			}
+			if publicKey != nil {
+				sig, err := base64.StdEncoding.DecodeString(link.Sig)
+				if err != nil || !ed25519.Verify(publicKey, hash, sig) {
+					problem("记录 #%d 的签名无效", link.Seq)
+				}
+			}
+
+			if prevLink == nil {
+				report.FirstSeq = link.Seq
+				genesis := link.Seq == 1 && link.Prev == ""
+				// 只有链的第一条记录之前可以有启用哈希链之前写入的记录；同一文件中其他记录之前出现
+				// 没有链字段的记录，说明这些记录的链字段被删除了
+				if !genesis {
+					for _, unchained := range unchainedLines {
+						report.Problems = append(report.Problems, auditChainProblem{File: path, Line: unchained,
+							Message: fmt.Sprintf("没有链字段的记录出现在同一文件的记录 #%d 之前，链字段可能被删除", link.Seq)})
+					}
+				}
+				// 更早的记录只能是随整个文件按保留策略被清理的
+				if !genesis && !anchoredAuditChainStart(checkpoints, link, fileRecords == 1, publicKey) {
+					problem("哈希链从记录 #%d 开始，但它不是检查点中记录的某个日志文件的开头，之前的记录可能被删除", link.Seq)
+				}
+			} else {
+				switch {
+				case link.Seq <= prevLink.Seq:
+					problem("记录 #%d 出现在记录 #%d 之后，记录顺序被调整过", link.Seq, prevLink.Seq)
+				case link.Seq != prevLink.Seq+1:
+					problem("记录 #%d 与 #%d 之间缺少 %d 条记录", prevLink.Seq, link.Seq, link.Seq-prevLink.Seq-1)
+				case link.Prev != prevLink.Hash:
+					problem("记录 #%d 与前一条记录的哈希不连续", link.Seq)
+				}
+			}
+			prevLink = link
+		}
+		err = scanner.Err()
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("读取审计日志 %s 失败: %w", path, err)
+		}
+	}
+
+	if prevLink != nil {
+		report.LastSeq = prevLink.Seq
+		report.LastHash = prevLink.Hash
+	}
+	return report, nil
+}
+
+// anchoredAuditChainStart 判断链的起点 link 是否为检查点中记录的某个日志文件的开头，firstInFile 表示它是所在文件的第一条记录
+func anchoredAuditChainStart(checkpoints map[uint64]auditChainCheckpoint, link *auditChainLink, firstInFile bool, publicKey ed25519.PublicKey) bool {
+	checkpoint, ok := checkpoints[link.Seq]
+	if !firstInFile || !ok || checkpoint.Hash != link.Hash {
+		return false
+	}
+	if publicKey != nil {
+		sig, err := base64.StdEncoding.DecodeString(checkpoint.Sig)
+		if err != nil || !ed25519.Verify(publicKey, computeAuditCheckpointDigest(checkpoint.Seq, checkpoint.Hash), sig) {
+			return false
+		}
+	}
+	return true
+}
+
+// auditSigningKeyPaths 返回审计签名密钥的路径，与 TLS 证书放在同一目录下
+func auditSigningKeyPaths() (keyPath, pubPath string, err error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", fmt.Errorf("无法获取用户主目录: %w", err)
+	}
+	certsDir := filepath.Join(home, ".kube-gateway", "certs")
+	return filepath.Join(certsDir, "audit-signing.key"), filepath.Join(certsDir, "audit-signing.pub"), nil
+}
+
+// newAuditFileChain 为文件输出启用哈希链，按需加载或生成签名密钥
+func newAuditFileChain(inner auditSink, logFile string) (auditSink, error) {
+	var signingKey ed25519.PrivateKey
+	if auditSignChain {
+		keyPath, pubPath, err := auditSigningKeyPaths()
+		if err != nil {
+			return nil, err
+		}
+		if signingKey, err = ensureAuditSigningKey(keyPath, pubPath); err != nil {
+			return nil, err
+		}
+	}
+	sink, err := newHashChainAuditSink(inner, logFile, signingKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("审计日志哈希链已启用 (签名: %t)，从记录 #%d 继续。", signingKey != nil, sink.seq+1)
+	return sink, nil
+}
@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memoryAuditSink 保存写入的每一行
+type memoryAuditSink struct {
+	lines [][]byte
+}
+
+func (s *memoryAuditSink) name() string { return "memory" }
+
+func (s *memoryAuditSink) write(line []byte) error {
+	s.lines = append(s.lines, append([]byte{}, line...))
+	return nil
+}
+
+func writeAuditTestFile(t *testing.T, path string, lines [][]byte) {
+	t.Helper()
+	data := bytes.Join(lines, nil)
+	if strings.HasSuffix(path, ".gz") {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		data = buf.Bytes()
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLogFilesOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{
+			name:  "logrotate",
+			files: []string{"audit.log", "audit.log.1", "audit.log.2.gz", "audit.log.10.gz"},
+			want:  []string{"audit.log.10.gz", "audit.log.2.gz", "audit.log.1", "audit.log"},
+		},
+		{
+			name:  "lumberjack",
+			files: []string{"audit.log", "audit-2026-01-02T00-00-00.000.log.gz", "audit-2026-01-01T00-00-00.000.log"},
+			want:  []string{"audit-2026-01-01T00-00-00.000.log", "audit-2026-01-02T00-00-00.000.log.gz", "audit.log"},
+		},
+		{
+			name:  "ignores unrelated files",
+			files: []string{"audit.log", "audit.log.1", "audit.log.bak", "audit.log.1.tmp"},
+			want:  []string{"audit.log.1", "audit.log"},
+		},
+		{
+			name:  "current file missing",
+			files: []string{"audit.log.1"},
+			want:  []string{"audit.log.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				writeAuditTestFile(t, filepath.Join(dir, name), nil)
+			}
+			files, err := auditLogFiles(filepath.Join(dir, "audit.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, path := range files {
+				got = append(got, filepath.Base(path))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("auditLogFiles = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// auditChainTestFiles 是测试中日志文件的名称，从最早到最新
+var auditChainTestFiles = []string{"audit.log.2.gz", "audit.log.1", "audit.log"}
+
+// writeAuditChainTestLogs 写入三个文件，每个文件 3 条记录。每个文件先写入 audit.log，再像 logrotate 一样移动到备份的位置，
+// 每个文件由新的 sink 从已有日志中恢复链的状态，模拟轮转和重启。返回每个文件中的记录
+func writeAuditChainTestLogs(t *testing.T, logFile string, privateKey ed25519.PrivateKey) [][][]byte {
+	t.Helper()
+	var files [][][]byte
+	seq := 0
+	for _, name := range auditChainTestFiles {
+		file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink, err := newHashChainAuditSink(&writerAuditSink{sinkName: auditSinkFile, writer: file}, logFile, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			seq++
+			if err := sink.write([]byte(fmt.Sprintf(`{"id":%d,"verb":"get"}`+"\n", seq))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		file.Close()
+		data, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		lines = lines[:len(lines)-1]
+		if err := os.Remove(logFile); err != nil {
+			t.Fatal(err)
+		}
+		writeAuditTestFile(t, filepath.Join(filepath.Dir(logFile), name), lines)
+		files = append(files, lines)
+	}
+	return files
+}
+
+func TestVerifyAuditChainAcrossRotation(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	stripChain := func(line []byte) []byte {
+		record, _, _ := splitAuditChainLine(line)
+		return append(record, '\n')
+	}
+
+	tests := []struct {
+		name string
+		// tamper 修改每个文件中的记录，files 依次为 auditChainTestFiles 中的文件
+		tamper    func(files [][][]byte) [][][]byte
+		publicKey ed25519.PublicKey
+		// removed 是按保留策略被清理的文件
+		removed []string
+		// removeCheckpoints 删除检查点文件，forgeCheckpoint 为链的新起点追加一个没有签名的检查点
+		removeCheckpoints bool
+		forgeCheckpoint   bool
+		// restart 在修改之后重新创建 sink，模拟旧版本写入的哈希链升级后第一次启动
+		restart       bool
+		wantProblems  []string
+		wantFirstSeq  uint64
+		wantUnchained int
+	}{
+		{name: "intact chain", publicKey: publicKey, wantFirstSeq: 1},
+		{name: "without signature check", wantFirstSeq: 1},
+		{name: "modified record", publicKey: publicKey, tamper: func(files [][][]byte) [][][]byte {
+			files[1][0] = bytes.Replace(files[1][0], []byte(`"verb":"get"`), []byte(`"verb":"delete"`), 1)
+			return files
+		}, wantProblems: []string{"记录 #4 的内容已被修改"}},
+		{name: "deleted record", tamper: func(files [][][]byte) [][][]byte {
+			files[1] = files[1][1:]
+			return files
+		}, wantProblems: []string{"记录 #3 与 #5 之间缺少 1 条记录"}},
+		{name: "missing backup", tamper: func(files [][][]byte) [][][]byte {
+			files[1] = nil
+			return files
+		}, wantProblems: []string{"记录 #3 与 #7 之间缺少 3 条记录"}},
+		{name: "reordered records", tamper: func(files [][][]byte) [][][]byte {
+			files[2][0], files[2][1] = files[2][1], files[2][0]
+			return files
+		}, wantProblems: []string{"记录 #6 与 #8 之间缺少 1 条记录", "记录 #7 出现在记录 #8 之后"}},
+		{name: "wrong key", publicKey: otherKey, wantProblems: []string{"记录 #1 的签名无效"}},
+		{name: "retention removed the oldest file", publicKey: publicKey, removed: []string{"audit.log.2.gz"}, wantFirstSeq: 4},
+		{name: "retention removed two files", publicKey: publicKey, removed: []string{"audit.log.2.gz", "audit.log.1"}, wantFirstSeq: 7},
+		{name: "unchained records before the genesis record", tamper: func(files [][][]byte) [][][]byte {
+			files[0] = append([][]byte{[]byte(`{"id":0}` + "\n")}, files[0]...)
+			return files
+		}, wantFirstSeq: 1, wantUnchained: 1},
+		{name: "first records deleted", tamper: func(files [][][]byte) [][][]byte {
+			files[0] = files[0][2:]
+			return files
+		}, wantProblems: []string{"哈希链从记录 #3 开始"}},
+		{name: "first records deleted after retention", publicKey: publicKey, removed: []string{"audit.log.2.gz"}, tamper: func(files [][][]byte) [][][]byte {
+			files[1] = files[1][1:]
+			return files
+		}, wantProblems: []string{"哈希链从记录 #5 开始"}},
+		{name: "chain fields stripped from the first records", tamper: func(files [][][]byte) [][][]byte {
+			files[0][0] = bytes.Replace(stripChain(files[0][0]), []byte(`"verb":"get"`), []byte(`"verb":"delete"`), 1)
+			files[0][1] = stripChain(files[0][1])
+			return files
+		}, wantProblems: []string{"没有链字段的记录出现在同一文件的记录 #3 之前", "没有链字段的记录出现在同一文件的记录 #3 之前", "哈希链从记录 #3 开始"}},
+		{name: "checkpoints deleted after retention", removed: []string{"audit.log.2.gz"}, removeCheckpoints: true,
+			wantProblems: []string{"哈希链从记录 #4 开始"}},
+		{name: "forged checkpoint", publicKey: publicKey, removed: []string{"audit.log.2.gz"}, forgeCheckpoint: true, tamper: func(files [][][]byte) [][][]byte {
+			files[1] = files[1][1:]
+			return files
+		}, wantProblems: []string{"哈希链从记录 #5 开始"}},
+		{name: "checkpoints created for an existing chain", publicKey: publicKey, removed: []string{"audit.log.2.gz"}, removeCheckpoints: true, restart: true,
+			wantFirstSeq: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			logFile := filepath.Join(dir, "audit.log")
+			checkpointFile := auditChainCheckpointPath(logFile)
+			files := writeAuditChainTestLogs(t, logFile, privateKey)
+
+			if tt.tamper != nil {
+				files = tt.tamper(files)
+				for i, name := range auditChainTestFiles {
+					writeAuditTestFile(t, filepath.Join(dir, name), files[i])
+				}
+			}
+			for _, name := range tt.removed {
+				if err := os.Remove(filepath.Join(dir, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.removeCheckpoints {
+				if err := os.Remove(checkpointFile); err != nil {
+					t.Fatal(err)
+				}
+			}
+			paths, err := auditLogFiles(logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.forgeCheckpoint {
+				link, err := firstAuditChainLink(paths[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := appendAuditChainCheckpoint(checkpointFile, *link, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.restart {
+				if _, err := newHashChainAuditSink(&memoryAuditSink{}, logFile, privateKey); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			report, err := verifyAuditChain(paths, checkpointFile, tt.publicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var problems []string
+			for _, problem := range report.Problems {
+				problems = append(problems, problem.Message)
+			}
+			if len(problems) < len(tt.wantProblems) || (len(tt.wantProblems) == 0 && len(problems) > 0) {
+				t.Fatalf("problems = %q, want %q", problems, tt.wantProblems)
+			}
+			for i, want := range tt.wantProblems {
+				if !strings.HasPrefix(problems[i], want) {
+					t.Errorf("problem %d = %q, want prefix %q", i, problems[i], want)
+				}
+			}
+			if len(tt.wantProblems) == 0 && (report.FirstSeq != tt.wantFirstSeq || report.LastSeq != 9 || report.Unchained != tt.wantUnchained) {
+				t.Errorf("report = first %d, last %d, unchained %d, want %d, 9, %d", report.FirstSeq, report.LastSeq, report.Unchained, tt.wantFirstSeq, tt.wantUnchained)
+			}
+		})
+	}
+}
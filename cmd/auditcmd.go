@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditFilePath      string
+	auditPublicKeyPath string
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect and verify the gateway audit log",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the hash chain of the audit log and detect deleted, reordered or modified entries",
+	Args:  cobra.NoArgs,
+	Run:   runAuditVerify,
+}
+
+func init() {
+	auditCmd.PersistentFlags().StringVar(&auditFilePath, "file", "", "审计日志文件路径，默认为 ~/.kube-gateway/logs/audit.log (会同时读取轮转后的备份)")
+	auditVerifyCmd.Flags().StringVar(&auditPublicKeyPath, "public-key", "", "用于校验签名的 Ed25519 公钥，默认为 ~/.kube-gateway/certs/audit-signing.pub (存在时)")
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+// defaultAuditLogPath 返回命令行工具读取的审计日志路径
+func defaultAuditLogPath() string {
+	if auditFilePath != "" {
+		return auditFilePath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("错误: 无法获取用户主目录: %v", err)
+	}
+	return filepath.Join(home, ".kube-gateway", "logs", "audit.log")
+}
+
+func runAuditVerify(cmd *cobra.Command, args []string) {
+	logFile := defaultAuditLogPath()
+	files, err := auditLogFiles(logFile)
+	if err != nil {
+		log.Fatalf("错误: 查找审计日志文件失败: %v", err)
+	}
+	if len(files) == 0 {
+		log.Fatalf("错误: 找不到审计日志文件 %s", logFile)
+	}
+
+	// 显式指定公钥时必须能读取；否则只有在默认位置存在公钥时才校验签名
+	var publicKey ed25519.PublicKey
+	pubPath := auditPublicKeyPath
+	if pubPath == "" {
+		if _, defaultPub, err := auditSigningKeyPaths(); err == nil {
+			if _, err := os.Stat(defaultPub); err == nil {
+				pubPath = defaultPub
+			}
+		}
+	}
+	if pubPath != "" {
+		if publicKey, err = loadAuditVerifyKey(pubPath); err != nil {
+			log.Fatalf("错误: %v", err)
+		}
+	}
+
+	fmt.Printf("正在校验 %d 个审计日志文件...\n", len(files))
+	for _, file := range files {
+		fmt.Printf("   - %s\n", file)
+	}
+
+	report, err := verifyAuditChain(files, auditChainCheckpointPath(logFile), publicKey)
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+
+	fmt.Printf("\n共 %d 条记录", report.Records)
+	if report.Unchained > 0 {
+		fmt.Printf("，其中 %d 条没有链字段 (启用哈希链之前写入)", report.Unchained)
+	}
+	fmt.Println("。")
+	if report.LastSeq == 0 {
+		fmt.Println("⚠️  没有找到带哈希链的记录，请使用 'serve --audit-hash-chain' 启用。")
+		return
+	}
+	if publicKey != nil {
+		fmt.Printf("签名校验: 已使用公钥 %s\n", pubPath)
+	} else {
+		fmt.Println("签名校验: 已跳过 (未找到公钥)")
+	}
+	fmt.Printf("哈希链范围: #%d - #%d\n", report.FirstSeq, report.LastSeq)
+	// 哈希链本身无法发现末尾记录被整体截断，需要与外部保存的最后一个哈希进行比对
+	fmt.Printf("最后一条记录的哈希: %s (可保存到外部，用于发现末尾的记录被截断)\n", report.LastHash)
+
+	if len(report.Problems) == 0 {
+		fmt.Println("\n✅ 哈希链完整，没有发现被删除、调整顺序或修改的记录。")
+		if report.FirstSeq > 1 {
+			fmt.Printf("   (记录 #1 - #%d 已随旧的日志文件按保留策略清理，起点与检查点一致)\n", report.FirstSeq-1)
+		}
+		return
+	}
+
+	fmt.Printf("\n❌ 发现 %d 个问题:\n", len(report.Problems))
+	for _, p := range report.Problems {
+		fmt.Printf("   %s:%d: %s\n", p.File, p.Line, p.Message)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"sigs.k8s.io/yaml"
+)
+
+// 审计级别，含义与 K8s 审计策略一致
+const (
+	auditLevelNone            = "None"
+	auditLevelMetadata        = "Metadata"
+	auditLevelRequest         = "Request"
+	auditLevelRequestResponse = "RequestResponse"
+)
+
+var auditLevelOrder = map[string]int{
+	auditLevelNone:            0,
+	auditLevelMetadata:        1,
+	auditLevelRequest:         2,
+	auditLevelRequestResponse: 3,
+}
+
+var (
+	auditPolicyFile   string
+	auditMaxBodyBytes int64
+
+	// currentAuditPolicy 保存当前生效的审计策略，为 nil 时所有请求都按 Metadata 级别记录
+	currentAuditPolicy atomic.Pointer[auditPolicy]
+)
+
+// auditPolicy 参照 audit.k8s.io/v1 的 Policy，规则按顺序匹配，第一条命中的规则决定审计级别
+type auditPolicy struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Rules      []auditPolicyRule `json:"rules"`
+}
+
+// auditPolicyRule 中为空的匹配条件表示匹配所有
+type auditPolicyRule struct {
+	Level string `json:"level"`
+	requestMatcher
+}
+
+// requestMatcher 按集群、动词、资源和命名空间匹配请求，为空的条件表示匹配所有。
+// 审计策略和网关配置中的规则使用相同的写法
+type requestMatcher struct {
+	Clusters   []string             `json:"clusters,omitempty"`
+	Verbs      []string             `json:"verbs,omitempty"`
+	Resources  []auditGroupResource `json:"resources,omitempty"`
+	Namespaces []string             `json:"namespaces,omitempty"`
+}
+
+// auditGroupResource 与 K8s 审计策略中的 GroupResources 一致，
+// resources 支持 "pods/log"、"pods/*" 和 "*/scale" 这样的子资源写法
+type auditGroupResource struct {
+	Group         string   `json:"group"`
+	Resources     []string `json:"resources,omitempty"`
+	ResourceNames []string `json:"resourceNames,omitempty"`
+}
+
+// loadAuditPolicy 读取并校验审计策略文件
+func loadAuditPolicy(path string) (*auditPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取审计策略文件 %s: %w", path, err)
+	}
+	policy := &auditPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("无法解析审计策略文件 %s: %w", path, err)
+	}
+	for i, rule := range policy.Rules {
+		if _, ok := auditLevelOrder[rule.Level]; !ok {
+			return nil, fmt.Errorf("审计策略第 %d 条规则的级别 '%s' 无效，可选值为 None、Metadata、Request、RequestResponse", i+1, rule.Level)
+		}
+	}
+	return policy, nil
+}
+
+// reloadAuditPolicy 重新加载审计策略文件，未指定策略文件时什么也不做
+func reloadAuditPolicy() error {
+	if auditPolicyFile == "" {
+		return nil
+	}
+	policy, err := loadAuditPolicy(auditPolicyFile)
+	if err != nil {
+		return err
+	}
+	currentAuditPolicy.Store(policy)
+	return nil
+}
+
+// auditLevelFor 返回请求对应的审计级别
+func auditLevelFor(clusterName string, info *RequestInfo) string {
+	policy := currentAuditPolicy.Load()
+	if policy == nil {
+		return auditLevelMetadata
+	}
+	for _, rule := range policy.Rules {
+		if rule.matches(clusterName, info) {
+			return rule.Level
+		}
+	}
+	// 与 K8s 一致，没有命中任何规则的请求不记录
+	return auditLevelNone
+}
+
+func (r *requestMatcher) matches(clusterName string, info *RequestInfo) bool {
+	if len(r.Clusters) > 0 && !matchesAny(r.Clusters, clusterName) {
+		return false
+	}
+	if len(r.Verbs) > 0 && !matchesAny(r.Verbs, info.Verb) {
+		return false
+	}
+	if len(r.Namespaces) > 0 {
+		// 集群级别的资源使用空字符串匹配，与 K8s 审计策略相同
+		if !info.IsResourceRequest || !matchesAny(r.Namespaces, info.Namespace) {
+			return false
+		}
+	}
+	if len(r.Resources) > 0 {
+		if !info.IsResourceRequest {
+			return false
+		}
+		matched := false
+		for _, gr := range r.Resources {
+			if gr.matches(info) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (gr *auditGroupResource) matches(info *RequestInfo) bool {
+	if gr.Group != "*" && gr.Group != info.APIGroup {
+		return false
+	}
+	if len(gr.ResourceNames) > 0 && !matchesAny(gr.ResourceNames, info.Name) {
+		return false
+	}
+	if len(gr.Resources) == 0 {
+		return true
+	}
+
+	combined := info.Resource
+	if info.Subresource != "" {
+		combined = info.Resource + "/" + info.Subresource
+	}
+	for _, res := range gr.Resources {
+		switch {
+		case res == "*" || res == combined:
+			return true
+		case strings.HasSuffix(res, "/*") && strings.TrimSuffix(res, "/*") == info.Resource:
+			return true
+		case strings.HasPrefix(res, "*/") && info.Subresource != "" && strings.TrimPrefix(res, "*/") == info.Subresource:
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny 判断 value 是否出现在列表中，"*" 匹配任意值
+func matchesAny(list []string, value string) bool {
+	for _, item := range list {
+		if item == "*" || item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// auditLevelAtLeast 判断 level 是否不低于 min
+func auditLevelAtLeast(level, min string) bool {
+	return auditLevelOrder[level] >= auditLevelOrder[min]
+}
+
+// redactedValue 用于替换 Secret 中的敏感数据
+const redactedValue = "<redacted>"
+
+// prepareAuditBody 校验并处理要写入审计事件的请求体或响应体，
+// Secret 的 data 和 stringData 总是会被脱敏，无法安全解析的 Secret 内容则直接丢弃
+func prepareAuditBody(body []byte, info *RequestInfo) (json.RawMessage, string) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, ""
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(trimmed, &doc); err != nil {
+		// 非 JSON 内容 (例如 protobuf) 无法嵌入到审计事件中，也无法对 Secret 进行脱敏
+		return nil, "non-json"
+	}
+
+	isSecret := info.APIGroup == "" && info.Resource == "secrets"
+	if redactSecrets(doc, isSecret) {
+		redacted, err := json.Marshal(doc)
+		if err != nil {
+			return nil, "non-json"
+		}
+		return redacted, ""
+	}
+	return json.RawMessage(trimmed), ""
+}
+
+// lastAppliedAnnotation 是 kubectl apply 保存完整清单的注解，对 Secret 来说其中包含明文数据
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// lastAppliedPatchPath 是 JSON Patch 中指向 lastAppliedAnnotation 的路径 ("/" 转义为 "~1")
+var lastAppliedPatchPath = "/metadata/annotations/" + strings.ReplaceAll(lastAppliedAnnotation, "/", "~1")
+
+// redactLastApplied 替换注解中 kubectl apply 保存的清单，返回是否修改了内容
+func redactLastApplied(annotations interface{}) bool {
+	values, ok := annotations.(map[string]interface{})
+	if !ok || values[lastAppliedAnnotation] == nil {
+		return false
+	}
+	values[lastAppliedAnnotation] = redactedValue
+	return true
+}
+
+// redactSecrets 递归地对 Secret 数据进行脱敏，返回是否修改了内容。
+// inSecret 为 true 时表示当前文档属于 secrets 资源，此时任意层级的 data、stringData 以及
+// last-applied-configuration 注解都会被脱敏，同时覆盖 JSON Patch 中指向这些字段的操作
+func redactSecrets(node interface{}, inSecret bool) bool {
+	changed := false
+	switch v := node.(type) {
+	case map[string]interface{}:
+		secret := inSecret || v["kind"] == "Secret"
+		for key, child := range v {
+			if secret && (key == "data" || key == "stringData") {
+				// 保留 Secret 数据中的键名，只替换对应的值
+				if values, ok := child.(map[string]interface{}); ok {
+					for dataKey := range values {
+						values[dataKey] = redactedValue
+						changed = true
+					}
+				} else if child != nil {
+					v[key] = redactedValue
+					changed = true
+				}
+				continue
+			}
+			if secret && key == "annotations" && redactLastApplied(child) {
+				changed = true
+				continue
+			}
+			if secret && key == "value" {
+				path, _ := v["path"].(string)
+				if strings.HasPrefix(path, "/data") || strings.HasPrefix(path, "/stringData") || path == lastAppliedPatchPath {
+					v[key] = redactedValue
+					changed = true
+					continue
+				}
+				if path == "/metadata/annotations" && redactLastApplied(child) {
+					changed = true
+					continue
+				}
+			}
+			if redactSecrets(child, secret) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if redactSecrets(child, inSecret) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrepareAuditBodyRedactsSecrets(t *testing.T) {
+	lastApplied := `"kubectl.kubernetes.io/last-applied-configuration":"{\"apiVersion\":\"v1\",\"data\":{\"password\":\"c2VjcmV0\"},\"kind\":\"Secret\"}\n"`
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		// want 是脱敏后的请求体中必须出现的内容，leaked 是不能再出现的内容
+		want   []string
+		leaked []string
+	}{
+		{
+			name:   "data and stringData",
+			path:   "/api/v1/namespaces/default/secrets",
+			body:   `{"kind":"Secret","data":{"password":"c2VjcmV0"},"stringData":{"token":"plain"}}`,
+			want:   []string{`"password":"<redacted>"`, `"token":"<redacted>"`},
+			leaked: []string{"c2VjcmV0", "plain"},
+		},
+		{
+			name:   "last-applied-configuration annotation",
+			path:   "/api/v1/namespaces/default/secrets/db",
+			body:   `{"kind":"Secret","metadata":{"name":"db","annotations":{` + lastApplied + `,"team":"payments"}},"data":{"password":"c2VjcmV0"}}`,
+			want:   []string{`"kubectl.kubernetes.io/last-applied-configuration":"<redacted>"`, `"team":"payments"`},
+			leaked: []string{"c2VjcmV0"},
+		},
+		{
+			name:   "last-applied-configuration in a merge patch",
+			path:   "/api/v1/namespaces/default/secrets/db",
+			body:   `{"metadata":{"annotations":{` + lastApplied + `}},"data":{"password":"c2VjcmV0"}}`,
+			want:   []string{`"kubectl.kubernetes.io/last-applied-configuration":"<redacted>"`},
+			leaked: []string{"c2VjcmV0"},
+		},
+		{
+			name:   "secrets in a list",
+			path:   "/api/v1/secrets",
+			body:   `{"kind":"SecretList","items":[{"metadata":{"annotations":{` + lastApplied + `}},"data":{"password":"c2VjcmV0"}}]}`,
+			want:   []string{`"kubectl.kubernetes.io/last-applied-configuration":"<redacted>"`},
+			leaked: []string{"c2VjcmV0"},
+		},
+		{
+			name:   "JSON patch of data",
+			path:   "/api/v1/namespaces/default/secrets/db",
+			body:   `[{"op":"replace","path":"/data/password","value":"c2VjcmV0"}]`,
+			want:   []string{`"value":"<redacted>"`},
+			leaked: []string{"c2VjcmV0"},
+		},
+		{
+			name:   "JSON patch of the annotation",
+			path:   "/api/v1/namespaces/default/secrets/db",
+			body:   `[{"op":"add","path":"/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration","value":"{\"data\":{\"password\":\"c2VjcmV0\"}}"}]`,
+			want:   []string{`"value":"<redacted>"`},
+			leaked: []string{"c2VjcmV0"},
+		},
+		{
+			name:   "JSON patch of all annotations",
+			path:   "/api/v1/namespaces/default/secrets/db",
+			body:   `[{"op":"replace","path":"/metadata/annotations","value":{` + lastApplied + `,"team":"payments"}}]`,
+			want:   []string{`"kubectl.kubernetes.io/last-applied-configuration":"<redacted>"`, `"team":"payments"`},
+			leaked: []string{"c2VjcmV0"},
+		},
+		{
+			name: "other resources keep the annotation",
+			path: "/api/v1/namespaces/default/configmaps/settings",
+			body: `{"kind":"ConfigMap","metadata":{"annotations":{` + lastApplied + `}},"data":{"mode":"fast"}}`,
+			want: []string{"c2VjcmV0", `"mode":"fast"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := parseRequestInfo(httptest.NewRequest(http.MethodPatch, tt.path, nil))
+			raw, reason := prepareAuditBody([]byte(tt.body), info)
+			if reason != "" {
+				t.Fatalf("body dropped: %s", reason)
+			}
+			// json.Marshal 会把 <redacted> 中的尖括号转义
+			body := strings.NewReplacer(`\u003c`, "<", `\u003e`, ">").Replace(string(raw))
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("body %s does not contain %s", body, want)
+				}
+			}
+			for _, leaked := range tt.leaked {
+				if strings.Contains(body, leaked) {
+					t.Errorf("body %s still contains %s", body, leaked)
+				}
+			}
+		})
+	}
+}
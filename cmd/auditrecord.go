@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditRecord 是从审计日志中读取的一条记录，json 和 k8s-event 两种格式都会被转换为这个结构
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	AuditID     string    `json:"auditID,omitempty"`
+	Cluster     string    `json:"cluster"`
+	User        string    `json:"user"`
+	Token       string    `json:"token"`
+	SourceIP    string    `json:"sourceIP"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	Verb        string    `json:"verb"`
+	APIGroup    string    `json:"apiGroup,omitempty"`
+	Resource    string    `json:"resource,omitempty"`
+	Subresource string    `json:"subresource,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Path        string    `json:"path"`
+	StatusCode  int       `json:"statusCode"`
+	LatencyMs   int64     `json:"latencyMs"`
+	SessionID   string    `json:"sessionID,omitempty"`
+
+	// raw 是原始的日志行 (去掉哈希链字段)
+	raw []byte
+}
+
+// legacyAuditLine 是 json 格式的审计日志行，早期版本只包含其中的一部分字段
+type legacyAuditLine struct {
+	Timestamp   string `json:"timestamp"`
+	SourceIP    string `json:"source_ip"`
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	StatusCode  int    `json:"status_code"`
+	LatencyMs   int64  `json:"latency_ms"`
+	Cluster     string `json:"cluster"`
+	AuditID     string `json:"audit_id"`
+	Verb        string `json:"verb"`
+	User        string `json:"user"`
+	Token       string `json:"token"`
+	UserAgent   string `json:"user_agent"`
+	APIGroup    string `json:"api_group"`
+	Resource    string `json:"resource"`
+	Subresource string `json:"subresource"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	SessionID   string `json:"session_id"`
+}
+
+// parseAuditRecord 解析一行审计日志
+func parseAuditRecord(line []byte) (*auditRecord, error) {
+	raw, _, err := splitAuditChainLine(line)
+	if err != nil {
+		return nil, err
+	}
+
+	var probe struct {
+		Kind       string `json:"kind"`
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, fmt.Errorf("无法解析审计记录: %w", err)
+	}
+
+	if probe.Kind == "Event" && strings.HasPrefix(probe.APIVersion, "audit.k8s.io/") {
+		event := &auditEvent{}
+		if err := json.Unmarshal(raw, event); err != nil {
+			return nil, fmt.Errorf("无法解析审计事件: %w", err)
+		}
+		record := auditRecordFromEvent(event)
+		record.raw = raw
+		return record, nil
+	}
+
+	legacy := &legacyAuditLine{}
+	if err := json.Unmarshal(raw, legacy); err != nil {
+		return nil, fmt.Errorf("无法解析审计记录: %w", err)
+	}
+	record := &auditRecord{
+		AuditID:     legacy.AuditID,
+		Cluster:     legacy.Cluster,
+		User:        legacy.User,
+		Token:       legacy.Token,
+		SourceIP:    legacy.SourceIP,
+		UserAgent:   legacy.UserAgent,
+		Verb:        legacy.Verb,
+		APIGroup:    legacy.APIGroup,
+		Resource:    legacy.Resource,
+		Subresource: legacy.Subresource,
+		Namespace:   legacy.Namespace,
+		Name:        legacy.Name,
+		Path:        legacy.Path,
+		StatusCode:  legacy.StatusCode,
+		LatencyMs:   legacy.LatencyMs,
+		SessionID:   legacy.SessionID,
+		raw:         raw,
+	}
+	record.Time, _ = time.Parse(time.RFC3339, legacy.Timestamp)
+	// 早期版本的记录只有方法和路径，按照相同的规则补全动词和资源信息
+	if record.Verb == "" && legacy.Method != "" {
+		info := parseRequestInfo(&http.Request{Method: legacy.Method, URL: &url.URL{Path: legacy.Path}})
+		record.Verb = info.Verb
+		record.APIGroup = info.APIGroup
+		record.Resource = info.Resource
+		record.Subresource = info.Subresource
+		record.Namespace = info.Namespace
+		record.Name = info.Name
+	}
+	return record, nil
+}
+
+// auditRecordFromEvent 将审计事件转换为 auditRecord
+func auditRecordFromEvent(event *auditEvent) *auditRecord {
+	record := &auditRecord{
+		Time:      event.RequestReceivedTimestamp.Time,
+		AuditID:   event.AuditID,
+		Cluster:   event.Annotations[auditAnnotationCluster],
+		User:      event.User.Username,
+		Token:     event.Annotations[auditAnnotationToken],
+		UserAgent: event.UserAgent,
+		Verb:      event.Verb,
+		Path:      strings.SplitN(event.RequestURI, "?", 2)[0],
+		SessionID: event.Annotations[auditAnnotationSessionID],
+	}
+	if len(event.SourceIPs) > 0 {
+		record.SourceIP = event.SourceIPs[0]
+	}
+	if ref := event.ObjectRef; ref != nil {
+		record.APIGroup = ref.APIGroup
+		record.Resource = ref.Resource
+		record.Subresource = ref.Subresource
+		record.Namespace = ref.Namespace
+		record.Name = ref.Name
+	}
+	if event.ResponseStatus != nil {
+		record.StatusCode = int(event.ResponseStatus.Code)
+	}
+	if latency, err := strconv.ParseInt(event.Annotations[auditAnnotationLatency], 10, 64); err == nil {
+		record.LatencyMs = latency
+	} else {
+		record.LatencyMs = event.StageTimestamp.Sub(event.RequestReceivedTimestamp.Time).Milliseconds()
+	}
+	return record
+}
+
+// isWriteVerb 判断动词是否会修改集群状态
+func isWriteVerb(verb string) bool {
+	switch verb {
+	case "create", "update", "patch", "delete", "deletecollection":
+		return true
+	}
+	return false
+}
+
+// auditRecordFilter 是查询审计记录时的过滤条件，空值表示不过滤
+type auditRecordFilter struct {
+	Since      time.Time
+	Until      time.Time
+	Clusters   []string
+	Users      []string
+	Tokens     []string
+	Verbs      []string
+	Resources  []string
+	Namespaces []string
+	Statuses   []string
+	WritesOnly bool
+}
+
+func (f *auditRecordFilter) matches(r *auditRecord) bool {
+	if !f.Since.IsZero() && r.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !r.Time.Before(f.Until) {
+		return false
+	}
+	if f.WritesOnly && !isWriteVerb(r.Verb) {
+		return false
+	}
+	if len(f.Clusters) > 0 && !matchesAny(f.Clusters, r.Cluster) {
+		return false
+	}
+	if len(f.Users) > 0 && !matchesAny(f.Users, r.User) {
+		return false
+	}
+	if len(f.Tokens) > 0 && !matchesAny(f.Tokens, r.Token) {
+		return false
+	}
+	if len(f.Verbs) > 0 && !matchesAny(f.Verbs, r.Verb) {
+		return false
+	}
+	if len(f.Resources) > 0 {
+		resource := r.Resource
+		if r.Subresource != "" {
+			resource += "/" + r.Subresource
+		}
+		if !matchesAny(f.Resources, r.Resource) && !matchesAny(f.Resources, resource) {
+			return false
+		}
+	}
+	if len(f.Namespaces) > 0 && !matchesAny(f.Namespaces, r.Namespace) {
+		return false
+	}
+	if len(f.Statuses) > 0 && !matchesStatus(f.Statuses, r.StatusCode) {
+		return false
+	}
+	return true
+}
+
+// matchesStatus 支持精确的状态码 (例如 403) 和按类别匹配 (例如 4xx)
+func matchesStatus(patterns []string, code int) bool {
+	value := strconv.Itoa(code)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == value {
+			return true
+		}
+		if len(pattern) == 3 && strings.HasSuffix(pattern, "xx") && len(value) == 3 && pattern[0] == value[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuditTime 解析时间参数，支持 RFC3339 时间、日期 (2006-01-02) 以及相对于现在的时长 (例如 2h)
+func parseAuditTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("无法解析时间 '%s'，支持 RFC3339、2006-01-02 或时长 (例如 2h)", value)
+}
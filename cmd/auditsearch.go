@@ -0,0 +1,326 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditSince        string
+	auditUntil        string
+	auditClusters     []string
+	auditUsers        []string
+	auditTokens       []string
+	auditVerbs        []string
+	auditResources    []string
+	auditNamespaces   []string
+	auditStatuses     []string
+	auditWritesOnly   bool
+	auditOutputFormat string
+	auditTailLines    int
+	auditTailFollow   bool
+)
+
+var auditSearchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "Search audit records across the current and rotated audit log files",
+	Long: `Search audit records across the current and rotated audit log files.
+
+Example:
+  kube-gateway audit search --since 24h --cluster prod --verb create,patch,delete
+  kube-gateway audit search --since 2025-01-01 --until 2025-01-02 --status 4xx -o csv`,
+	Args: cobra.NoArgs,
+	Run:  runAuditSearch,
+}
+
+var auditTailCmd = &cobra.Command{
+	Use:   "tail",
+	Short: "Show the latest audit records and optionally stream new ones as they are written",
+	Args:  cobra.NoArgs,
+	Run:   runAuditTail,
+}
+
+func init() {
+	for _, c := range []*cobra.Command{auditSearchCmd, auditTailCmd} {
+		c.Flags().StringSliceVar(&auditClusters, "cluster", nil, "只显示指定集群的记录")
+		c.Flags().StringSliceVar(&auditUsers, "user", nil, "只显示指定用户的记录 (例如 user-for-dev)")
+		c.Flags().StringSliceVar(&auditTokens, "token", nil, "只显示指定 Token 的记录")
+		c.Flags().StringSliceVar(&auditVerbs, "verb", nil, "只显示指定动词的记录 (例如 get,list,create,patch,delete)")
+		c.Flags().StringSliceVar(&auditResources, "resource", nil, "只显示指定资源的记录 (例如 pods 或 pods/exec)")
+		c.Flags().StringSliceVar(&auditNamespaces, "namespace", nil, "只显示指定命名空间的记录")
+		c.Flags().StringSliceVar(&auditStatuses, "status", nil, "只显示指定状态码的记录 (例如 403 或 5xx)")
+		c.Flags().BoolVar(&auditWritesOnly, "writes-only", false, "只显示会修改集群状态的请求")
+		c.Flags().StringVarP(&auditOutputFormat, "output", "o", "table", "输出格式: table、json 或 csv")
+	}
+	auditSearchCmd.Flags().StringVar(&auditSince, "since", "", "起始时间 (RFC3339、2006-01-02 或时长，例如 2h)")
+	auditSearchCmd.Flags().StringVar(&auditUntil, "until", "", "结束时间 (RFC3339、2006-01-02 或时长，例如 30m)")
+	auditTailCmd.Flags().IntVarP(&auditTailLines, "lines", "n", 10, "先显示最近的记录条数")
+	auditTailCmd.Flags().BoolVarP(&auditTailFollow, "follow", "f", false, "持续输出新写入的记录")
+
+	auditCmd.AddCommand(auditSearchCmd)
+	auditCmd.AddCommand(auditTailCmd)
+}
+
+// buildAuditRecordFilter 根据命令行参数构建过滤条件
+func buildAuditRecordFilter() *auditRecordFilter {
+	now := time.Now()
+	since, err := parseAuditTime(auditSince, now)
+	if err != nil {
+		log.Fatalf("错误: --since: %v", err)
+	}
+	until, err := parseAuditTime(auditUntil, now)
+	if err != nil {
+		log.Fatalf("错误: --until: %v", err)
+	}
+	return &auditRecordFilter{
+		Since:      since,
+		Until:      until,
+		Clusters:   auditClusters,
+		Users:      auditUsers,
+		Tokens:     auditTokens,
+		Verbs:      auditVerbs,
+		Resources:  auditResources,
+		Namespaces: auditNamespaces,
+		Statuses:   auditStatuses,
+		WritesOnly: auditWritesOnly,
+	}
+}
+
+// scanAuditRecords 按顺序读取所有审计日志文件，对每条符合条件的记录调用 fn
+func scanAuditRecords(files []string, filter *auditRecordFilter, fn func(*auditRecord)) error {
+	skipped := 0
+	for _, path := range files {
+		reader, err := openAuditLogReader(path)
+		if err != nil {
+			return fmt.Errorf("无法打开审计日志 %s: %w", path, err)
+		}
+		scanner := newAuditLogScanner(reader)
+		for scanner.Scan() {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			record, err := parseAuditRecord(scanner.Bytes())
+			if err != nil {
+				skipped++
+				continue
+			}
+			if filter.matches(record) {
+				fn(record)
+			}
+		}
+		err = scanner.Err()
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("读取审计日志 %s 失败: %w", path, err)
+		}
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "警告: 跳过了 %d 条无法解析的记录。\n", skipped)
+	}
+	return nil
+}
+
+// auditRecordPrinter 以表格、JSON 或 CSV 格式输出审计记录
+type auditRecordPrinter struct {
+	format string
+	csv    *csv.Writer
+}
+
+const auditTableFormat = "%-20s %-15s %-20s %-16s %-25s %-15s %-30s %-6s %s\n"
+
+func newAuditRecordPrinter(format string) *auditRecordPrinter {
+	p := &auditRecordPrinter{format: format}
+	switch format {
+	case "table":
+		fmt.Printf(auditTableFormat, "时间", "集群", "用户", "动词", "资源", "命名空间", "名称", "状态", "延迟")
+		fmt.Printf(auditTableFormat, strings.Repeat("-", 20), strings.Repeat("-", 15), strings.Repeat("-", 20), strings.Repeat("-", 16),
+			strings.Repeat("-", 25), strings.Repeat("-", 15), strings.Repeat("-", 30), strings.Repeat("-", 6), strings.Repeat("-", 8))
+	case "csv":
+		p.csv = csv.NewWriter(os.Stdout)
+		p.csv.Write([]string{"time", "audit_id", "cluster", "user", "token", "source_ip", "verb", "api_group", "resource",
+			"subresource", "namespace", "name", "path", "status_code", "latency_ms", "user_agent", "session_id"})
+	case "json":
+	default:
+		log.Fatalf("错误: 不支持的输出格式 '%s'，可选值为 table、json、csv", format)
+	}
+	return p
+}
+
+func (p *auditRecordPrinter) print(r *auditRecord) {
+	switch p.format {
+	case "table":
+		resource := r.Resource
+		if r.Subresource != "" {
+			resource += "/" + r.Subresource
+		}
+		if resource == "" {
+			resource = r.Path
+		}
+		fmt.Printf(auditTableFormat, r.Time.Local().Format("2006-01-02 15:04:05"), r.Cluster, r.User, r.Verb,
+			resource, r.Namespace, r.Name, strconv.Itoa(r.StatusCode), fmt.Sprintf("%dms", r.LatencyMs))
+	case "csv":
+		p.csv.Write([]string{r.Time.Format(time.RFC3339Nano), r.AuditID, r.Cluster, r.User, r.Token, r.SourceIP, r.Verb, r.APIGroup,
+			r.Resource, r.Subresource, r.Namespace, r.Name, r.Path, strconv.Itoa(r.StatusCode), strconv.FormatInt(r.LatencyMs, 10), r.UserAgent, r.SessionID})
+		p.csv.Flush()
+	case "json":
+		// 输出原始记录，便于交给 jq 等工具继续处理
+		os.Stdout.Write(r.raw)
+		os.Stdout.Write([]byte("\n"))
+	}
+}
+
+func runAuditSearch(cmd *cobra.Command, args []string) {
+	filter := buildAuditRecordFilter()
+	files, err := auditLogFiles(defaultAuditLogPath())
+	if err != nil {
+		log.Fatalf("错误: 查找审计日志文件失败: %v", err)
+	}
+	if len(files) == 0 {
+		log.Fatalf("错误: 找不到审计日志文件 %s", defaultAuditLogPath())
+	}
+
+	printer := newAuditRecordPrinter(auditOutputFormat)
+	count := 0
+	err = scanAuditRecords(files, filter, func(r *auditRecord) {
+		printer.print(r)
+		count++
+	})
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	if auditOutputFormat == "table" {
+		fmt.Printf("\n共找到 %d 条记录。\n", count)
+	}
+}
+
+func runAuditTail(cmd *cobra.Command, args []string) {
+	filter := buildAuditRecordFilter()
+	logFile := defaultAuditLogPath()
+
+	// 先从当前文件中找出最近的 N 条记录
+	var recent []*auditRecord
+	if _, err := os.Stat(logFile); err == nil {
+		err := scanAuditRecords([]string{logFile}, filter, func(r *auditRecord) {
+			recent = append(recent, r)
+			if len(recent) > auditTailLines {
+				recent = recent[1:]
+			}
+		})
+		if err != nil {
+			log.Fatalf("错误: %v", err)
+		}
+	} else if !auditTailFollow {
+		log.Fatalf("错误: 找不到审计日志文件 %s", logFile)
+	}
+
+	printer := newAuditRecordPrinter(auditOutputFormat)
+	for _, r := range recent {
+		printer.print(r)
+	}
+	if !auditTailFollow {
+		return
+	}
+
+	err := followAuditLog(logFile, func(line []byte) {
+		record, err := parseAuditRecord(line)
+		if err != nil {
+			return
+		}
+		if filter.matches(record) {
+			printer.print(record)
+		}
+	})
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+}
+
+// followAuditLog 从文件末尾开始持续读取新写入的行，文件被轮转或截断后自动重新打开
+func followAuditLog(path string, fn func(line []byte)) error {
+	var file *os.File
+	var reader *bufio.Reader
+	var partial []byte
+
+	open := func(fromEnd bool) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		if fromEnd {
+			if _, err := f.Seek(0, io.SeekEnd); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if file != nil {
+			file.Close()
+		}
+		file = f
+		reader = bufio.NewReader(f)
+		partial = nil
+		return nil
+	}
+
+	// 文件不存在时等待其被创建
+	for {
+		if err := open(true); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("无法打开审计日志 %s: %w", path, err)
+		}
+		time.Sleep(time.Second)
+	}
+	defer func() { file.Close() }()
+
+	for {
+		chunk, err := reader.ReadBytes('\n')
+		partial = append(partial, chunk...)
+		if err == nil {
+			if len(bytes.TrimSpace(partial)) > 0 {
+				fn(partial)
+			}
+			partial = nil
+			continue
+		}
+		if err != io.EOF {
+			return fmt.Errorf("读取审计日志 %s 失败: %w", path, err)
+		}
+
+		time.Sleep(500 * time.Millisecond)
+
+		// 检查文件是否被轮转 (换成了新文件) 或被截断
+		current, statErr := os.Stat(path)
+		if statErr != nil {
+			continue
+		}
+		opened, statErr := file.Stat()
+		if statErr != nil {
+			continue
+		}
+		offset, _ := file.Seek(0, io.SeekCurrent)
+		if !os.SameFile(current, opened) || current.Size() < offset-int64(reader.Buffered()) {
+			// 先读完旧文件中剩余的内容，再从头读取新文件
+			if rest, _ := io.ReadAll(reader); len(rest) > 0 {
+				partial = append(partial, rest...)
+			}
+			for _, line := range bytes.Split(partial, []byte("\n")) {
+				if len(bytes.TrimSpace(line)) > 0 {
+					fn(line)
+				}
+			}
+			if err := open(false); err != nil {
+				continue
+			}
+		}
+	}
+}
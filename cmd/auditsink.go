@@ -0,0 +1,490 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 可选的审计输出
+const (
+	auditSinkFile    = "file"
+	auditSinkStdout  = "stdout"
+	auditSinkWebhook = "webhook"
+	auditSinkSyslog  = "syslog"
+)
+
+var (
+	auditSinks      []string
+	auditBufferSize int
+
+	auditWebhookURL          string
+	auditWebhookBatchSize    int
+	auditWebhookBatchWait    time.Duration
+	auditWebhookSpoolDir     string
+	auditWebhookMaxSpoolSize int
+	auditWebhookMaxSpoolMB   int
+
+	auditSyslogAddress string
+)
+
+var (
+	auditEventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_events_dropped_total",
+		Help:      "Total number of audit events dropped because a sink could not keep up or failed permanently.",
+	}, []string{"sink"})
+
+	auditSinkErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_sink_errors_total",
+		Help:      "Total number of errors returned by audit sinks.",
+	}, []string{"sink"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(auditEventsDropped, auditSinkErrors)
+}
+
+// auditSink 是审计事件的一个输出目标，write 只会被同一个 goroutine 调用
+type auditSink interface {
+	name() string
+	write(line []byte) error
+}
+
+// auditDispatcher 将审计事件异步地分发给所有输出，请求处理永远不会因为某个输出变慢而阻塞
+type auditDispatcher struct {
+	queues []chan []byte
+	sinks  []auditSink
+}
+
+func newAuditDispatcher(sinks []auditSink, bufferSize int) *auditDispatcher {
+	d := &auditDispatcher{sinks: sinks}
+	for _, sink := range sinks {
+		queue := make(chan []byte, bufferSize)
+		d.queues = append(d.queues, queue)
+		go func(sink auditSink, queue chan []byte) {
+			for line := range queue {
+				if err := sink.write(line); err != nil {
+					auditSinkErrors.WithLabelValues(sink.name()).Inc()
+					auditEventsDropped.WithLabelValues(sink.name()).Inc()
+					log.Printf("错误: 写入审计输出 %s 失败: %v", sink.name(), err)
+				}
+			}
+		}(sink, queue)
+	}
+	return d
+}
+
+// emit 将一条审计事件放入每个输出的缓冲队列，队列已满时丢弃并计数
+func (d *auditDispatcher) emit(line []byte) {
+	for i, queue := range d.queues {
+		select {
+		case queue <- line:
+		default:
+			auditEventsDropped.WithLabelValues(d.sinks[i].name()).Inc()
+		}
+	}
+}
+
+// newAuditSinks 根据 --audit-sinks 创建所有审计输出
+func newAuditSinks() ([]auditSink, error) {
+	var sinks []auditSink
+	for _, name := range auditSinks {
+		switch strings.TrimSpace(name) {
+		case auditSinkFile:
+			writer, err := openAuditLogFile()
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("审计日志将写入 %s (单个文件上限 %d MB，保留 %d 个备份，保留 %d 天)", writer.Filename, writer.MaxSize, writer.MaxBackups, writer.MaxAge)
+			var sink auditSink = &writerAuditSink{sinkName: auditSinkFile, writer: writer}
+			if auditHashChain {
+				sink, err = newAuditFileChain(sink, writer.Filename)
+				if err != nil {
+					return nil, err
+				}
+			}
+			sinks = append(sinks, sink)
+		case auditSinkStdout:
+			sinks = append(sinks, &writerAuditSink{sinkName: auditSinkStdout, writer: os.Stdout})
+		case auditSinkWebhook:
+			sink, err := newWebhookAuditSink()
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("审计事件将批量发送到 %s", auditWebhookURL)
+			sinks = append(sinks, sink)
+		case auditSinkSyslog:
+			sink, err := newSyslogAuditSink(auditSyslogAddress)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("审计事件将发送到 syslog %s", auditSyslogAddress)
+			sinks = append(sinks, sink)
+		default:
+			return nil, fmt.Errorf("不支持的审计输出 '%s'，可选值为 file、stdout、webhook、syslog", name)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("至少需要指定一个审计输出")
+	}
+	return sinks, nil
+}
+
+// writerAuditSink 将审计事件逐行写入文件或标准输出
+type writerAuditSink struct {
+	sinkName string
+	writer   io.Writer
+}
+
+func (s *writerAuditSink) name() string { return s.sinkName }
+
+func (s *writerAuditSink) write(line []byte) error {
+	_, err := s.writer.Write(line)
+	return err
+}
+
+// webhookAuditSink 将审计事件攒批后通过 HTTP POST 发送，失败时按指数退避重试，
+// 重试仍然失败的批次会暂存到磁盘上，待接收端恢复后再补发
+type webhookAuditSink struct {
+	endpoint string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending [][]byte
+	timer   *time.Timer
+	batches chan [][]byte
+}
+
+// webhookInitialBackoff 是第一次重试前的等待时间，之后每次翻倍，直到 webhookMaxBackoff
+var webhookInitialBackoff = time.Second
+
+const (
+	webhookMaxBackoff  = 30 * time.Second
+	webhookMaxAttempts = 5
+	// webhookMaxRejectedFiles 是保留的被接收端拒绝的暂存文件数，超出时删除最早的文件
+	webhookMaxRejectedFiles = 100
+)
+
+// webhookStatusError 是接收端返回的非 2xx 状态码
+type webhookStatusError struct {
+	statusCode int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("接收端返回状态码 %d", e.statusCode)
+}
+
+// isPermanentWebhookError 判断接收端是否永久拒绝了一个批次: 除 408 和 429 外的 4xx 重试也不会成功
+func isPermanentWebhookError(err error) bool {
+	var statusErr *webhookStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	code := statusErr.statusCode
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+func newWebhookAuditSink() (*webhookAuditSink, error) {
+	if auditWebhookURL == "" {
+		return nil, fmt.Errorf("使用 webhook 审计输出时必须指定 --audit-webhook-url")
+	}
+	if _, err := url.ParseRequestURI(auditWebhookURL); err != nil {
+		return nil, fmt.Errorf("无效的审计 webhook 地址 %s: %w", auditWebhookURL, err)
+	}
+	if auditWebhookSpoolDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("无法获取用户主目录: %w", err)
+		}
+		auditWebhookSpoolDir = filepath.Join(home, ".kube-gateway", "spool", "webhook")
+	}
+	if err := os.MkdirAll(auditWebhookSpoolDir, 0700); err != nil {
+		return nil, fmt.Errorf("无法创建审计 webhook 暂存目录 %s: %w", auditWebhookSpoolDir, err)
+	}
+
+	s := &webhookAuditSink{
+		endpoint: auditWebhookURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		batches:  make(chan [][]byte, 1),
+	}
+	go s.sendLoop()
+	return s, nil
+}
+
+func (s *webhookAuditSink) name() string { return auditSinkWebhook }
+
+// write 将事件加入当前批次，批次满或等待超时后交给发送协程
+func (s *webhookAuditSink) write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, line)
+	if len(s.pending) >= auditWebhookBatchSize {
+		s.flushLocked()
+		return nil
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(auditWebhookBatchWait, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.flushLocked()
+		})
+	}
+	return nil
+}
+
+func (s *webhookAuditSink) flushLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.pending) == 0 {
+		return
+	}
+	batch := s.pending
+	s.pending = nil
+	select {
+	case s.batches <- batch:
+	default:
+		// 发送协程正忙于重试，直接暂存到磁盘
+		s.spool(batch)
+	}
+}
+
+// sendLoop 依次发送新批次，并在接收端可用时补发磁盘上暂存的批次
+func (s *webhookAuditSink) sendLoop() {
+	ticker := time.NewTicker(webhookMaxBackoff)
+	defer ticker.Stop()
+	for {
+		select {
+		case batch := <-s.batches:
+			if err := s.sendWithRetry(batch); err != nil {
+				if isPermanentWebhookError(err) {
+					auditEventsDropped.WithLabelValues(auditSinkWebhook).Add(float64(len(batch)))
+					log.Printf("错误: 审计 webhook 接收端拒绝了 %d 条事件，已丢弃: %v", len(batch), err)
+					continue
+				}
+				log.Printf("错误: 审计 webhook 发送失败，已暂存 %d 条事件到磁盘: %v", len(batch), err)
+				s.spool(batch)
+				continue
+			}
+			s.replaySpool()
+		case <-ticker.C:
+			s.replaySpool()
+		}
+	}
+}
+
+func (s *webhookAuditSink) sendWithRetry(batch [][]byte) error {
+	backoff := webhookInitialBackoff
+	var err error
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if err = s.send(batch); err == nil {
+			return nil
+		}
+		auditSinkErrors.WithLabelValues(auditSinkWebhook).Inc()
+		if attempt == webhookMaxAttempts || isPermanentWebhookError(err) {
+			break
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, webhookMaxBackoff)
+	}
+	return err
+}
+
+func (s *webhookAuditSink) send(batch [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(encodeAuditBatch(batch)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookStatusError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// encodeAuditBatch 将一批审计事件编码为请求体。k8s-event 格式与 K8s 审计 webhook 一样发送 EventList，
+// json 格式则发送 JSON 数组
+func encodeAuditBatch(batch [][]byte) []byte {
+	var buf bytes.Buffer
+	if auditLogFormat == auditFormatEvent {
+		buf.WriteString(`{"kind":"EventList","apiVersion":"audit.k8s.io/v1","metadata":{},"items":[`)
+	} else {
+		buf.WriteString("[")
+	}
+	for i, line := range batch {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.Write(bytes.TrimSpace(line))
+	}
+	if auditLogFormat == auditFormatEvent {
+		buf.WriteString("]}")
+	} else {
+		buf.WriteString("]")
+	}
+	return buf.Bytes()
+}
+
+// spool 将一批事件写入暂存目录，每个批次一个文件，每行一条事件。
+// 暂存的批次数或总大小超过上限时丢弃新的批次
+func (s *webhookAuditSink) spool(batch [][]byte) {
+	data := bytes.Join(batch, nil)
+	files, _ := filepath.Glob(filepath.Join(auditWebhookSpoolDir, "*.spool"))
+	if auditWebhookMaxSpoolSize > 0 && len(files) >= auditWebhookMaxSpoolSize {
+		auditEventsDropped.WithLabelValues(auditSinkWebhook).Add(float64(len(batch)))
+		log.Printf("错误: 审计 webhook 暂存目录已有 %d 个批次，丢弃 %d 条事件", len(files), len(batch))
+		return
+	}
+	if auditWebhookMaxSpoolMB > 0 {
+		size := int64(len(data))
+		for _, path := range files {
+			if info, err := os.Stat(path); err == nil {
+				size += info.Size()
+			}
+		}
+		if size > int64(auditWebhookMaxSpoolMB)<<20 {
+			auditEventsDropped.WithLabelValues(auditSinkWebhook).Add(float64(len(batch)))
+			log.Printf("错误: 审计 webhook 暂存目录已超过 %d MB，丢弃 %d 条事件", auditWebhookMaxSpoolMB, len(batch))
+			return
+		}
+	}
+	path := filepath.Join(auditWebhookSpoolDir, fmt.Sprintf("%d.spool", time.Now().UnixNano()))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		auditEventsDropped.WithLabelValues(auditSinkWebhook).Add(float64(len(batch)))
+		log.Printf("错误: 写入审计 webhook 暂存文件 %s 失败，丢弃 %d 条事件: %v", path, len(batch), err)
+	}
+}
+
+// replaySpool 按时间顺序补发暂存的批次，遇到可重试的失败立即停止，等待下一次机会。
+// 被接收端拒绝的批次改名为 .rejected 留待排查，不再阻塞之后的批次
+func (s *webhookAuditSink) replaySpool() {
+	files, err := filepath.Glob(filepath.Join(auditWebhookSpoolDir, "*.spool"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("错误: 读取审计 webhook 暂存文件 %s 失败: %v", path, err)
+			continue
+		}
+		var batch [][]byte
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				batch = append(batch, line)
+			}
+		}
+		if err := s.send(batch); err != nil {
+			auditSinkErrors.WithLabelValues(auditSinkWebhook).Inc()
+			if !isPermanentWebhookError(err) {
+				return
+			}
+			auditEventsDropped.WithLabelValues(auditSinkWebhook).Add(float64(len(batch)))
+			log.Printf("错误: 审计 webhook 接收端拒绝了暂存的 %d 条事件，已移至 %s.rejected: %v", len(batch), path, err)
+			rejectSpoolFile(path)
+			continue
+		}
+		os.Remove(path)
+		log.Printf("已补发暂存的 %d 条审计事件", len(batch))
+	}
+}
+
+// rejectSpoolFile 把被拒绝的暂存文件改名，只保留最近的 webhookMaxRejectedFiles 个
+func rejectSpoolFile(path string) {
+	if err := os.Rename(path, path+".rejected"); err != nil {
+		log.Printf("错误: 移动审计 webhook 暂存文件 %s 失败，已删除: %v", path, err)
+		os.Remove(path)
+		return
+	}
+	rejected, _ := filepath.Glob(filepath.Join(auditWebhookSpoolDir, "*.spool.rejected"))
+	sort.Strings(rejected)
+	for len(rejected) > webhookMaxRejectedFiles {
+		os.Remove(rejected[0])
+		rejected = rejected[1:]
+	}
+}
+
+// syslogAuditSink 按照 RFC 5424 将审计事件发送到 syslog 服务器，支持 UDP 和 TCP
+type syslogAuditSink struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+}
+
+// syslogPriority 为 local0.info
+const syslogPriority = 16*8 + 6
+
+func newSyslogAuditSink(rawAddress string) (*syslogAuditSink, error) {
+	if rawAddress == "" {
+		return nil, fmt.Errorf("使用 syslog 审计输出时必须指定 --audit-syslog-address")
+	}
+	u, err := url.Parse(rawAddress)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("无效的 syslog 地址 '%s'，格式应为 udp://host:port 或 tcp://host:port", rawAddress)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	return &syslogAuditSink{network: u.Scheme, address: u.Host, hostname: hostname}, nil
+}
+
+func (s *syslogAuditSink) name() string { return auditSinkSyslog }
+
+func (s *syslogAuditSink) write(line []byte) error {
+	msg := fmt.Sprintf("<%d>1 %s %s kube-gateway %d audit - %s",
+		syslogPriority, time.Now().Format(time.RFC3339Nano), s.hostname, os.Getpid(), bytes.TrimSpace(line))
+	if s.network == "tcp" {
+		// RFC 6587 的 octet-counting 分帧
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	// 连接断开时重连一次，仍然失败则交由调用方记录错误
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(s.conn, msg); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			if attempt == 1 {
+				return err
+			}
+			continue
+		}
+		return nil
+	}
+	return nil
+}
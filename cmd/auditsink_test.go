@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver 按顺序返回 statuses 中的状态码 (最后一个重复使用)，并记录收到的每个批次
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	batches  [][]string
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	r := &webhookReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var events []map[string]interface{}
+		if err := json.Unmarshal(body, &events); err != nil {
+			t.Errorf("webhook body is not a JSON array: %s", body)
+		}
+		var ids []string
+		for _, event := range events {
+			ids = append(ids, fmt.Sprint(event["id"]))
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.batches = append(r.batches, ids)
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status = r.statuses[0]
+			if len(r.statuses) > 1 {
+				r.statuses = r.statuses[1:]
+			}
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) received() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string{}, r.batches...)
+}
+
+// setupWebhookSinkTest 为测试设置审计 webhook 的全局参数，并在测试结束后恢复
+func setupWebhookSinkTest(t *testing.T) {
+	format, batchSize, batchWait := auditLogFormat, auditWebhookBatchSize, auditWebhookBatchWait
+	spoolDir, maxSpoolSize, maxSpoolMB, backoff := auditWebhookSpoolDir, auditWebhookMaxSpoolSize, auditWebhookMaxSpoolMB, webhookInitialBackoff
+	t.Cleanup(func() {
+		auditLogFormat, auditWebhookBatchSize, auditWebhookBatchWait = format, batchSize, batchWait
+		auditWebhookSpoolDir, auditWebhookMaxSpoolSize, auditWebhookMaxSpoolMB, webhookInitialBackoff = spoolDir, maxSpoolSize, maxSpoolMB, backoff
+	})
+	auditLogFormat = auditFormatJSON
+	auditWebhookBatchSize = 3
+	auditWebhookBatchWait = 50 * time.Millisecond
+	auditWebhookSpoolDir = t.TempDir()
+	auditWebhookMaxSpoolSize = 0
+	auditWebhookMaxSpoolMB = 0
+	webhookInitialBackoff = time.Millisecond
+}
+
+func newTestWebhookSink(endpoint string) *webhookAuditSink {
+	return &webhookAuditSink{endpoint: endpoint, client: &http.Client{Timeout: 5 * time.Second}, batches: make(chan [][]byte, 1)}
+}
+
+func auditTestBatch(ids ...int) [][]byte {
+	var batch [][]byte
+	for _, id := range ids {
+		batch = append(batch, []byte(fmt.Sprintf(`{"id":%d}`+"\n", id)))
+	}
+	return batch
+}
+
+func makeRange(n int) []int {
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids
+}
+
+func spoolFiles(t *testing.T, pattern string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(auditWebhookSpoolDir, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWebhookAuditSinkBatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   int
+		wantSize int
+		// wantWait 表示批次要等到 batchWait 之后才会发出
+		wantWait bool
+	}{
+		{name: "full batch is sent at once", events: 3, wantSize: 3},
+		{name: "partial batch is sent after the wait", events: 2, wantSize: 2, wantWait: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupWebhookSinkTest(t)
+			sink := newTestWebhookSink("http://127.0.0.1:0")
+			start := time.Now()
+			for _, line := range auditTestBatch(makeRange(tt.events)...) {
+				sink.write(line)
+			}
+			select {
+			case batch := <-sink.batches:
+				if len(batch) != tt.wantSize {
+					t.Errorf("batch size = %d, want %d", len(batch), tt.wantSize)
+				}
+				if waited := time.Since(start) >= auditWebhookBatchWait; waited != tt.wantWait {
+					t.Errorf("batch sent after %s, want waiting = %v", time.Since(start), tt.wantWait)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no batch was flushed")
+			}
+		})
+	}
+}
+
+func TestWebhookAuditSinkSendWithRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		wantErr       bool
+		wantPermanent bool
+		wantAttempts  int
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, wantAttempts: 1},
+		{name: "retries server errors", statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, wantAttempts: 3},
+		{name: "retries throttling", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, wantAttempts: 2},
+		{name: "retries request timeout", statuses: []int{http.StatusRequestTimeout, http.StatusOK}, wantAttempts: 2},
+		{name: "gives up after max attempts", statuses: []int{http.StatusServiceUnavailable}, wantErr: true, wantAttempts: webhookMaxAttempts},
+		{name: "does not retry rejected batches", statuses: []int{http.StatusBadRequest}, wantErr: true, wantPermanent: true, wantAttempts: 1},
+		{name: "does not retry unauthorized", statuses: []int{http.StatusUnauthorized}, wantErr: true, wantPermanent: true, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupWebhookSinkTest(t)
+			receiver := newWebhookReceiver(t, tt.statuses...)
+			sink := newTestWebhookSink(receiver.URL)
+			err := sink.sendWithRetry(auditTestBatch(1, 2))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error = %v", err, tt.wantErr)
+			}
+			if isPermanentWebhookError(err) != tt.wantPermanent {
+				t.Errorf("permanent = %v, want %v", isPermanentWebhookError(err), tt.wantPermanent)
+			}
+			received := receiver.received()
+			if len(received) != tt.wantAttempts {
+				t.Fatalf("attempts = %d, want %d", len(received), tt.wantAttempts)
+			}
+			if got := strings.Join(received[0], ","); got != "1,2" {
+				t.Errorf("batch = %s, want 1,2", got)
+			}
+		})
+	}
+}
+
+func TestWebhookAuditSinkSpoolAndReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		// maxSpoolSize 和 maxSpoolMB 是暂存目录的上限，0 表示不限制
+		maxSpoolSize int
+		maxSpoolMB   int
+		batches      [][][]byte
+		statuses     []int
+		// wantReceived 是补发时接收端收到的批次，wantSpooled 和 wantRejected 是补发后剩余的暂存文件数
+		wantReceived []string
+		wantSpooled  int
+		wantRejected int
+	}{
+		{
+			name:         "replays batches in order",
+			batches:      [][][]byte{auditTestBatch(1, 2), auditTestBatch(3)},
+			wantReceived: []string{"1,2", "3"},
+		},
+		{
+			name:         "stops at a retryable failure",
+			batches:      [][][]byte{auditTestBatch(1, 2), auditTestBatch(3)},
+			statuses:     []int{http.StatusServiceUnavailable},
+			wantReceived: []string{"1,2"},
+			wantSpooled:  2,
+		},
+		{
+			name:         "moves a rejected batch aside",
+			batches:      [][][]byte{auditTestBatch(1, 2), auditTestBatch(3)},
+			statuses:     []int{http.StatusBadRequest, http.StatusOK},
+			wantReceived: []string{"1,2", "3"},
+			wantRejected: 1,
+		},
+		{
+			name:         "drops batches beyond the file limit",
+			maxSpoolSize: 1,
+			batches:      [][][]byte{auditTestBatch(1, 2), auditTestBatch(3)},
+			wantReceived: []string{"1,2"},
+		},
+		{
+			name:         "drops batches beyond the size limit",
+			maxSpoolMB:   1,
+			batches:      [][][]byte{auditTestBatch(1), {[]byte(`{"id":2,"padding":"` + strings.Repeat("x", 1<<20) + `"}` + "\n")}},
+			wantReceived: []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupWebhookSinkTest(t)
+			auditWebhookMaxSpoolSize, auditWebhookMaxSpoolMB = tt.maxSpoolSize, tt.maxSpoolMB
+			receiver := newWebhookReceiver(t, tt.statuses...)
+			sink := newTestWebhookSink(receiver.URL)
+			for _, batch := range tt.batches {
+				sink.spool(batch)
+				// 暂存文件以纳秒时间戳命名，保证文件名不同
+				time.Sleep(time.Millisecond)
+			}
+			sink.replaySpool()
+
+			var received []string
+			for _, batch := range receiver.received() {
+				received = append(received, strings.Join(batch, ","))
+			}
+			if strings.Join(received, " ") != strings.Join(tt.wantReceived, " ") {
+				t.Errorf("received %q, want %q", received, tt.wantReceived)
+			}
+			if spooled := spoolFiles(t, "*.spool"); len(spooled) != tt.wantSpooled {
+				t.Errorf("%d batches left in the spool, want %d", len(spooled), tt.wantSpooled)
+			}
+			if rejected := spoolFiles(t, "*.spool.rejected"); len(rejected) != tt.wantRejected {
+				t.Errorf("%d rejected files, want %d", len(rejected), tt.wantRejected)
+			}
+		})
+	}
+}
+
+func TestRejectSpoolFileKeepsNewest(t *testing.T) {
+	setupWebhookSinkTest(t)
+	for i := 0; i < webhookMaxRejectedFiles+5; i++ {
+		path := filepath.Join(auditWebhookSpoolDir, fmt.Sprintf("%04d.spool", i))
+		if err := os.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		rejectSpoolFile(path)
+	}
+	rejected := spoolFiles(t, "*.spool.rejected")
+	if len(rejected) != webhookMaxRejectedFiles {
+		t.Fatalf("%d rejected files kept, want %d", len(rejected), webhookMaxRejectedFiles)
+	}
+	if filepath.Base(rejected[0]) != "0005.spool.rejected" {
+		t.Errorf("oldest kept file = %s, want 0005.spool.rejected", filepath.Base(rejected[0]))
+	}
+}
@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// auditSinkStream 是管理端口上实时推送审计事件的内部输出，启用审计日志和管理端口时自动添加
+const auditSinkStream = "stream"
+
+var (
+	adminTokenFile string
+	adminToken     string
+
+	// auditStreamEnabled 表示审计日志已启用，实时推送接口可以使用
+	auditStreamEnabled atomic.Bool
+
+	auditStream = &auditStreamHub{subscribers: make(map[*auditStreamSubscriber]struct{})}
+)
+
+var auditStreamSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "audit_stream_subscribers",
+	Help:      "Number of clients currently connected to the audit event stream.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(auditStreamSubscribers)
+}
+
+// auditStreamSubscriber 是一个连接到实时推送接口的客户端
+type auditStreamSubscriber struct {
+	filter  *auditRecordFilter
+	events  chan *auditRecord
+	dropped atomic.Int64
+}
+
+// auditStreamHub 将审计事件分发给所有订阅者，订阅者处理过慢时丢弃事件，不会阻塞其他输出
+type auditStreamHub struct {
+	mu          sync.RWMutex
+	subscribers map[*auditStreamSubscriber]struct{}
+}
+
+func (h *auditStreamHub) subscribe(filter *auditRecordFilter) *auditStreamSubscriber {
+	sub := &auditStreamSubscriber{filter: filter, events: make(chan *auditRecord, 1000)}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	auditStreamSubscribers.Inc()
+	return sub
+}
+
+func (h *auditStreamHub) unsubscribe(sub *auditStreamSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+	auditStreamSubscribers.Dec()
+}
+
+func (h *auditStreamHub) name() string { return auditSinkStream }
+
+// write 实现 auditSink，没有订阅者时不解析事件
+func (h *auditStreamHub) write(line []byte) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.subscribers) == 0 {
+		return nil
+	}
+	record, err := parseAuditRecord(line)
+	if err != nil {
+		return err
+	}
+	for sub := range h.subscribers {
+		if !sub.filter.matches(record) {
+			continue
+		}
+		select {
+		case sub.events <- record:
+		default:
+			sub.dropped.Add(1)
+			auditEventsDropped.WithLabelValues(auditSinkStream).Inc()
+		}
+	}
+	return nil
+}
+
+// auditStreamAllowed 判断是否可以提供 /audit/stream: 管理端口使用 TLS，或者只监听本地回环地址，
+// 以免管理端口 Token 和审计事件以明文在网络上传输
+func auditStreamAllowed() bool {
+	if adminTLS {
+		return true
+	}
+	host, _, err := net.SplitHostPort(adminAddress)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorizeAdminRequest 校验管理端口请求携带的 Bearer Token
+func authorizeAdminRequest(req *http.Request) bool {
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || adminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// auditStreamFilterFromQuery 从查询参数构建过滤条件，多个值可以用逗号分隔或重复指定参数
+func auditStreamFilterFromQuery(query url.Values) (*auditRecordFilter, error) {
+	list := func(name string) []string {
+		var values []string
+		for _, value := range query[name] {
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+		return values
+	}
+	filter := &auditRecordFilter{
+		Clusters:   list("cluster"),
+		Users:      list("user"),
+		Tokens:     list("token"),
+		Verbs:      list("verb"),
+		Resources:  list("resource"),
+		Namespaces: list("namespace"),
+		Statuses:   list("status"),
+	}
+	switch query.Get("writesOnly") {
+	case "", "false", "0":
+	case "true", "1":
+		filter.WritesOnly = true
+	default:
+		return nil, fmt.Errorf("writesOnly 参数只能为 true 或 false")
+	}
+	return filter, nil
+}
+
+// handleAuditStream 以 Server-Sent Events 的形式推送审计事件
+func handleAuditStream(w http.ResponseWriter, r *http.Request) {
+	if !auditStreamAllowed() {
+		http.Error(w, "管理端口未启用 TLS 且不是本地回环地址，/audit/stream 已禁用，请使用 'serve --admin-tls' 启动网关", http.StatusForbidden)
+		return
+	}
+	if !authorizeAdminRequest(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kube-gateway-admin"`)
+		http.Error(w, "未授权: 缺少或无效的管理端口 Token", http.StatusUnauthorized)
+		return
+	}
+	if !auditStreamEnabled.Load() {
+		http.Error(w, "审计日志未启用，请使用 'serve --enable-audit-log' 启动网关", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := auditStreamFilterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持流式响应", http.StatusInternalServerError)
+		return
+	}
+
+	sub := auditStream.subscribe(filter)
+	defer auditStream.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	// 定期发送注释行，避免中间的代理因连接空闲而将其断开
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	var reported int64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case record := <-sub.events:
+			// 通知客户端有事件因处理过慢被丢弃
+			if dropped := sub.dropped.Load(); dropped > reported {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped-reported)
+				reported = dropped
+			}
+			if record.AuditID != "" {
+				fmt.Fprintf(w, "id: %s\n", record.AuditID)
+			}
+			fmt.Fprintf(w, "event: audit\ndata: %s\n\n", record.raw)
+		}
+		flusher.Flush()
+	}
+}
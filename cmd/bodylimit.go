@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// errRequestBodyTooLarge 在分块传输的请求体读取到超过上限时返回，不计为后端的连接失败
+var errRequestBodyTooLarge = errors.New("请求体超过了网关的大小限制")
+
+var requestBodyRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "request_body_rejected_total",
+	Help:      "Total number of requests rejected because the request body exceeded the configured size limit.",
+}, []string{"cluster", "token", "verb"})
+
+func init() {
+	metricsRegistry.MustRegister(requestBodyRejections)
+}
+
+// bodyVerbs 是可以单独设置请求体上限的动词
+var bodyVerbs = map[string]bool{
+	"create": true, "update": true, "patch": true, "delete": true, "deletecollection": true,
+	"get": true, "list": true, "post": true, "put": true,
+}
+
+// bodySizeLimits 设置一个集群的请求体上限，verbs 中按动词单独设置的值优先于 maxBytes，0 表示不限制
+type bodySizeLimits struct {
+	MaxBytes resource.Quantity            `json:"maxBytes,omitempty"`
+	Verbs    map[string]resource.Quantity `json:"verbs,omitempty"`
+}
+
+// bodyLimitConfig 是 gateway.yaml 中的 bodyLimits 部分。perCluster 是所有集群的默认值，
+// clusters 中可以按名称单独覆盖，命中 exemptions 中任意一条规则的请求不受限制
+type bodyLimitConfig struct {
+	PerCluster bodySizeLimits            `json:"perCluster,omitempty"`
+	Clusters   map[string]bodySizeLimits `json:"clusters,omitempty"`
+	Exemptions []requestMatcher          `json:"exemptions,omitempty"`
+}
+
+// limitFor 返回请求体的字节数上限，按 集群+动词、集群、默认+动词、默认 的顺序取第一个设置的值
+func (c *bodyLimitConfig) limitFor(clusterName, verb string) int64 {
+	candidates := []bodySizeLimits{c.Clusters[clusterName], c.PerCluster}
+	for _, limits := range candidates {
+		if q, ok := limits.Verbs[verb]; ok && !q.IsZero() {
+			return q.Value()
+		}
+		if !limits.MaxBytes.IsZero() {
+			return limits.MaxBytes.Value()
+		}
+	}
+	return 0
+}
+
+func (c *bodyLimitConfig) validate() error {
+	check := func(where string, limits bodySizeLimits) error {
+		if limits.MaxBytes.Sign() < 0 {
+			return fmt.Errorf("bodyLimits.%s.maxBytes 不能为负数", where)
+		}
+		for verb, q := range limits.Verbs {
+			if !bodyVerbs[verb] {
+				return fmt.Errorf("bodyLimits.%s.verbs 中的动词 '%s' 无效", where, verb)
+			}
+			if q.Sign() < 0 {
+				return fmt.Errorf("bodyLimits.%s.verbs.%s 不能为负数", where, verb)
+			}
+		}
+		return nil
+	}
+	if err := check("perCluster", c.PerCluster); err != nil {
+		return err
+	}
+	for name, limits := range c.Clusters {
+		if err := check("clusters."+name, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bodyLimitRejection 描述一次因请求体过大被拒绝的请求
+type bodyLimitRejection struct {
+	limit int64
+}
+
+// message 返回给客户端的说明
+func (r *bodyLimitRejection) message(clusterName string) string {
+	return fmt.Sprintf("请求体过大: 集群 %s 的请求体不能超过 %s", clusterName, resource.NewQuantity(r.limit, resource.BinarySI).String())
+}
+
+// checkBodyLimit 检查请求体的大小。带有 Content-Length 的请求直接比较，
+// 分块传输的请求体在转发过程中计数，超出上限时中止转发。协议升级请求的数据不经过请求体，不做限制
+func checkBodyLimit(req *http.Request, clusterName, tokenName string, info *RequestInfo) *bodyLimitRejection {
+	if req.Body == nil || req.Body == http.NoBody || isUpgradeRequest(req) {
+		return nil
+	}
+	config := &gatewayConfigSnapshot().BodyLimits
+	limit := config.limitFor(clusterName, info.Verb)
+	if limit <= 0 {
+		return nil
+	}
+	for _, exemption := range config.Exemptions {
+		if exemption.matches(clusterName, info) {
+			return nil
+		}
+	}
+	if req.ContentLength > limit {
+		requestBodyRejections.WithLabelValues(clusterName, tokenName, info.Verb).Inc()
+		return &bodyLimitRejection{limit: limit}
+	}
+	if req.ContentLength < 0 {
+		req.Body = &limitedRequestBody{ReadCloser: req.Body, remaining: limit, onExceeded: func() {
+			requestBodyRejections.WithLabelValues(clusterName, tokenName, info.Verb).Inc()
+		}}
+	}
+	return nil
+}
+
+// limitedRequestBody 在读取的字节数超过上限时返回 errRequestBodyTooLarge
+type limitedRequestBody struct {
+	io.ReadCloser
+	remaining  int64
+	onExceeded func()
+}
+
+func (b *limitedRequestBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	// 多读一个字节，用于判断请求体是否恰好等于上限
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.onExceeded()
+		return 0, errRequestBodyTooLarge
+	}
+	return n, err
+}
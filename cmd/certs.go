@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"log"
@@ -12,6 +14,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -92,3 +95,99 @@ func ensureCerts(certPath, keyPath, publicAddress string) error {
 	log.Printf("✅ 成功生成并保存证书到 %s 和 %s", certPath, keyPath)
 	return nil
 }
+
+// ensureAuditSigningKey 确保用于签名审计哈希链的 Ed25519 密钥存在，不存在时自动生成
+func ensureAuditSigningKey(keyPath, pubPath string) (ed25519.PrivateKey, error) {
+	if keyPEM, err := os.ReadFile(keyPath); err == nil {
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("无法解析审计签名私钥 %s", keyPath)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("无法解析审计签名私钥 %s: %w", keyPath, err)
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("审计签名私钥 %s 不是 Ed25519 密钥", keyPath)
+		}
+		return privateKey, nil
+	}
+
+	log.Println("未找到审计签名密钥，正在自动生成新的 Ed25519 密钥...")
+
+	keyDir := filepath.Dir(keyPath)
+	if err := os.MkdirAll(keyDir, 0755); err != nil {
+		return nil, fmt.Errorf("无法创建密钥目录 %s: %w", keyDir, err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("生成 Ed25519 密钥失败: %w", err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("编码审计签名私钥失败: %w", err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("编码审计签名公钥失败: %w", err)
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+		return nil, fmt.Errorf("写入审计签名私钥失败: %w", err)
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0644); err != nil {
+		return nil, fmt.Errorf("写入审计签名公钥失败: %w", err)
+	}
+
+	log.Printf("✅ 成功生成并保存审计签名密钥到 %s 和 %s", keyPath, pubPath)
+	return privateKey, nil
+}
+
+// loadAuditVerifyKey 读取用于校验审计哈希链签名的 Ed25519 公钥
+func loadAuditVerifyKey(pubPath string) (ed25519.PublicKey, error) {
+	pubPEM, err := os.ReadFile(pubPath)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取审计签名公钥 %s: %w", pubPath, err)
+	}
+	block, _ := pem.Decode(pubPEM)
+	if block == nil {
+		return nil, fmt.Errorf("无法解析审计签名公钥 %s", pubPath)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析审计签名公钥 %s: %w", pubPath, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("审计签名公钥 %s 不是 Ed25519 密钥", pubPath)
+	}
+	return publicKey, nil
+}
+
+// ensureAdminToken 读取管理端口的访问 Token，不存在时自动生成
+func ensureAdminToken(tokenPath string) (string, error) {
+	if tokenBytes, err := os.ReadFile(tokenPath); err == nil {
+		token := strings.TrimSpace(string(tokenBytes))
+		if token == "" {
+			return "", fmt.Errorf("管理端口 Token 文件 %s 为空", tokenPath)
+		}
+		return token, nil
+	}
+
+	tokenDir := filepath.Dir(tokenPath)
+	if err := os.MkdirAll(tokenDir, 0755); err != nil {
+		return "", fmt.Errorf("无法创建目录 %s: %w", tokenDir, err)
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("生成管理端口 Token 失败: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.WriteFile(tokenPath, []byte(token), 0600); err != nil {
+		return "", fmt.Errorf("写入管理端口 Token 失败: %w", err)
+	}
+	log.Printf("✅ 已生成管理端口访问 Token 并保存到 %s", tokenPath)
+	return token, nil
+}
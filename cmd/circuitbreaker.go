@@ -0,0 +1,383 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// 熔断器的默认参数
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitOpenDuration     = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+	circuitStateClosed             = "closed"
+	circuitStateOpen               = "open"
+	circuitStateHalfOpen           = "half-open"
+	// circuitProbeTimeout 是熔断期间后台 /readyz 探测的超时时间
+	circuitProbeTimeout = 5 * time.Second
+)
+
+var (
+	circuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_state",
+		Help:      "Current circuit breaker state per cluster (0 = closed, 1 = half-open, 2 = open).",
+	}, []string{"cluster"})
+
+	circuitBreakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Total number of circuit breaker state changes per cluster.",
+	}, []string{"cluster", "from", "to"})
+
+	circuitBreakerRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_rejected_requests_total",
+		Help:      "Total number of requests rejected without contacting the backend because the circuit was open.",
+	}, []string{"cluster", "token"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(circuitBreakerState, circuitBreakerTransitions, circuitBreakerRejections)
+}
+
+// circuitBreakerSettings 设置一个集群的熔断参数，未设置的字段使用默认值。
+// 连续 failureThreshold 次无法连接后端时熔断，openDuration 之后放行 halfOpenRequests 个请求试探后端是否恢复
+type circuitBreakerSettings struct {
+	Disabled         bool            `json:"disabled,omitempty"`
+	FailureThreshold int             `json:"failureThreshold,omitempty"`
+	OpenDuration     metav1.Duration `json:"openDuration,omitempty"`
+	HalfOpenRequests int             `json:"halfOpenRequests,omitempty"`
+}
+
+// circuitBreakerConfig 是 gateway.yaml 中的 circuitBreaker 部分，
+// perCluster 是所有集群的默认值，clusters 中可以按名称单独覆盖
+type circuitBreakerConfig struct {
+	PerCluster circuitBreakerSettings            `json:"perCluster,omitempty"`
+	Clusters   map[string]circuitBreakerSettings `json:"clusters,omitempty"`
+}
+
+// settingsFor 按字段合并默认值和单独的配置
+func (c *circuitBreakerConfig) settingsFor(clusterName string) circuitBreakerSettings {
+	settings := c.PerCluster
+	if override, ok := c.Clusters[clusterName]; ok {
+		if override.Disabled {
+			settings.Disabled = true
+		}
+		if override.FailureThreshold != 0 {
+			settings.FailureThreshold = override.FailureThreshold
+		}
+		if override.OpenDuration.Duration != 0 {
+			settings.OpenDuration = override.OpenDuration
+		}
+		if override.HalfOpenRequests != 0 {
+			settings.HalfOpenRequests = override.HalfOpenRequests
+		}
+	}
+	if settings.FailureThreshold == 0 {
+		settings.FailureThreshold = defaultCircuitFailureThreshold
+	}
+	if settings.OpenDuration.Duration == 0 {
+		settings.OpenDuration.Duration = defaultCircuitOpenDuration
+	}
+	if settings.HalfOpenRequests == 0 {
+		settings.HalfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+	return settings
+}
+
+func (c *circuitBreakerConfig) validate() error {
+	check := func(where string, settings circuitBreakerSettings) error {
+		if settings.FailureThreshold < 0 || settings.OpenDuration.Duration < 0 || settings.HalfOpenRequests < 0 {
+			return fmt.Errorf("circuitBreaker.%s 中的值不能为负数", where)
+		}
+		return nil
+	}
+	if err := check("perCluster", c.PerCluster); err != nil {
+		return err
+	}
+	for name, settings := range c.Clusters {
+		if err := check("clusters."+name, settings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// circuitBreaker 记录一个集群后端的连续失败次数，状态变化为 closed -> open -> half-open -> closed/open
+type circuitBreaker struct {
+	clusterName string
+
+	mu                  sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	probes              int
+	// probing 表示后台探测正在运行，熔断期间每隔 openDuration 探测一次后端的 /readyz
+	probing bool
+}
+
+// circuitBreakerRegistry 按集群名保存熔断器，同一集群的普通请求和协议升级请求共用一个熔断器
+type circuitBreakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+var circuitBreakers = &circuitBreakerRegistry{breakers: make(map[string]*circuitBreaker)}
+
+func (r *circuitBreakerRegistry) get(clusterName string) *circuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	breaker, ok := r.breakers[clusterName]
+	if !ok {
+		breaker = &circuitBreaker{clusterName: clusterName, state: circuitStateClosed}
+		circuitBreakerState.WithLabelValues(clusterName).Set(0)
+		r.breakers[clusterName] = breaker
+	}
+	return breaker
+}
+
+// setStateLocked 切换状态，并记录日志和指标
+func (b *circuitBreaker) setStateLocked(state string, reason string) {
+	if b.state == state {
+		return
+	}
+	circuitBreakerTransitions.WithLabelValues(b.clusterName, b.state, state).Inc()
+	log.Printf("集群 %s 的熔断器状态变化: %s -> %s (%s)", b.clusterName, b.state, state, reason)
+	b.state = state
+	switch state {
+	case circuitStateClosed:
+		circuitBreakerState.WithLabelValues(b.clusterName).Set(0)
+	case circuitStateHalfOpen:
+		circuitBreakerState.WithLabelValues(b.clusterName).Set(1)
+	case circuitStateOpen:
+		circuitBreakerState.WithLabelValues(b.clusterName).Set(2)
+		if !b.probing {
+			b.probing = true
+			go b.probeWhileOpen()
+		}
+	}
+}
+
+// probeWhileOpen 在熔断期间定期探测后端，后端恢复后关闭熔断器，
+// 这样长时间没有请求时，恢复后的第一批请求不会因为等待真实请求试探而收到 503
+func (b *circuitBreaker) probeWhileOpen() {
+	for {
+		settings := gatewayConfigSnapshot().CircuitBreaker.settingsFor(b.clusterName)
+		b.mu.Lock()
+		if b.state == circuitStateClosed || settings.Disabled {
+			b.probing = false
+			b.mu.Unlock()
+			return
+		}
+		wait := time.Until(b.openedAt.Add(settings.OpenDuration.Duration))
+		b.mu.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+
+		proxy := proxyForCluster(b.clusterName)
+		if proxy == nil {
+			// 集群已在 reload 时被移除
+			b.mu.Lock()
+			b.probing = false
+			b.mu.Unlock()
+			return
+		}
+		err := probeClusterReadyz(proxy)
+		b.mu.Lock()
+		switch {
+		case b.state == circuitStateClosed:
+		case err == nil:
+			b.consecutiveFailures = 0
+			b.setStateLocked(circuitStateClosed, "后台探测 /readyz 成功，后端已恢复")
+		default:
+			b.openedAt = time.Now()
+			b.setStateLocked(circuitStateOpen, fmt.Sprintf("后台探测 /readyz 失败: %v", err))
+		}
+		if b.state == circuitStateClosed {
+			b.probing = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+	}
+}
+
+// probeClusterReadyz 通过集群的反向代理访问后端的 /readyz，收到非 5xx 响应即认为后端可以正常处理请求
+func probeClusterReadyz(proxy *httputil.ReverseProxy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), circuitProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/readyz", nil)
+	if err != nil {
+		return err
+	}
+	proxy.Director(req)
+	resp, err := proxy.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("后端返回状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// allow 判断请求是否可以转发到后端。熔断期间返回还需等待的时间；
+// 熔断时间结束后进入 half-open 状态，只放行有限个试探请求
+func (b *circuitBreaker) allow(settings circuitBreakerSettings, now time.Time) (probe bool, retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitStateOpen:
+		if remaining := b.openedAt.Add(settings.OpenDuration.Duration).Sub(now); remaining > 0 {
+			return false, remaining, false
+		}
+		b.setStateLocked(circuitStateHalfOpen, "熔断时间结束，开始试探后端")
+		b.probes = 0
+		fallthrough
+	case circuitStateHalfOpen:
+		if b.probes >= settings.HalfOpenRequests {
+			return false, time.Second, false
+		}
+		b.probes++
+		return true, 0, true
+	default:
+		return false, 0, true
+	}
+}
+
+// recordSuccess 在收到后端的响应后调用，任何响应 (包括错误状态码) 都说明后端可以连接
+func (b *circuitBreaker) recordSuccess(probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutiveFailures = 0
+	if probe && b.probes > 0 {
+		b.probes--
+	}
+	if b.state != circuitStateClosed {
+		b.setStateLocked(circuitStateClosed, "后端已恢复")
+	}
+}
+
+// recordFailure 在无法连接后端时调用
+func (b *circuitBreaker) recordFailure(settings circuitBreakerSettings, probe bool, err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutiveFailures++
+	if probe && b.probes > 0 {
+		b.probes--
+	}
+	switch {
+	case b.state == circuitStateHalfOpen && probe:
+		b.openedAt = now
+		b.setStateLocked(circuitStateOpen, fmt.Sprintf("试探请求失败: %v", err))
+	case b.state == circuitStateClosed && b.consecutiveFailures >= settings.FailureThreshold:
+		b.openedAt = now
+		b.setStateLocked(circuitStateOpen, fmt.Sprintf("连续 %d 次请求失败，最后一次错误: %v", b.consecutiveFailures, err))
+	}
+}
+
+// release 在试探请求没有得到结果 (例如客户端取消) 时归还试探名额
+func (b *circuitBreaker) release(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.probes > 0 {
+		b.probes--
+	}
+}
+
+type circuitBreakerCallKey struct{}
+
+// circuitBreakerCall 跟踪一次被放行的请求，由 circuitBreakerTransport 记录结果
+type circuitBreakerCall struct {
+	breaker  *circuitBreaker
+	settings circuitBreakerSettings
+	probe    bool
+	recorded bool
+}
+
+// done 在请求处理结束时调用，请求没有到达后端时归还试探名额
+func (c *circuitBreakerCall) done() {
+	if c != nil && !c.recorded {
+		c.breaker.release(c.probe)
+	}
+}
+
+// circuitRejection 描述一次因熔断被拒绝的请求
+type circuitRejection struct {
+	failureThreshold int
+	retryAfter       time.Duration
+}
+
+// message 返回给客户端的说明
+func (r *circuitRejection) message(clusterName string) string {
+	return fmt.Sprintf("服务不可用: 集群 %s 的 API Server 连续 %d 次无法连接，网关已暂停转发请求，请稍后重试", clusterName, r.failureThreshold)
+}
+
+// retryAfterSeconds 将等待时间向上取整为秒
+func (r *circuitRejection) retryAfterSeconds() int32 {
+	return int32(math.Ceil(r.retryAfter.Seconds()))
+}
+
+// allowCircuit 检查集群的熔断器，放行时返回附带熔断器信息的 context，请求结束时必须调用 call.done
+func allowCircuit(ctx context.Context, clusterName, tokenName string) (context.Context, *circuitBreakerCall, *circuitRejection) {
+	settings := gatewayConfigSnapshot().CircuitBreaker.settingsFor(clusterName)
+	if settings.Disabled {
+		return ctx, nil, nil
+	}
+	breaker := circuitBreakers.get(clusterName)
+	probe, retryAfter, ok := breaker.allow(settings, time.Now())
+	if !ok {
+		circuitBreakerRejections.WithLabelValues(clusterName, tokenName).Inc()
+		return ctx, nil, &circuitRejection{failureThreshold: settings.FailureThreshold, retryAfter: retryAfter}
+	}
+	call := &circuitBreakerCall{breaker: breaker, settings: settings, probe: probe}
+	return context.WithValue(ctx, circuitBreakerCallKey{}, call), call, nil
+}
+
+// circuitBreakerTransport 根据后端的连接结果更新熔断器。客户端主动取消、请求体超限，
+// 以及已经连上后端但超过网关请求超时时间的请求 (后端只是响应慢) 不计入
+type circuitBreakerTransport struct {
+	underlyingTransport http.RoundTripper
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call, _ := req.Context().Value(circuitBreakerCallKey{}).(*circuitBreakerCall)
+	if call == nil || call.recorded {
+		return t.underlyingTransport.RoundTrip(req)
+	}
+	var connected atomic.Bool
+	trace := &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { connected.Store(true) }}
+	resp, err := t.underlyingTransport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	switch {
+	case err == nil:
+		call.recorded = true
+		call.breaker.recordSuccess(call.probe)
+	case errors.Is(err, context.Canceled), errors.Is(err, errRequestBodyTooLarge):
+	case (errors.Is(err, context.DeadlineExceeded) || errors.Is(req.Context().Err(), context.DeadlineExceeded)) && connected.Load():
+	default:
+		call.recorded = true
+		call.breaker.recordFailure(call.settings, call.probe, err, time.Now())
+	}
+	return resp, err
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	settings := circuitBreakerSettings{
+		FailureThreshold: 2,
+		OpenDuration:     metav1.Duration{Duration: 10 * time.Second},
+		HalfOpenRequests: 1,
+	}
+	errBackend := errors.New("connection refused")
+
+	// step 是对熔断器的一次操作: allow 检查是否放行，success/failure 记录请求结果；at 是相对于开始时间的偏移
+	type step struct {
+		op        string
+		at        time.Duration
+		probe     bool
+		wantOK    bool
+		wantProbe bool
+		wantState string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "stays closed below the threshold", steps: []step{
+			{op: "failure", wantState: circuitStateClosed},
+			{op: "allow", wantOK: true, wantState: circuitStateClosed},
+		}},
+		{name: "success resets the failure count", steps: []step{
+			{op: "failure", wantState: circuitStateClosed},
+			{op: "success", wantState: circuitStateClosed},
+			{op: "failure", wantState: circuitStateClosed},
+		}},
+		{name: "opens at the threshold and rejects", steps: []step{
+			{op: "failure", wantState: circuitStateClosed},
+			{op: "failure", wantState: circuitStateOpen},
+			{op: "allow", at: 5 * time.Second, wantOK: false, wantState: circuitStateOpen},
+		}},
+		{name: "half-open admits a limited number of probes", steps: []step{
+			{op: "failure"},
+			{op: "failure", wantState: circuitStateOpen},
+			{op: "allow", at: 10 * time.Second, wantOK: true, wantProbe: true, wantState: circuitStateHalfOpen},
+			{op: "allow", at: 10 * time.Second, wantOK: false, wantState: circuitStateHalfOpen},
+		}},
+		{name: "successful probe closes", steps: []step{
+			{op: "failure"},
+			{op: "failure", wantState: circuitStateOpen},
+			{op: "allow", at: 10 * time.Second, wantOK: true, wantProbe: true, wantState: circuitStateHalfOpen},
+			{op: "success", probe: true, wantState: circuitStateClosed},
+			{op: "allow", at: 10 * time.Second, wantOK: true, wantState: circuitStateClosed},
+		}},
+		{name: "failed probe reopens", steps: []step{
+			{op: "failure"},
+			{op: "failure", wantState: circuitStateOpen},
+			{op: "allow", at: 10 * time.Second, wantOK: true, wantProbe: true, wantState: circuitStateHalfOpen},
+			{op: "failure", at: 10 * time.Second, probe: true, wantState: circuitStateOpen},
+			{op: "allow", at: 15 * time.Second, wantOK: false, wantState: circuitStateOpen},
+			{op: "allow", at: 20 * time.Second, wantOK: true, wantProbe: true, wantState: circuitStateHalfOpen},
+		}},
+		{name: "failure of a non-probe request while half-open", steps: []step{
+			{op: "failure"},
+			{op: "failure", wantState: circuitStateOpen},
+			{op: "allow", at: 10 * time.Second, wantOK: true, wantProbe: true, wantState: circuitStateHalfOpen},
+			{op: "failure", at: 10 * time.Second, wantState: circuitStateHalfOpen},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 熔断后启动的后台探测找不到集群的代理，会立即退出
+			breaker := &circuitBreaker{clusterName: "circuit-breaker-test", state: circuitStateClosed}
+			start := time.Now()
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				switch s.op {
+				case "allow":
+					probe, _, ok := breaker.allow(settings, now)
+					if ok != s.wantOK || probe != s.wantProbe {
+						t.Fatalf("step %d: allow = (probe %v, ok %v), want (probe %v, ok %v)", i, probe, ok, s.wantProbe, s.wantOK)
+					}
+				case "success":
+					breaker.recordSuccess(s.probe)
+				case "failure":
+					breaker.recordFailure(settings, s.probe, errBackend, now)
+				}
+				breaker.mu.Lock()
+				state := breaker.state
+				breaker.mu.Unlock()
+				if s.wantState != "" && state != s.wantState {
+					t.Fatalf("step %d (%s): state = %s, want %s", i, s.op, state, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerTransportCountsOnlyConnectionFailures(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		timeout time.Duration
+		// headerTimeout 是网关等待响应头的超时时间 (timeouts.request)
+		headerTimeout time.Duration
+		wantFailures  int
+	}{
+		{name: "5xx response", url: failing.URL, timeout: time.Second, wantFailures: 0},
+		{name: "client deadline after connecting", url: slow.URL, timeout: 100 * time.Millisecond, wantFailures: 0},
+		{name: "response header timeout after connecting", url: slow.URL, timeout: time.Second, headerTimeout: 100 * time.Millisecond, wantFailures: 0},
+		{name: "connection refused", url: refused, timeout: time.Second, wantFailures: 1},
+		{name: "connection refused with response header timeout", url: refused, timeout: time.Second, headerTimeout: 100 * time.Millisecond, wantFailures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := &circuitBreaker{clusterName: "circuit-breaker-test", state: circuitStateClosed}
+			call := &circuitBreakerCall{breaker: breaker, settings: circuitBreakerSettings{FailureThreshold: 5}}
+			ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), circuitBreakerCallKey{}, call), tt.timeout)
+			defer cancel()
+			if tt.headerTimeout > 0 {
+				ctx = withResponseHeaderTimeout(ctx, tt.headerTimeout)
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport := &circuitBreakerTransport{underlyingTransport: &responseHeaderTimeoutTransport{underlyingTransport: &http.Transport{}}}
+			if resp, err := transport.RoundTrip(req); err == nil {
+				resp.Body.Close()
+			}
+			breaker.mu.Lock()
+			failures := breaker.consecutiveFailures
+			breaker.mu.Unlock()
+			if failures != tt.wantFailures {
+				t.Errorf("consecutive failures = %d, want %d", failures, tt.wantFailures)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var coalescedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "coalesced_requests_total",
+	Help:      "Total number of coalescable GET requests by result (leader: sent to the backend, shared: answered with another request's response, overflow: sent to the backend because the shared response was too large to buffer).",
+}, []string{"cluster", "result"})
+
+func init() {
+	metricsRegistry.MustRegister(coalescedRequests)
+}
+
+// coalescingSettings 设置一个集群是否合并相同的并发 GET 请求
+type coalescingSettings struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// coalescingConfig 是 gateway.yaml 中的 coalescing 部分，perCluster 是所有集群的默认值，clusters 中可以按名称单独覆盖
+type coalescingConfig struct {
+	PerCluster coalescingSettings            `json:"perCluster,omitempty"`
+	Clusters   map[string]coalescingSettings `json:"clusters,omitempty"`
+}
+
+func (c *coalescingConfig) enabledFor(clusterName string) bool {
+	if override, ok := c.Clusters[clusterName]; ok && override.Enabled != nil {
+		return *override.Enabled
+	}
+	return c.PerCluster.Enabled != nil && *c.PerCluster.Enabled
+}
+
+// coalescingKey 返回合并请求使用的键，返回空字符串表示请求不能与其他请求合并。
+// 只合并没有请求体的 GET，并且要求 Token 相同；带有 Impersonate-* 头的请求以其他身份访问后端，不参与合并
+func coalescingKey(req *http.Request, clusterName string) string {
+	if req.Method != http.MethodGet || req.ContentLength > 0 || isUpgradeRequest(req) || hasImpersonationHeaders(req) {
+		return ""
+	}
+	// 不直接使用 Token 作为键的一部分，避免 Token 长时间留在内存中
+	identity := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	return strings.Join([]string{
+		clusterName,
+		hex.EncodeToString(identity[:]),
+		req.URL.Path + "?" + req.URL.RawQuery,
+		req.Header.Get("Accept"),
+		req.Header.Get("Accept-Encoding"),
+	}, "\n")
+}
+
+// hasImpersonationHeaders 判断请求是否带有 Impersonate-* 头。这类请求由后端按被模拟的身份检查权限，
+// 不能使用以网关身份获取的缓存或与其他请求共享的结果
+func hasImpersonationHeaders(req *http.Request) bool {
+	for name := range req.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "Impersonate-") {
+			return true
+		}
+	}
+	return false
+}
+
+// maxCoalescedResponseBytes 是合并请求在内存中缓冲的响应大小上限。超出时改为直接流式返回给第一个请求，
+// 等待中的其他请求各自转发到后端，避免较大的 LIST 占用大量内存并推迟客户端收到第一个字节的时间
+const maxCoalescedResponseBytes = 8 << 20
+
+// coalescedCall 是一个正在进行的后端请求，完成后 response 中保存完整的响应
+type coalescedCall struct {
+	done chan struct{}
+	// overflow 在响应超过 maxCoalescedResponseBytes 时关闭
+	overflow chan struct{}
+	response *coalescedResponseWriter
+	waiters  int
+}
+
+// requestCoalescer 记录正在进行的请求，相同的请求只有第一个会被转发到后端
+type requestCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+var coalescer = &requestCoalescer{calls: make(map[string]*coalescedCall)}
+
+// serveCoalesced 转发请求，与正在进行的相同请求共用同一个后端响应。
+// 第一个请求负责访问后端，它的客户端提前断开时仍然等待后端响应，以免其他请求一起失败；
+// 其余请求等待第一个请求的结果 (后端没有按时返回响应头时同样收到 504)，断开时不影响其他请求
+func serveCoalesced(proxy *httputil.ReverseProxy, w http.ResponseWriter, req *http.Request, clusterName, key string) {
+	coalescer.mu.Lock()
+	if call, ok := coalescer.calls[key]; ok {
+		call.waiters++
+		coalescer.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-call.overflow:
+		case <-req.Context().Done():
+			return
+		}
+		if call.response.overflowed {
+			coalescedRequests.WithLabelValues(clusterName, "overflow").Inc()
+			proxy.ServeHTTP(w, req)
+			return
+		}
+		coalescedRequests.WithLabelValues(clusterName, "shared").Inc()
+		writeCoalescedResponse(w, call.response, call.waiters)
+		return
+	}
+	call := &coalescedCall{done: make(chan struct{}), overflow: make(chan struct{})}
+	call.response = &coalescedResponseWriter{
+		header: make(http.Header),
+		leader: w,
+		onOverflow: func() {
+			// 之后的相同请求不再等待这个响应
+			coalescer.mu.Lock()
+			if coalescer.calls[key] == call {
+				delete(coalescer.calls, key)
+			}
+			coalescer.mu.Unlock()
+			close(call.overflow)
+		},
+	}
+	coalescer.calls[key] = call
+	coalescer.mu.Unlock()
+	coalescedRequests.WithLabelValues(clusterName, "leader").Inc()
+
+	// 保留 context 中的熔断和追踪信息以及等待响应头的超时时间，但不随客户端断开而取消
+	proxy.ServeHTTP(call.response, req.WithContext(context.WithoutCancel(req.Context())))
+	if call.response.status == 0 {
+		call.response.status = http.StatusOK
+	}
+
+	coalescer.mu.Lock()
+	if coalescer.calls[key] == call {
+		delete(coalescer.calls, key)
+	}
+	waiters := call.waiters
+	coalescer.mu.Unlock()
+	close(call.done)
+	if !call.response.overflowed {
+		writeCoalescedResponse(w, call.response, waiters)
+	}
+}
+
+// writeCoalescedResponse 把共用的响应写给一个客户端，X-Kube-Gateway-Coalesced 头说明共用该响应的请求数
+func writeCoalescedResponse(w http.ResponseWriter, response *coalescedResponseWriter, waiters int) {
+	for name, values := range response.header {
+		w.Header()[name] = values
+	}
+	if waiters > 0 {
+		w.Header().Set("X-Kube-Gateway-Coalesced", strconv.Itoa(waiters+1))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(response.body.Len()))
+	w.WriteHeader(response.status)
+	w.Write(response.body.Bytes())
+}
+
+// coalescedResponseWriter 在内存中接收后端的响应。响应超过 maxCoalescedResponseBytes 时，
+// 把已缓冲的内容和之后的数据直接写给第一个请求的客户端，并调用 onOverflow
+type coalescedResponseWriter struct {
+	header     http.Header
+	status     int
+	body       bytes.Buffer
+	leader     http.ResponseWriter
+	overflowed bool
+	onOverflow func()
+}
+
+func (r *coalescedResponseWriter) Header() http.Header {
+	if r.overflowed {
+		return r.leader.Header()
+	}
+	return r.header
+}
+
+func (r *coalescedResponseWriter) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *coalescedResponseWriter) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.overflowed {
+		return r.leader.Write(p)
+	}
+	if r.body.Len()+len(p) <= maxCoalescedResponseBytes {
+		return r.body.Write(p)
+	}
+	r.overflowed = true
+	for name, values := range r.header {
+		r.leader.Header()[name] = values
+	}
+	r.leader.WriteHeader(r.status)
+	buffered := r.body.Bytes()
+	r.body = bytes.Buffer{}
+	r.onOverflow()
+	if _, err := r.leader.Write(buffered); err != nil {
+		return 0, err
+	}
+	return r.leader.Write(p)
+}
+
+// Flush 在改为流式返回后把数据及时发送给客户端
+func (r *coalescedResponseWriter) Flush() {
+	if flusher, ok := r.leader.(http.Flusher); r.overflowed && ok {
+		flusher.Flush()
+	}
+}
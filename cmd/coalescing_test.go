@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCoalescingKey(t *testing.T) {
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods?limit=500", nil)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		req.Header.Set("Accept", "application/json")
+		return req
+	}
+	base := coalescingKey(newRequest(), "dev")
+	if base == "" {
+		t.Fatal("expected a plain GET to be coalescable")
+	}
+	if strings.Contains(base, "secret-token") {
+		t.Fatal("the key must not contain the token")
+	}
+
+	tests := []struct {
+		name    string
+		cluster string
+		modify  func(req *http.Request)
+		// want 为 "none" 表示不能合并，"same" 表示与基准请求合并，"different" 表示单独合并
+		want string
+	}{
+		{name: "identical request", want: "same"},
+		{name: "post", modify: func(req *http.Request) { req.Method = http.MethodPost }, want: "none"},
+		{name: "get with body", modify: func(req *http.Request) { req.ContentLength = 10 }, want: "none"},
+		{name: "upgrade", modify: func(req *http.Request) {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "SPDY/3.1")
+		}, want: "none"},
+		{name: "impersonation", modify: func(req *http.Request) { req.Header.Set("Impersonate-User", "admin") }, want: "none"},
+		{name: "impersonation extra", modify: func(req *http.Request) { req.Header["impersonate-extra-scopes"] = []string{"x"} }, want: "none"},
+		{name: "other token", modify: func(req *http.Request) { req.Header.Set("Authorization", "Bearer other") }, want: "different"},
+		{name: "other query", modify: func(req *http.Request) { req.URL.RawQuery = "limit=10" }, want: "different"},
+		{name: "other path", modify: func(req *http.Request) { req.URL.Path = "/api/v1/pods" }, want: "different"},
+		{name: "other accept", modify: func(req *http.Request) {
+			req.Header.Set("Accept", "application/json;as=Table;v=v1;g=meta.k8s.io")
+		}, want: "different"},
+		{name: "other encoding", modify: func(req *http.Request) { req.Header.Set("Accept-Encoding", "gzip") }, want: "different"},
+		{name: "other cluster", cluster: "prod", want: "different"},
+		{name: "unrelated header", modify: func(req *http.Request) { req.Header.Set("User-Agent", "kubectl") }, want: "same"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest()
+			if tt.modify != nil {
+				tt.modify(req)
+			}
+			cluster := tt.cluster
+			if cluster == "" {
+				cluster = "dev"
+			}
+			key := coalescingKey(req, cluster)
+			var got string
+			switch {
+			case key == "":
+				got = "none"
+			case key == base:
+				got = "same"
+			default:
+				got = "different"
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
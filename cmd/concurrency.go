@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultQueueTimeout 是请求在队列中等待的默认最长时间
+const defaultQueueTimeout = 10 * time.Second
+
+// 并发限制的两类请求: 普通请求可以排队等待，长连接请求超出限制时直接拒绝
+const (
+	concurrencyClassInflight    = "inflight"
+	concurrencyClassLongRunning = "long-running"
+)
+
+var (
+	queuedRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queued_requests",
+		Help:      "Number of requests waiting in the queue for a free in-flight slot.",
+	}, []string{"scope", "name"})
+
+	queueWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_wait_duration_seconds",
+		Help:      "Time requests spent waiting in the queue for a free in-flight slot.",
+		Buckets:   []float64{0.001, 0.005, 0.025, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"cluster"})
+
+	concurrencyRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "concurrency_rejected_requests_total",
+		Help:      "Total number of requests rejected because an in-flight or long-running limit was reached.",
+	}, []string{"cluster", "token", "scope", "class", "reason"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(queuedRequests, queueWaitDuration, concurrencyRejections)
+}
+
+// concurrencyLimits 设置一个集群或 Token 的并发上限，0 表示不限制。
+// maxInflight 限制普通请求，maxLongRunning 限制 watch、exec、attach、port-forward、logs -f 等长连接请求；
+// 普通请求超出上限时最多有 queueLength 个请求排队等待 queueTimeout
+type concurrencyLimits struct {
+	MaxInflight    int             `json:"maxInflight,omitempty"`
+	MaxLongRunning int             `json:"maxLongRunning,omitempty"`
+	QueueLength    int             `json:"queueLength,omitempty"`
+	QueueTimeout   metav1.Duration `json:"queueTimeout,omitempty"`
+}
+
+// concurrencyConfig 是 gateway.yaml 中的 concurrency 部分，结构与 rateLimits 相同
+type concurrencyConfig struct {
+	PerCluster concurrencyLimits            `json:"perCluster,omitempty"`
+	PerToken   concurrencyLimits            `json:"perToken,omitempty"`
+	Clusters   map[string]concurrencyLimits `json:"clusters,omitempty"`
+	Tokens     map[string]concurrencyLimits `json:"tokens,omitempty"`
+}
+
+// limitsFor 按字段合并默认值和单独的配置
+func limitsFor(overrides map[string]concurrencyLimits, defaults concurrencyLimits, name string) concurrencyLimits {
+	limits := defaults
+	if override, ok := overrides[name]; ok {
+		if override.MaxInflight != 0 {
+			limits.MaxInflight = override.MaxInflight
+		}
+		if override.MaxLongRunning != 0 {
+			limits.MaxLongRunning = override.MaxLongRunning
+		}
+		if override.QueueLength != 0 {
+			limits.QueueLength = override.QueueLength
+		}
+		if override.QueueTimeout.Duration != 0 {
+			limits.QueueTimeout = override.QueueTimeout
+		}
+	}
+	if limits.QueueTimeout.Duration == 0 {
+		limits.QueueTimeout.Duration = defaultQueueTimeout
+	}
+	return limits
+}
+
+func (c *concurrencyConfig) validate() error {
+	check := func(where string, limits concurrencyLimits) error {
+		if limits.MaxInflight < 0 || limits.MaxLongRunning < 0 || limits.QueueLength < 0 || limits.QueueTimeout.Duration < 0 {
+			return fmt.Errorf("concurrency.%s 中的值不能为负数", where)
+		}
+		return nil
+	}
+	if err := check("perCluster", c.PerCluster); err != nil {
+		return err
+	}
+	if err := check("perToken", c.PerToken); err != nil {
+		return err
+	}
+	for name, limits := range c.Clusters {
+		if err := check("clusters."+name, limits); err != nil {
+			return err
+		}
+	}
+	for name, limits := range c.Tokens {
+		if err := check("tokens."+name, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// longRunningKind 判断请求是否为长连接请求并返回其类型，与 API Server 的 long-running 判定类似
+func longRunningKind(req *http.Request, info *RequestInfo) string {
+	if info.Verb == "watch" {
+		return "watch"
+	}
+	switch info.Subresource {
+	case "exec", "attach", "portforward", "proxy":
+		return info.Subresource
+	case "log":
+		if follow := req.URL.Query().Get("follow"); follow == "true" || follow == "1" {
+			return "log"
+		}
+	}
+	if isUpgradeRequest(req) {
+		return "upgrade"
+	}
+	return ""
+}
+
+// concurrencyLimiter 是带 FIFO 等待队列的计数信号量
+type concurrencyLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	inUse   int
+	waiters *list.List
+	gauge   prometheus.Gauge
+}
+
+// concurrencyWaiter 在获得名额时 ready 被关闭
+type concurrencyWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// setLimit 调整上限，上限变大时唤醒排队的请求
+func (l *concurrencyLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.grantLocked()
+}
+
+func (l *concurrencyLimiter) grantLocked() {
+	for l.waiters.Len() > 0 && l.inUse < l.limit {
+		waiter := l.waiters.Remove(l.waiters.Front()).(*concurrencyWaiter)
+		waiter.granted = true
+		l.inUse++
+		close(waiter.ready)
+		l.gauge.Dec()
+	}
+}
+
+// acquire 获取一个名额，队列已满或到达 deadline 仍未获得名额时返回拒绝的原因
+func (l *concurrencyLimiter) acquire(ctx context.Context, queueLength int, deadline time.Time) string {
+	l.mu.Lock()
+	if l.inUse < l.limit {
+		l.inUse++
+		l.mu.Unlock()
+		return ""
+	}
+	if l.waiters.Len() >= queueLength {
+		l.mu.Unlock()
+		if queueLength == 0 {
+			return "limit"
+		}
+		return "queue_full"
+	}
+	waiter := &concurrencyWaiter{ready: make(chan struct{})}
+	element := l.waiters.PushBack(waiter)
+	l.gauge.Inc()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	reason := ""
+	select {
+	case <-waiter.ready:
+		return ""
+	case <-timer.C:
+		reason = "timeout"
+	case <-ctx.Done():
+		reason = "canceled"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if waiter.granted {
+		// 在超时的同时拿到了名额，直接使用
+		return ""
+	}
+	l.waiters.Remove(element)
+	l.gauge.Dec()
+	return reason
+}
+
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inUse--
+	l.grantLocked()
+}
+
+// concurrencyLimiterRegistry 按 "范围/名称/类别" 保存信号量，重新加载配置时原地调整上限
+type concurrencyLimiterRegistry struct {
+	mu       sync.Mutex
+	limiters map[string]*concurrencyLimiter
+}
+
+var concurrencyLimiters = &concurrencyLimiterRegistry{limiters: make(map[string]*concurrencyLimiter)}
+
+func (r *concurrencyLimiterRegistry) get(scope, name, class string, limit int) *concurrencyLimiter {
+	key := scope + "/" + name + "/" + class
+	r.mu.Lock()
+	limiter, ok := r.limiters[key]
+	if !ok {
+		limiter = &concurrencyLimiter{limit: limit, waiters: list.New(), gauge: queuedRequests.WithLabelValues(scope, name)}
+		r.limiters[key] = limiter
+	}
+	r.mu.Unlock()
+	if ok {
+		limiter.setLimit(limit)
+	}
+	return limiter
+}
+
+// concurrencyRejection 描述一次因并发上限被拒绝的请求
+type concurrencyRejection struct {
+	scope  string
+	class  string
+	limit  int
+	reason string
+}
+
+// acquireConcurrency 先后占用 Token 和集群的名额，先检查更具体的 Token，
+// 避免某个 Token 的请求在排队时占用整个集群的名额。两次排队共用一个截止时间 (两者中较短的 queueTimeout)，
+// 请求的总等待时间不会超过配置的排队时间。返回的 release 必须在请求结束时调用
+func acquireConcurrency(ctx context.Context, clusterName, tokenName string, longRunning bool) (func(), *concurrencyRejection) {
+	config := &gatewayConfigSnapshot().Concurrency
+	scopes := []struct {
+		scope  string
+		name   string
+		limits concurrencyLimits
+	}{
+		{rateLimitScopeToken, tokenName, limitsFor(config.Tokens, config.PerToken, tokenName)},
+		{rateLimitScopeCluster, clusterName, limitsFor(config.Clusters, config.PerCluster, clusterName)},
+	}
+
+	start := time.Now()
+	var queueTimeout time.Duration
+	for _, s := range scopes {
+		if s.limits.MaxInflight > 0 && (queueTimeout == 0 || s.limits.QueueTimeout.Duration < queueTimeout) {
+			queueTimeout = s.limits.QueueTimeout.Duration
+		}
+	}
+	deadline := start.Add(queueTimeout)
+	var acquired []*concurrencyLimiter
+	release := func() {
+		for _, limiter := range acquired {
+			limiter.release()
+		}
+	}
+	for _, s := range scopes {
+		class, limit, queueLength := concurrencyClassInflight, s.limits.MaxInflight, s.limits.QueueLength
+		if longRunning {
+			// 长连接会一直占用名额，排队没有意义
+			class, limit, queueLength = concurrencyClassLongRunning, s.limits.MaxLongRunning, 0
+		}
+		if limit == 0 {
+			continue
+		}
+		limiter := concurrencyLimiters.get(s.scope, s.name, class, limit)
+		if reason := limiter.acquire(ctx, queueLength, deadline); reason != "" {
+			release()
+			concurrencyRejections.WithLabelValues(clusterName, tokenName, s.scope, class, reason).Inc()
+			return nil, &concurrencyRejection{scope: s.scope, class: class, limit: limit, reason: reason}
+		}
+		acquired = append(acquired, limiter)
+	}
+	if !longRunning {
+		queueWaitDuration.WithLabelValues(clusterName).Observe(time.Since(start).Seconds())
+	}
+	return release, nil
+}
+
+// message 返回给客户端的说明
+func (r *concurrencyRejection) message(clusterName, tokenName string) string {
+	target := "集群 " + clusterName
+	if r.scope == rateLimitScopeToken {
+		target = "Token " + tokenName
+	}
+	if r.class == concurrencyClassLongRunning {
+		return fmt.Sprintf("请求过多: %s 的长连接请求 (watch/exec/logs -f 等) 已达到上限 %d，请稍后重试", target, r.limit)
+	}
+	if r.reason == "timeout" {
+		return fmt.Sprintf("请求过多: %s 的并发请求已达到上限 %d，排队等待超时，请稍后重试", target, r.limit)
+	}
+	return fmt.Sprintf("请求过多: %s 的并发请求已达到上限 %d，请稍后重试", target, r.limit)
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAcquireConcurrencySharesQueueDeadline(t *testing.T) {
+	previous := currentGatewayConfig.Load()
+	t.Cleanup(func() { currentGatewayConfig.Store(previous) })
+	queueTimeout := 300 * time.Millisecond
+	config := &gatewayConfig{}
+	config.Concurrency.PerToken = concurrencyLimits{MaxInflight: 1, QueueLength: 2, QueueTimeout: metav1.Duration{Duration: queueTimeout}}
+	config.Concurrency.PerCluster = concurrencyLimits{MaxInflight: 1, QueueLength: 2, QueueTimeout: metav1.Duration{Duration: queueTimeout}}
+	currentGatewayConfig.Store(config)
+	ctx := context.Background()
+	cluster := "concurrency-test"
+
+	// first 占用 Token a 和集群的名额
+	releaseFirst, rejection := acquireConcurrency(ctx, cluster, "a", false)
+	if rejection != nil {
+		t.Fatalf("first request rejected: %s", rejection.reason)
+	}
+	// second 在 Token a 的队列中等待
+	type result struct {
+		rejection *concurrencyRejection
+		elapsed   time.Duration
+	}
+	second := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		release, rejection := acquireConcurrency(ctx, cluster, "a", false)
+		if release != nil {
+			release()
+		}
+		second <- result{rejection, time.Since(start)}
+	}()
+	// other 使用另一个 Token，在集群的队列中排在 second 之前，first 结束后拿到集群的名额并一直占用
+	time.Sleep(50 * time.Millisecond)
+	otherAcquired := make(chan func(), 1)
+	go func() {
+		release, rejection := acquireConcurrency(ctx, cluster, "b", false)
+		if rejection != nil {
+			t.Errorf("other request rejected: %s", rejection.reason)
+			release = func() {}
+		}
+		otherAcquired <- release
+	}()
+	time.Sleep(150 * time.Millisecond)
+	releaseFirst()
+	releaseOther := <-otherAcquired
+	defer releaseOther()
+
+	// second 在 Token 的队列中等了约 200ms，再在集群的队列中等待时只剩下约 100ms
+	got := <-second
+	if got.rejection == nil || got.rejection.reason != "timeout" || got.rejection.scope != rateLimitScopeCluster {
+		t.Fatalf("second request = %+v, want a cluster queue timeout", got.rejection)
+	}
+	if got.elapsed > queueTimeout+100*time.Millisecond {
+		t.Errorf("second request waited %s in total, want at most the queue timeout %s", got.elapsed, queueTimeout)
+	}
+}
@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// maxCachedDiscoveryBytes 是单个缓存条目的上限，超出时照常返回但不缓存
+	maxCachedDiscoveryBytes = 32 << 20
+	// maxDiscoveryCacheEntries 是每个集群缓存的条目数上限，超出时丢弃最早缓存的条目
+	maxDiscoveryCacheEntries = 256
+)
+
+var (
+	discoveryCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_cache_requests_total",
+		Help:      "Total number of discovery and OpenAPI requests by cache result (hit, miss, not_modified).",
+	}, []string{"cluster", "result"})
+
+	discoveryCacheEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "discovery_cache_entries",
+		Help:      "Number of discovery and OpenAPI responses currently cached.",
+	}, []string{"cluster"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(discoveryCacheRequests, discoveryCacheEntries)
+}
+
+// discoveryCacheSettings 设置一个集群的发现文档缓存，ttl 为 0 表示不缓存
+type discoveryCacheSettings struct {
+	TTL metav1.Duration `json:"ttl,omitempty"`
+}
+
+// discoveryCacheConfig 是 gateway.yaml 中的 discoveryCache 部分，perCluster 是所有集群的默认值，clusters 中可以按名称单独覆盖
+type discoveryCacheConfig struct {
+	PerCluster discoveryCacheSettings            `json:"perCluster,omitempty"`
+	Clusters   map[string]discoveryCacheSettings `json:"clusters,omitempty"`
+}
+
+func (c *discoveryCacheConfig) ttlFor(clusterName string) time.Duration {
+	if override, ok := c.Clusters[clusterName]; ok && override.TTL.Duration != 0 {
+		return override.TTL.Duration
+	}
+	return c.PerCluster.TTL.Duration
+}
+
+func (c *discoveryCacheConfig) validate() error {
+	if c.PerCluster.TTL.Duration < 0 {
+		return fmt.Errorf("discoveryCache.perCluster.ttl 不能为负数")
+	}
+	for name, settings := range c.Clusters {
+		if settings.TTL.Duration < 0 {
+			return fmt.Errorf("discoveryCache.clusters.%s.ttl 不能为负数", name)
+		}
+	}
+	return nil
+}
+
+// isDiscoveryRequest 判断请求是否为发现文档或 OpenAPI 文档: /api、/api/v1、/apis、/apis/<group>、
+// /apis/<group>/<version>、/openapi/... 和 /version
+func isDiscoveryRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "api":
+		return len(parts) <= 2
+	case "apis":
+		return len(parts) <= 3
+	case "openapi":
+		return true
+	case "version":
+		return len(parts) == 1
+	}
+	return false
+}
+
+// discoveryCacheEntry 是一个缓存的响应
+type discoveryCacheEntry struct {
+	header   http.Header
+	body     []byte
+	etag     string
+	storedAt time.Time
+}
+
+// discoveryCacheStore 按集群保存发现文档，同一路径的不同 Accept (例如聚合发现文档与旧格式) 分别缓存
+type discoveryCacheStore struct {
+	mu      sync.RWMutex
+	entries map[string]map[string]*discoveryCacheEntry
+}
+
+var discoveryCache = &discoveryCacheStore{entries: make(map[string]map[string]*discoveryCacheEntry)}
+
+// discoveryCacheKey 返回缓存的键。发现文档不使用查询参数，只有 /openapi/v3 下的文档使用 hash 参数区分版本，
+// 其余参数不参与缓存键，避免客户端通过随意的查询参数产生大量缓存条目
+func discoveryCacheKey(req *http.Request) string {
+	key := req.URL.Path
+	if strings.HasPrefix(key, "/openapi/v3/") {
+		if hash := req.URL.Query().Get("hash"); hash != "" {
+			key += "?hash=" + hash
+		}
+	}
+	return key + "\n" + req.Header.Get("Accept") + "\n" + req.Header.Get("Accept-Encoding")
+}
+
+func (s *discoveryCacheStore) get(clusterName, key string, ttl time.Duration) *discoveryCacheEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry := s.entries[clusterName][key]
+	if entry == nil || time.Since(entry.storedAt) > ttl {
+		return nil
+	}
+	return entry
+}
+
+// put 保存一个条目，同时丢弃已经超过 ttl 的条目；条目数仍达到上限时丢弃最早缓存的条目
+func (s *discoveryCacheStore) put(clusterName, key string, entry *discoveryCacheEntry, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.entries[clusterName]
+	if entries == nil {
+		entries = make(map[string]*discoveryCacheEntry)
+		s.entries[clusterName] = entries
+	}
+	for k, e := range entries {
+		if entry.storedAt.Sub(e.storedAt) > ttl {
+			delete(entries, k)
+		}
+	}
+	if _, exists := entries[key]; !exists && len(entries) >= maxDiscoveryCacheEntries {
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range entries {
+			if oldestKey == "" || e.storedAt.Before(oldest) {
+				oldestKey, oldest = k, e.storedAt
+			}
+		}
+		delete(entries, oldestKey)
+	}
+	entries[key] = entry
+	discoveryCacheEntries.WithLabelValues(clusterName).Set(float64(len(entries)))
+}
+
+// purge 清空所有缓存，在执行 reload 后调用，使新增的 CRD 或更换的后端立即可见
+func (s *discoveryCacheStore) purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for clusterName := range s.entries {
+		discoveryCacheEntries.DeleteLabelValues(clusterName)
+	}
+	s.entries = make(map[string]map[string]*discoveryCacheEntry)
+}
+
+// serveCachedDiscovery 在缓存命中时直接返回响应，返回值表示是否已处理请求
+func serveCachedDiscovery(w http.ResponseWriter, req *http.Request, clusterName string, ttl time.Duration) bool {
+	entry := discoveryCache.get(clusterName, discoveryCacheKey(req), ttl)
+	if entry == nil {
+		return false
+	}
+	writeCachedDiscovery(w, req, clusterName, entry, "hit")
+	return true
+}
+
+// writeCachedDiscovery 写入缓存的响应，客户端的 If-None-Match 与 ETag 一致时返回 304
+func writeCachedDiscovery(w http.ResponseWriter, req *http.Request, clusterName string, entry *discoveryCacheEntry, result string) {
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.storedAt).Seconds())))
+	if etagMatches(req.Header.Get("If-None-Match"), entry.etag) {
+		discoveryCacheRequests.WithLabelValues(clusterName, "not_modified").Inc()
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	discoveryCacheRequests.WithLabelValues(clusterName, result).Inc()
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.body)
+}
+
+// etagMatches 按弱比较判断 If-None-Match 中是否包含指定的 ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchDiscovery 向后端请求完整的文档并缓存，再按客户端的条件请求返回。
+// 转发时去掉 If-None-Match，确保后端返回可以缓存的完整响应
+func fetchDiscovery(proxy *httputil.ReverseProxy, w http.ResponseWriter, req *http.Request, clusterName string, ttl time.Duration) {
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	req.Header.Del("If-None-Match")
+	recorder := &discoveryResponseRecorder{header: make(http.Header)}
+	proxy.ServeHTTP(recorder, req)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	if recorder.status != http.StatusOK || recorder.body.Len() > maxCachedDiscoveryBytes {
+		for name, values := range recorder.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(recorder.status)
+		w.Write(recorder.body.Bytes())
+		return
+	}
+
+	entry := &discoveryCacheEntry{header: recorder.header.Clone(), body: recorder.body.Bytes(), storedAt: time.Now()}
+	// 每个请求的审计 ID 和时间不应被复用
+	for _, name := range []string{"Audit-Id", "Date", "Content-Length"} {
+		entry.header.Del(name)
+	}
+	entry.etag = recorder.header.Get("ETag")
+	if entry.etag == "" {
+		sum := sha256.Sum256(entry.body)
+		entry.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+	discoveryCache.put(clusterName, discoveryCacheKey(req), entry, ttl)
+	if auditID := recorder.header.Get("Audit-Id"); auditID != "" {
+		w.Header().Set("Audit-Id", auditID)
+	}
+	writeCachedDiscovery(w, req, clusterName, entry, "miss")
+}
+
+// discoveryResponseRecorder 在内存中接收后端的响应
+type discoveryResponseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *discoveryResponseRecorder) Header() http.Header { return r.header }
+
+func (r *discoveryResponseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *discoveryResponseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(p)
+}
@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 多个后端地址时的健康检查参数
+const (
+	endpointHealthCheckInterval = 10 * time.Second
+	endpointHealthCheckTimeout  = 3 * time.Second
+)
+
+var (
+	backendEndpointHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_endpoint_healthy",
+		Help:      "Whether a backend API server endpoint is currently considered healthy (1) or not (0).",
+	}, []string{"cluster", "endpoint"})
+
+	backendRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_retries_total",
+		Help:      "Total number of idempotent requests retried on another backend endpoint after a connection failure.",
+	}, []string{"cluster"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(backendEndpointHealthy, backendRetries)
+}
+
+// readClusterEndpoints 读取集群目录下的 endpoints 文件，每行一个 API Server 地址，# 开头的行为注释。
+// 文件不存在时返回空列表
+func readClusterEndpoints(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var endpoints []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		endpoints = append(endpoints, line)
+	}
+	return endpoints, scanner.Err()
+}
+
+// clusterEndpointURLs 合并 kubeconfig 中的地址和 endpoints 文件中的额外地址，去掉重复项。
+// 请求只会替换地址中的主机部分，因此所有地址的路径必须相同
+func clusterEndpointURLs(primary string, extra []string) ([]*url.URL, error) {
+	var urls []*url.URL
+	seen := make(map[string]bool)
+	for _, raw := range append([]string{primary}, extra...) {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 API Server 地址 %q: %w", raw, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("无效的 API Server 地址 %q: 必须是 http:// 或 https:// 开头的完整地址", raw)
+		}
+		if len(urls) > 0 && strings.TrimSuffix(u.Path, "/") != strings.TrimSuffix(urls[0].Path, "/") {
+			return nil, fmt.Errorf("API Server 地址 %q 的路径与 %q 不同", raw, urls[0].String())
+		}
+		if seen[u.Host] {
+			continue
+		}
+		seen[u.Host] = true
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// backendEndpoint 是集群的一个 API Server 地址
+type backendEndpoint struct {
+	url     *url.URL
+	healthy atomic.Bool
+}
+
+// endpointPool 保存一个集群的全部 API Server 地址，在健康的地址之间轮流转发请求
+type endpointPool struct {
+	clusterName string
+	endpoints   []*backendEndpoint
+	next        atomic.Uint64
+	cancel      context.CancelFunc
+}
+
+func newEndpointPool(clusterName string, urls []*url.URL) *endpointPool {
+	pool := &endpointPool{clusterName: clusterName}
+	for _, u := range urls {
+		endpoint := &backendEndpoint{url: u}
+		// 在第一次健康检查之前认为所有地址都可用
+		endpoint.healthy.Store(true)
+		backendEndpointHealthy.WithLabelValues(clusterName, u.Host).Set(1)
+		pool.endpoints = append(pool.endpoints, endpoint)
+	}
+	return pool
+}
+
+// candidates 返回本次请求依次尝试的地址: 健康的地址按轮询顺序排在前面，不健康的地址排在最后，
+// 所有地址都不健康时仍然会尝试，交由熔断器决定是否暂停转发
+func (p *endpointPool) candidates() []*backendEndpoint {
+	start := int(p.next.Add(1) - 1)
+	var healthy, unhealthy []*backendEndpoint
+	for i := range p.endpoints {
+		endpoint := p.endpoints[(start+i)%len(p.endpoints)]
+		if endpoint.healthy.Load() {
+			healthy = append(healthy, endpoint)
+		} else {
+			unhealthy = append(unhealthy, endpoint)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// setHealthy 更新地址的健康状态，状态变化时记录日志
+func (p *endpointPool) setHealthy(endpoint *backendEndpoint, healthy bool, reason string) {
+	if endpoint.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		backendEndpointHealthy.WithLabelValues(p.clusterName, endpoint.url.Host).Set(1)
+		log.Printf("集群 %s 的 API Server %s 已恢复", p.clusterName, endpoint.url.Host)
+	} else {
+		backendEndpointHealthy.WithLabelValues(p.clusterName, endpoint.url.Host).Set(0)
+		log.Printf("集群 %s 的 API Server %s 不可用，已暂停向其转发请求: %s", p.clusterName, endpoint.url.Host, reason)
+	}
+}
+
+// startHealthChecks 定期访问每个地址的 /readyz，直到 stop 被调用
+func (p *endpointPool) startHealthChecks(transport http.RoundTripper) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	client := &http.Client{Transport: transport, Timeout: endpointHealthCheckTimeout}
+	go func() {
+		ticker := time.NewTicker(endpointHealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			var wg sync.WaitGroup
+			for _, endpoint := range p.endpoints {
+				wg.Add(1)
+				go func(endpoint *backendEndpoint) {
+					defer wg.Done()
+					p.checkEndpoint(ctx, client, endpoint)
+				}(endpoint)
+			}
+			wg.Wait()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// checkEndpoint 检查单个地址。API Server 未就绪时 /readyz 返回 5xx；
+// 匿名访问被禁用时返回 401/403，但同样说明该地址可以连接
+func (p *endpointPool) checkEndpoint(ctx context.Context, client *http.Client, endpoint *backendEndpoint) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.url.JoinPath("/readyz").String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		p.setHealthy(endpoint, false, err.Error())
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		p.setHealthy(endpoint, false, fmt.Sprintf("/readyz 返回 %d", resp.StatusCode))
+		return
+	}
+	p.setHealthy(endpoint, true, "")
+}
+
+// stopEndpointPools 停止旧的地址池的健康检查，并清理新配置中已经不存在的地址的指标
+func stopEndpointPools(pools, current map[string]*endpointPool) {
+	for clusterName, pool := range pools {
+		if pool.cancel != nil {
+			pool.cancel()
+		}
+		for _, endpoint := range pool.endpoints {
+			if !current[clusterName].has(endpoint.url.Host) {
+				backendEndpointHealthy.DeleteLabelValues(clusterName, endpoint.url.Host)
+			}
+		}
+	}
+}
+
+func (p *endpointPool) has(host string) bool {
+	if p == nil {
+		return false
+	}
+	for _, endpoint := range p.endpoints {
+		if endpoint.url.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryableRequest 判断请求在连接失败后能否换一个地址重试: 只重试幂等且可以重放请求体的请求
+func isRetryableRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	if req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// endpointFailoverTransport 将请求转发到集群的某个健康地址，
+// 连接失败时把该地址标记为不可用，并对幂等请求换下一个地址重试
+type endpointFailoverTransport struct {
+	pool                *endpointPool
+	underlyingTransport http.RoundTripper
+}
+
+func (t *endpointFailoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	candidates := t.pool.candidates()
+	if !isRetryableRequest(req) {
+		candidates = candidates[:1]
+	}
+	var lastErr error
+	for i, endpoint := range candidates {
+		if i > 0 {
+			backendRetries.WithLabelValues(t.pool.clusterName).Inc()
+		}
+		attempt := req.Clone(req.Context())
+		attempt.URL.Scheme = endpoint.url.Scheme
+		attempt.URL.Host = endpoint.url.Host
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt.Body = body
+		}
+		resp, err := t.underlyingTransport.RoundTrip(attempt)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if errors.Is(err, context.Canceled) || errors.Is(err, errRequestBodyTooLarge) || req.Context().Err() != nil {
+			return nil, err
+		}
+		t.pool.setHealthy(endpoint, false, err.Error())
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	gatewayConfigFile string
+
+	// currentGatewayConfig 保存当前生效的网关配置，执行 reload 时整体替换
+	currentGatewayConfig atomic.Pointer[gatewayConfig]
+)
+
+// gatewayConfig 是 ~/.kube-gateway/gateway.yaml 中的流量控制配置，
+// 与集群配置一样在执行 reload 时重新加载
+type gatewayConfig struct {
+	RateLimits     rateLimitConfig      `json:"rateLimits,omitempty"`
+	Concurrency    concurrencyConfig    `json:"concurrency,omitempty"`
+	CircuitBreaker circuitBreakerConfig `json:"circuitBreaker,omitempty"`
+	Timeouts       timeoutConfig        `json:"timeouts,omitempty"`
+	BodyLimits     bodyLimitConfig      `json:"bodyLimits,omitempty"`
+	DiscoveryCache discoveryCacheConfig `json:"discoveryCache,omitempty"`
+	ReadCache      readCacheConfig      `json:"readCache,omitempty"`
+	Coalescing     coalescingConfig     `json:"coalescing,omitempty"`
+	WatchCache     watchCacheConfig     `json:"watchCache,omitempty"`
+	StaleReads     staleReadConfig      `json:"staleReads,omitempty"`
+	Mirroring      mirrorConfig         `json:"mirroring,omitempty"`
+}
+
+// defaultGatewayConfigPath 返回网关配置文件的路径，以及该路径是否由用户显式指定
+func defaultGatewayConfigPath() (string, bool, error) {
+	if gatewayConfigFile != "" {
+		return gatewayConfigFile, true, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", false, fmt.Errorf("无法获取用户主目录: %w", err)
+	}
+	return filepath.Join(home, ".kube-gateway", "gateway.yaml"), false, nil
+}
+
+// loadGatewayConfig 读取并校验网关配置文件
+func loadGatewayConfig(path string) (*gatewayConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取网关配置文件 %s: %w", path, err)
+	}
+	config := &gatewayConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("无法解析网关配置文件 %s: %w", path, err)
+	}
+	if err := config.RateLimits.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.Concurrency.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.CircuitBreaker.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.Timeouts.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.BodyLimits.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.DiscoveryCache.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.ReadCache.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.WatchCache.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.StaleReads.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	if err := config.Mirroring.validate(); err != nil {
+		return nil, fmt.Errorf("网关配置文件 %s 无效: %w", path, err)
+	}
+	return config, nil
+}
+
+// reloadGatewayConfig 重新加载网关配置。默认位置的配置文件不存在时使用空配置 (不做任何限制)，
+// 加载失败时保留之前的配置
+func reloadGatewayConfig() error {
+	path, explicit, err := defaultGatewayConfigPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) && !explicit {
+		currentGatewayConfig.Store(&gatewayConfig{})
+		return nil
+	}
+	config, err := loadGatewayConfig(path)
+	if err != nil {
+		return err
+	}
+	currentGatewayConfig.Store(config)
+	return nil
+}
+
+// gatewayConfigSnapshot 返回当前生效的网关配置
+func gatewayConfigSnapshot() *gatewayConfig {
+	if config := currentGatewayConfig.Load(); config != nil {
+		return config
+	}
+	return &gatewayConfig{}
+}
@@ -76,6 +76,9 @@ func runList(cmd *cobra.Command, args []string) {
 					info.APIServer = "Not Found"
 				}
 			}
+			if endpoints, err := readClusterEndpoints(filepath.Join(path, "endpoints")); err == nil && len(endpoints) > 0 {
+				info.APIServer += fmt.Sprintf(" (+%d)", len(endpoints))
+			}
 			clustersInfo = append(clustersInfo, info)
 			return filepath.SkipDir
 		}
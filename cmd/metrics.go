@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "kube_gateway"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Total number of API requests handled by the gateway.",
+	}, []string{"cluster", "token", "verb", "resource", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of API requests handled by the gateway.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"cluster", "token", "verb", "resource", "code"})
+
+	inflightRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "inflight_requests",
+		Help:      "Number of API requests currently being proxied, excluding long-running requests.",
+	}, []string{"cluster"})
+
+	activeWatches = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_watches",
+		Help:      "Number of watch requests currently open.",
+	}, []string{"cluster"})
+
+	longRunningRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "long_running_requests",
+		Help:      "Number of long-running requests (watch, exec, attach, port-forward, log follow, proxy) currently open.",
+	}, []string{"cluster", "kind"})
+
+	backendErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_errors_total",
+		Help:      "Total number of failed requests to backend API servers by error type.",
+	}, []string{"cluster", "type"})
+
+	reloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Total number of configuration reloads by result.",
+	}, []string{"result"})
+
+	lastReloadTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_timestamp_seconds",
+		Help:      "Unix timestamp of the last configuration reload by result.",
+	}, []string{"result"})
+
+	clustersLoaded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "clusters_loaded",
+		Help:      "Number of cluster proxies currently loaded.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		inflightRequests,
+		activeWatches,
+		longRunningRequests,
+		backendErrorsTotal,
+		reloadsTotal,
+		lastReloadTimestamp,
+		clustersLoaded,
+	)
+}
+
+// unauthenticatedLabel 是未通过 Token 校验的请求 (包括不转发的路径) 的 verb 和 resource 标签。
+// 这些请求的路径由客户端任意指定，不能用作标签，否则未经认证的客户端就能制造无限多的时间序列
+const unauthenticatedLabel = "unknown"
+
+// MetricsMiddleware 在请求处理完成后记录请求计数与延迟
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		startTime := time.Now()
+
+		c.Next()
+
+		latency := time.Since(startTime)
+
+		clusterName := c.GetString("targetCluster")
+		tokenName := c.GetString("tokenName")
+		code := strconv.Itoa(c.Writer.Status())
+		verb, resource := unauthenticatedLabel, unauthenticatedLabel
+		// tokenName 只在 Token 校验通过后设置
+		if _, authenticated := c.Get("tokenName"); authenticated {
+			info := requestInfoFor(c)
+			verb, resource = info.Verb, info.Resource
+		}
+
+		requestsTotal.WithLabelValues(clusterName, tokenName, verb, resource, code).Inc()
+		requestDuration.WithLabelValues(clusterName, tokenName, verb, resource, code).Observe(latency.Seconds())
+	}
+}
+
+// recordReload 记录一次配置重载的结果
+func recordReload(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	reloadsTotal.WithLabelValues(result).Inc()
+	lastReloadTimestamp.WithLabelValues(result).SetToCurrentTime()
+}
+
+// classifyBackendError 将访问后端 API Server 时出现的错误归类，用于指标和日志
+func classifyBackendError(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCertErr x509.CertificateInvalidError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &unknownAuthErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidCertErr):
+		return "tls"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection_reset"
+	default:
+		return "other"
+	}
+}
+
+// newAdminHandler 创建管理端口上的 HTTP 处理器
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/audit/stream", handleAuditStream)
+	return mux
+}
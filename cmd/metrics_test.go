@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddlewareLabels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MetricsMiddleware())
+	router.Any("/api/*proxyPath", func(c *gin.Context) {
+		if c.Request.Header.Get("Authorization") != "Bearer metrics-test" {
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+		c.Set("targetCluster", "metrics-test")
+		c.Set("tokenName", "metrics-test")
+		c.Status(http.StatusOK)
+	})
+	router.NoRoute(func(c *gin.Context) { c.Status(http.StatusNotFound) })
+
+	tests := []struct {
+		name    string
+		path    string
+		token   string
+		cluster string
+		labels  [4]string
+	}{
+		{name: "accepted token", path: "/api/v1/namespaces/default/pods", token: "metrics-test", cluster: "metrics-test",
+			labels: [4]string{"metrics-test", "list", "pods", "200"}},
+		{name: "invalid token", path: "/api/v1/namespaces/default/random-resource-1", token: "invalid",
+			labels: [4]string{"", unauthenticatedLabel, unauthenticatedLabel, "401"}},
+		{name: "unknown path", path: "/random/path/2",
+			labels: [4]string{"", unauthenticatedLabel, unauthenticatedLabel, "404"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := requestsTotal.WithLabelValues(tt.cluster, tt.labels[0], tt.labels[1], tt.labels[2], tt.labels[3])
+			before := testutil.ToFloat64(counter)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), req)
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("requests_total%v increased by %v, want 1", tt.labels, got)
+			}
+		})
+	}
+}
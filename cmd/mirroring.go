@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxInflightMirrors 是同时进行的镜像请求数上限，超出时丢弃新的镜像请求，避免影子集群变慢时占用过多资源
+	maxInflightMirrors = 64
+	// defaultMirrorSizeTolerance 是默认允许的响应大小差异的百分比，两个集群中对象的 resourceVersion、时间戳等字段本来就不同
+	defaultMirrorSizeTolerance = 10
+	// mirrorTimeout 是镜像请求等待影子集群响应的时间
+	mirrorTimeout = defaultRequestTimeout
+)
+
+var mirroredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "mirrored_requests_total",
+	Help:      "Total number of read requests mirrored to a shadow cluster by result (match, mismatch, error, dropped).",
+}, []string{"cluster", "target", "result"})
+
+func init() {
+	metricsRegistry.MustRegister(mirroredRequests)
+}
+
+// mirrorSettings 设置一个集群的请求镜像: target 是接收镜像请求的影子集群，必须是已经添加的集群或别名；
+// percent 是被镜像的 GET/LIST 请求的百分比，不设置表示全部，0 表示暂停；两边响应大小的差异超过 sizeTolerancePercent 时记为不一致
+type mirrorSettings struct {
+	Target               string   `json:"target"`
+	Percent              *float64 `json:"percent,omitempty"`
+	SizeTolerancePercent float64  `json:"sizeTolerancePercent,omitempty"`
+}
+
+// mirrorConfig 是 gateway.yaml 中的 mirroring 部分，按集群名称设置
+type mirrorConfig struct {
+	Clusters map[string]mirrorSettings `json:"clusters,omitempty"`
+}
+
+func (c *mirrorConfig) validate() error {
+	for name, settings := range c.Clusters {
+		if settings.Target == "" {
+			return fmt.Errorf("mirroring.clusters.%s.target 不能为空", name)
+		}
+		if settings.Target == name {
+			return fmt.Errorf("mirroring.clusters.%s.target 不能是集群自身", name)
+		}
+		if !mirrorTargetExists(settings.Target) {
+			return fmt.Errorf("mirroring.clusters.%s.target: 找不到名为 '%s' 的集群或别名", name, settings.Target)
+		}
+		if settings.Percent != nil && (*settings.Percent < 0 || *settings.Percent > 100) {
+			return fmt.Errorf("mirroring.clusters.%s.percent 必须在 0 到 100 之间", name)
+		}
+		if settings.SizeTolerancePercent < 0 {
+			return fmt.Errorf("mirroring.clusters.%s.sizeTolerancePercent 不能为负数", name)
+		}
+	}
+	return nil
+}
+
+// mirrorTargetExists 判断影子集群是否是已经添加的集群或别名。网关启动时先加载配置再加载集群，
+// 因此直接检查集群和别名目录中的 token 文件
+func mirrorTargetExists(name string) bool {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return false
+	}
+	for _, dir := range []string{"clusters", "aliases"} {
+		if _, err := os.Stat(filepath.Join(home, ".kube-gateway", dir, name, "token")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorSlots 限制同时进行的镜像请求数
+var mirrorSlots = make(chan struct{}, maxInflightMirrors)
+
+// mirroredRequest 是一个需要复制到影子集群的请求，在主请求完成后根据主请求的响应发出
+type mirroredRequest struct {
+	clusterName string
+	settings    mirrorSettings
+	request     *http.Request
+}
+
+// mirrorFor 判断请求是否需要镜像: 只镜像配置了影子集群的集群中的 get 和 list，并按 percent 抽样。
+// 请求在转发过程中可能被修改，因此在此时复制一份
+func mirrorFor(req *http.Request, clusterName string, info *RequestInfo, longRunning string) *mirroredRequest {
+	if req.Method != http.MethodGet || longRunning != "" || (info.Verb != "get" && info.Verb != "list") {
+		return nil
+	}
+	settings, ok := gatewayConfigSnapshot().Mirroring.Clusters[clusterName]
+	if !ok {
+		return nil
+	}
+	if settings.Percent != nil && rand.Float64()*100 >= *settings.Percent {
+		return nil
+	}
+	clone := req.Clone(context.Background())
+	clone.Body = http.NoBody
+	return &mirroredRequest{clusterName: clusterName, settings: settings, request: clone}
+}
+
+// start 在主请求完成后调用，异步把请求发往影子集群并比较状态码和响应大小，不会阻塞主请求
+func (m *mirroredRequest) start(primary gin.ResponseWriter) {
+	primaryStatus, primarySize := primary.Status(), primary.Size()
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		mirroredRequests.WithLabelValues(m.clusterName, m.settings.Target, "dropped").Inc()
+		return
+	}
+	go func() {
+		defer func() { <-mirrorSlots }()
+		m.run(primaryStatus, max(primarySize, 0))
+	}()
+}
+
+func (m *mirroredRequest) run(primaryStatus, primarySize int) {
+	target := m.settings.Target
+	proxy := proxyForCluster(target)
+	if proxy == nil {
+		mirroredRequests.WithLabelValues(m.clusterName, target, "error").Inc()
+		log.Printf("警告: 镜像: 影子集群 %s 不存在", target)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+	recorder := &mirrorResponseRecorder{header: make(http.Header)}
+	proxy.ServeHTTP(recorder, m.request.WithContext(ctx))
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	path := m.request.URL.RequestURI()
+	if ctx.Err() != nil {
+		mirroredRequests.WithLabelValues(m.clusterName, target, "error").Inc()
+		log.Printf("镜像: 影子集群 %s 未能在 %s 内响应 GET %s", target, mirrorTimeout, path)
+		return
+	}
+	tolerance := m.settings.SizeTolerancePercent
+	if tolerance == 0 {
+		tolerance = defaultMirrorSizeTolerance
+	}
+	if recorder.status == primaryStatus && sizesMatch(primarySize, recorder.size, tolerance) {
+		mirroredRequests.WithLabelValues(m.clusterName, target, "match").Inc()
+		return
+	}
+	mirroredRequests.WithLabelValues(m.clusterName, target, "mismatch").Inc()
+	log.Printf("镜像: 集群 %s 与影子集群 %s 的响应不一致: GET %s 状态码 %d / %d，响应大小 %d / %d 字节",
+		m.clusterName, target, path, primaryStatus, recorder.status, primarySize, recorder.size)
+}
+
+// sizesMatch 判断两个响应大小的差异是否在允许的百分比之内
+func sizesMatch(a, b int, tolerancePercent float64) bool {
+	if a == b {
+		return true
+	}
+	diff := float64(max(a, b) - min(a, b))
+	return diff*100 <= float64(max(a, b))*tolerancePercent
+}
+
+// proxyForCluster 返回转发到指定集群的反向代理，名称也可以是别名 (使用其当前指向的集群)，不存在时返回 nil
+func proxyForCluster(clusterName string) *httputil.ReverseProxy {
+	proxyMutex.RLock()
+	defer proxyMutex.RUnlock()
+	for token, name := range tokenNameMap {
+		if name == clusterName {
+			return proxyMap[token]
+		}
+	}
+	return nil
+}
+
+// mirrorResponseRecorder 丢弃影子集群的响应，只记录状态码和大小
+type mirrorResponseRecorder struct {
+	header http.Header
+	status int
+	size   int
+}
+
+func (r *mirrorResponseRecorder) Header() http.Header { return r.header }
+
+func (r *mirrorResponseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *mirrorResponseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.size += len(p)
+	return len(p), nil
+}
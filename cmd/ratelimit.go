@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// 限速的作用范围
+const (
+	rateLimitScopeGlobal  = "global"
+	rateLimitScopeCluster = "cluster"
+	rateLimitScopeToken   = "token"
+)
+
+// 读请求和写请求使用各自独立的令牌桶，避免大量 list/watch 挤占写操作的额度，反之亦然
+const (
+	rateLimitClassRead     = "read"
+	rateLimitClassMutating = "mutating"
+)
+
+var rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "rate_limited_requests_total",
+	Help:      "Total number of requests rejected by the gateway rate limiter.",
+}, []string{"cluster", "token", "scope", "class"})
+
+func init() {
+	metricsRegistry.MustRegister(rateLimitedRequests)
+}
+
+// rateLimitBudget 是一个令牌桶: 每秒补充 qps 个令牌，最多累积 burst 个
+type rateLimitBudget struct {
+	QPS   float64 `json:"qps"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// rateLimitBudgets 分别为读请求和写请求设置额度，未设置的一类不限速
+type rateLimitBudgets struct {
+	Read     *rateLimitBudget `json:"read,omitempty"`
+	Mutating *rateLimitBudget `json:"mutating,omitempty"`
+}
+
+// rateLimitConfig 是 gateway.yaml 中的 rateLimits 部分。
+// perCluster/perToken 是每个集群/Token 的默认额度，clusters/tokens 中可以按名称单独覆盖
+type rateLimitConfig struct {
+	Global     rateLimitBudgets            `json:"global,omitempty"`
+	PerCluster rateLimitBudgets            `json:"perCluster,omitempty"`
+	PerToken   rateLimitBudgets            `json:"perToken,omitempty"`
+	Clusters   map[string]rateLimitBudgets `json:"clusters,omitempty"`
+	Tokens     map[string]rateLimitBudgets `json:"tokens,omitempty"`
+}
+
+func (b *rateLimitBudgets) forClass(class string) *rateLimitBudget {
+	if class == rateLimitClassMutating {
+		return b.Mutating
+	}
+	return b.Read
+}
+
+// budgetFor 返回某个集群或 Token 的额度，单独配置的优先于默认值
+func budgetFor(overrides map[string]rateLimitBudgets, defaults rateLimitBudgets, name, class string) *rateLimitBudget {
+	if override, ok := overrides[name]; ok {
+		if budget := override.forClass(class); budget != nil {
+			return budget
+		}
+	}
+	return defaults.forClass(class)
+}
+
+func (c *rateLimitConfig) validate() error {
+	check := func(where string, budgets rateLimitBudgets) error {
+		for class, budget := range map[string]*rateLimitBudget{rateLimitClassRead: budgets.Read, rateLimitClassMutating: budgets.Mutating} {
+			if budget == nil {
+				continue
+			}
+			if budget.QPS <= 0 {
+				return fmt.Errorf("rateLimits.%s.%s.qps 必须大于 0", where, class)
+			}
+			if budget.Burst < 0 {
+				return fmt.Errorf("rateLimits.%s.%s.burst 不能为负数", where, class)
+			}
+		}
+		return nil
+	}
+	if err := check("global", c.Global); err != nil {
+		return err
+	}
+	if err := check("perCluster", c.PerCluster); err != nil {
+		return err
+	}
+	if err := check("perToken", c.PerToken); err != nil {
+		return err
+	}
+	for name, budgets := range c.Clusters {
+		if err := check("clusters."+name, budgets); err != nil {
+			return err
+		}
+	}
+	for name, budgets := range c.Tokens {
+		if err := check("tokens."+name, budgets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// burst 未设置时允许一秒内的请求量一次性通过
+func (b *rateLimitBudget) burst() int {
+	if b.Burst > 0 {
+		return b.Burst
+	}
+	return int(math.Max(1, math.Ceil(b.QPS)))
+}
+
+// rateLimiterRegistry 按 "范围/名称/类别" 保存令牌桶。重新加载配置后额度有变化的令牌桶会被原地调整，
+// 已经消耗的令牌不会因为 reload 而被重置
+type rateLimiterRegistry struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+var rateLimiters = &rateLimiterRegistry{limiters: make(map[string]*rate.Limiter)}
+
+func (r *rateLimiterRegistry) get(key string, budget *rateLimitBudget, now time.Time) *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	limit, burst := rate.Limit(budget.QPS), budget.burst()
+	limiter, ok := r.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(limit, burst)
+		r.limiters[key] = limiter
+		return limiter
+	}
+	if limiter.Limit() != limit {
+		limiter.SetLimitAt(now, limit)
+	}
+	if limiter.Burst() != burst {
+		limiter.SetBurstAt(now, burst)
+	}
+	return limiter
+}
+
+// rateLimitRejection 描述一次被限速的请求
+type rateLimitRejection struct {
+	scope      string
+	class      string
+	qps        float64
+	retryAfter time.Duration
+}
+
+// checkRateLimit 依次检查全局、集群和 Token 三个令牌桶。只有全部通过时才真正消耗令牌，
+// 任何一个被拒绝都会归还已经预留的令牌，避免被拒绝的请求占用其他范围的额度
+func checkRateLimit(clusterName, tokenName string, mutating bool) *rateLimitRejection {
+	class := rateLimitClassRead
+	if mutating {
+		class = rateLimitClassMutating
+	}
+	limits := &gatewayConfigSnapshot().RateLimits
+	checks := []struct {
+		scope  string
+		key    string
+		budget *rateLimitBudget
+	}{
+		{rateLimitScopeGlobal, rateLimitScopeGlobal + "/" + class, limits.Global.forClass(class)},
+		{rateLimitScopeCluster, rateLimitScopeCluster + "/" + clusterName + "/" + class, budgetFor(limits.Clusters, limits.PerCluster, clusterName, class)},
+		{rateLimitScopeToken, rateLimitScopeToken + "/" + tokenName + "/" + class, budgetFor(limits.Tokens, limits.PerToken, tokenName, class)},
+	}
+
+	now := time.Now()
+	var reserved []*rate.Reservation
+	for _, check := range checks {
+		if check.budget == nil {
+			continue
+		}
+		reservation := rateLimiters.get(check.key, check.budget, now).ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+			reservation.CancelAt(now)
+			for _, r := range reserved {
+				r.CancelAt(now)
+			}
+			rateLimitedRequests.WithLabelValues(clusterName, tokenName, check.scope, class).Inc()
+			return &rateLimitRejection{scope: check.scope, class: class, qps: check.budget.QPS, retryAfter: delay}
+		}
+		reserved = append(reserved, reservation)
+	}
+	return nil
+}
+
+// message 返回给客户端的说明
+func (r *rateLimitRejection) message(clusterName, tokenName string) string {
+	kind := "读请求"
+	if r.class == rateLimitClassMutating {
+		kind = "写请求"
+	}
+	switch r.scope {
+	case rateLimitScopeCluster:
+		return fmt.Sprintf("请求过多: 集群 %s 的%s超过了网关限速 (%g QPS)，请稍后重试", clusterName, kind, r.qps)
+	case rateLimitScopeToken:
+		return fmt.Sprintf("请求过多: Token %s 的%s超过了网关限速 (%g QPS)，请稍后重试", tokenName, kind, r.qps)
+	default:
+		return fmt.Sprintf("请求过多: 网关的%s总量超过了限速 (%g QPS)，请稍后重试", kind, r.qps)
+	}
+}
+
+// retryAfterSeconds 将等待时间向上取整为秒
+func (r *rateLimitRejection) retryAfterSeconds() int32 {
+	return int32(math.Ceil(r.retryAfter.Seconds()))
+}
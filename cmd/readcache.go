@@ -0,0 +1,429 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// readCacheDiscoveryRetry 是查询资源信息失败后重试的间隔
+const readCacheDiscoveryRetry = 30 * time.Second
+
+var (
+	readCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "read_cache_requests_total",
+		Help:      "Total number of GET/LIST requests for cached resources by result (hit, miss, bypass).",
+	}, []string{"cluster", "resource", "result"})
+
+	readCacheObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "read_cache_objects",
+		Help:      "Number of objects currently held in the informer-backed read cache.",
+	}, []string{"cluster", "resource"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(readCacheRequests, readCacheObjects)
+}
+
+// readCacheResource 是一个需要缓存的资源，例如 {group: apps, version: v1, resource: deployments}
+type readCacheResource struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+}
+
+func (r readCacheResource) gvr() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+}
+
+// readCacheSettings 设置一个集群需要缓存的资源。默认只有允许读取旧数据的请求由缓存返回，
+// 没有指定 resourceVersion 的请求 (要求读取最新数据) 转发到后端，保证写入后立即读取能看到刚写入的内容；
+// relaxedConsistency 为 true 时这些请求也由可能稍有延迟的缓存返回
+type readCacheSettings struct {
+	Resources          []readCacheResource `json:"resources,omitempty"`
+	RelaxedConsistency *bool               `json:"relaxedConsistency,omitempty"`
+}
+
+func (s readCacheSettings) relaxed() bool {
+	return s.RelaxedConsistency != nil && *s.RelaxedConsistency
+}
+
+// readCacheConfig 是 gateway.yaml 中的 readCache 部分，perCluster 是所有集群的默认值，
+// clusters 中单独设置的 resources 会替换默认的资源列表
+type readCacheConfig struct {
+	PerCluster readCacheSettings            `json:"perCluster,omitempty"`
+	Clusters   map[string]readCacheSettings `json:"clusters,omitempty"`
+}
+
+func (c *readCacheConfig) settingsFor(clusterName string) readCacheSettings {
+	settings := c.PerCluster
+	if override, ok := c.Clusters[clusterName]; ok {
+		if override.Resources != nil {
+			settings.Resources = override.Resources
+		}
+		if override.RelaxedConsistency != nil {
+			settings.RelaxedConsistency = override.RelaxedConsistency
+		}
+	}
+	return settings
+}
+
+// validateCacheResources 检查缓存的资源列表，where 是配置中的位置，例如 readCache.perCluster
+func validateCacheResources(where string, resources []readCacheResource) error {
+	for i, r := range resources {
+		if r.Version == "" || r.Resource == "" {
+			return fmt.Errorf("%s.resources[%d] 必须指定 version 和 resource", where, i)
+		}
+		if strings.Contains(r.Resource, "/") {
+			return fmt.Errorf("%s.resources[%d] 不支持子资源 '%s'", where, i, r.Resource)
+		}
+	}
+	return nil
+}
+
+func (c *readCacheConfig) validate() error {
+	if err := validateCacheResources("readCache.perCluster", c.PerCluster.Resources); err != nil {
+		return err
+	}
+	for name, settings := range c.Clusters {
+		if err := validateCacheResources("readCache.clusters."+name, settings.Resources); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resourceCache 是一个集群中某个资源的 informer
+type resourceCache struct {
+	clusterName string
+	gvr         schema.GroupVersionResource
+	config      *rest.Config
+	stop        chan struct{}
+
+	mu         sync.RWMutex
+	kind       string
+	namespaced bool
+	informer   cache.SharedIndexInformer
+}
+
+// readCacheManager 按 "集群/资源" 管理 informer，执行 reload 时按新配置增减
+type readCacheManager struct {
+	mu     sync.RWMutex
+	caches map[string]*resourceCache
+}
+
+var readCaches = &readCacheManager{caches: make(map[string]*resourceCache)}
+
+func readCacheKey(clusterName string, gvr schema.GroupVersionResource) string {
+	return clusterName + "/" + gvr.String()
+}
+
+// readCacheResourceLabel 是指标中资源的名称，例如 deployments.apps
+func readCacheResourceLabel(gvr schema.GroupVersionResource) string {
+	return gvr.GroupResource().String()
+}
+
+// reconcile 按当前配置启动新增的 informer，停止已经不需要或集群配置发生变化的 informer
+func (m *readCacheManager) reconcile(configs map[string]*rest.Config) {
+	config := &gatewayConfigSnapshot().ReadCache
+	desired := make(map[string]*resourceCache)
+	for clusterName, restConfig := range configs {
+		for _, r := range config.settingsFor(clusterName).Resources {
+			gvr := r.gvr()
+			desired[readCacheKey(clusterName, gvr)] = &resourceCache{clusterName: clusterName, gvr: gvr, config: restConfig}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, rc := range m.caches {
+		if want, ok := desired[key]; ok && reflect.DeepEqual(*want.config, *rc.config) {
+			continue
+		}
+		close(rc.stop)
+		delete(m.caches, key)
+		readCacheObjects.DeleteLabelValues(rc.clusterName, readCacheResourceLabel(rc.gvr))
+		log.Printf("读缓存: 已停止集群 %s 的 %s", rc.clusterName, readCacheResourceLabel(rc.gvr))
+	}
+	for key, rc := range desired {
+		if _, ok := m.caches[key]; ok {
+			continue
+		}
+		rc.stop = make(chan struct{})
+		m.caches[key] = rc
+		go rc.run()
+	}
+}
+
+func (m *readCacheManager) lookup(clusterName string, gvr schema.GroupVersionResource) *resourceCache {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.caches[readCacheKey(clusterName, gvr)]
+}
+
+// run 查询资源的 Kind 和作用域后启动 informer，直到 stop 被关闭
+func (rc *resourceCache) run() {
+	name := readCacheResourceLabel(rc.gvr)
+	for {
+		kind, namespaced, err := rc.discover()
+		if err == nil {
+			rc.mu.Lock()
+			rc.kind, rc.namespaced = kind, namespaced
+			rc.mu.Unlock()
+			break
+		}
+		log.Printf("警告: 读缓存: 无法获取集群 %s 的 %s 的资源信息: %v，%s 后重试", rc.clusterName, name, err, readCacheDiscoveryRetry)
+		select {
+		case <-rc.stop:
+			return
+		case <-time.After(readCacheDiscoveryRetry):
+		}
+	}
+
+	client, err := dynamic.NewForConfig(rc.config)
+	if err != nil {
+		log.Printf("警告: 读缓存: 无法为集群 %s 创建客户端: %v", rc.clusterName, err)
+		return
+	}
+	informer := dynamicinformer.NewFilteredDynamicInformer(client, rc.gvr, metav1.NamespaceAll, 0,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, nil).Informer()
+	objects := readCacheObjects.WithLabelValues(rc.clusterName, name)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { objects.Inc() },
+		DeleteFunc: func(interface{}) { objects.Dec() },
+	})
+	rc.mu.Lock()
+	rc.informer = informer
+	rc.mu.Unlock()
+
+	log.Printf("读缓存: 正在同步集群 %s 的 %s", rc.clusterName, name)
+	go informer.Run(rc.stop)
+	if cache.WaitForCacheSync(rc.stop, informer.HasSynced) {
+		log.Printf("读缓存: 集群 %s 的 %s 已同步 (%d 个对象)", rc.clusterName, name, len(informer.GetStore().ListKeys()))
+	}
+}
+
+// discover 查询资源的 Kind 以及是否属于命名空间，并确认资源支持 list 和 watch
+func (rc *resourceCache) discover() (string, bool, error) {
+	client, err := discovery.NewDiscoveryClientForConfig(rc.config)
+	if err != nil {
+		return "", false, err
+	}
+	resources, err := client.ServerResourcesForGroupVersion(rc.gvr.GroupVersion().String())
+	if err != nil {
+		return "", false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name != rc.gvr.Resource {
+			continue
+		}
+		verbs := r.Verbs.String()
+		if !strings.Contains(verbs, "list") || !strings.Contains(verbs, "watch") {
+			return "", false, fmt.Errorf("资源不支持 list 和 watch")
+		}
+		return r.Kind, r.Namespaced, nil
+	}
+	return "", false, fmt.Errorf("资源不存在")
+}
+
+// synced 返回已经完成同步的 informer，尚未就绪时返回 nil
+func (rc *resourceCache) synced() (cache.SharedIndexInformer, string, bool) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	if rc.informer == nil || !rc.informer.HasSynced() {
+		return nil, "", false
+	}
+	return rc.informer, rc.kind, rc.namespaced
+}
+
+// acceptsPlainJSON 判断客户端是否接受普通的 JSON 响应。kubectl get 首选服务端生成的 Table，
+// client-go 可能首选 protobuf，这些请求都转发到后端
+func acceptsPlainJSON(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	first := strings.Split(accept, ",")[0]
+	mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(first))
+	if err != nil {
+		return false
+	}
+	if _, ok := params["as"]; ok {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "*/*" || mediaType == "application/*"
+}
+
+// servableResourceVersion 判断 resourceVersion 相关参数能否由缓存满足:
+// 未指定时要求最新数据 (只有 relaxed 时由缓存返回)，"0" 表示任意数据，其余值要求缓存不早于该版本，Exact 和分页请求转发到后端
+func servableResourceVersion(query url.Values, cacheVersion string, relaxed bool) bool {
+	if query.Get("continue") != "" {
+		return false
+	}
+	rv, match := query.Get("resourceVersion"), query.Get("resourceVersionMatch")
+	switch {
+	case match == string(metav1.ResourceVersionMatchExact):
+		return false
+	case rv == "":
+		return relaxed
+	case rv == "0":
+		return true
+	case match == "" && query.Get("limit") != "":
+		// 旧的分页语义下，带 limit 的非零 resourceVersion 表示精确匹配
+		return false
+	}
+	requested, err := strconv.ParseUint(rv, 10, 64)
+	if err != nil {
+		return false
+	}
+	current, err := strconv.ParseUint(cacheVersion, 10, 64)
+	return err == nil && requested <= current
+}
+
+// serveFromReadCache 尝试由 informer 返回 GET/LIST 请求，返回值表示是否已处理请求
+func serveFromReadCache(w http.ResponseWriter, req *http.Request, clusterName string, info *RequestInfo) bool {
+	if !info.IsResourceRequest || info.Subresource != "" || (info.Verb != "get" && info.Verb != "list") {
+		return false
+	}
+	gvr := schema.GroupVersionResource{Group: info.APIGroup, Version: info.APIVersion, Resource: info.Resource}
+	rc := readCaches.lookup(clusterName, gvr)
+	if rc == nil {
+		return false
+	}
+	resourceLabel := readCacheResourceLabel(gvr)
+	// 模拟其他身份的请求需要后端检查被模拟身份的权限，而缓存中是网关身份能读取的全部对象
+	if hasImpersonationHeaders(req) {
+		readCacheRequests.WithLabelValues(clusterName, resourceLabel, "bypass").Inc()
+		return false
+	}
+	informer, kind, namespaced := rc.synced()
+	if informer == nil {
+		readCacheRequests.WithLabelValues(clusterName, resourceLabel, "miss").Inc()
+		return false
+	}
+	query := req.URL.Query()
+	relaxed := gatewayConfigSnapshot().ReadCache.settingsFor(clusterName).relaxed()
+	if !acceptsPlainJSON(req.Header.Get("Accept")) || !servableResourceVersion(query, informer.LastSyncResourceVersion(), relaxed) {
+		readCacheRequests.WithLabelValues(clusterName, resourceLabel, "bypass").Inc()
+		return false
+	}
+
+	var body []byte
+	var err error
+	if info.Verb == "get" {
+		key := info.Name
+		if namespaced {
+			key = info.Namespace + "/" + info.Name
+		}
+		item, exists, _ := informer.GetIndexer().GetByKey(key)
+		if !exists {
+			// 对象可能刚刚创建，交给后端确认
+			readCacheRequests.WithLabelValues(clusterName, resourceLabel, "miss").Inc()
+			return false
+		}
+		body, err = item.(*unstructured.Unstructured).MarshalJSON()
+	} else {
+		list, ok := listFromReadCache(informer, query, gvr, kind, info.Namespace)
+		if !ok {
+			readCacheRequests.WithLabelValues(clusterName, resourceLabel, "bypass").Inc()
+			return false
+		}
+		body, err = list.MarshalJSON()
+	}
+	if err != nil {
+		readCacheRequests.WithLabelValues(clusterName, resourceLabel, "miss").Inc()
+		return false
+	}
+	readCacheRequests.WithLabelValues(clusterName, resourceLabel, "hit").Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return true
+}
+
+// listFromReadCache 按命名空间、标签选择器和字段选择器过滤缓存中的对象。
+// 与 API Server 从 watch 缓存返回的结果一致，limit 参数会被忽略，一次返回全部对象
+func listFromReadCache(informer cache.SharedIndexInformer, query url.Values, gvr schema.GroupVersionResource, kind, namespace string) (*unstructured.UnstructuredList, bool) {
+	labelSelector, fieldSelector, ok := parseCacheSelectors(query)
+	if !ok {
+		return nil, false
+	}
+
+	var items []interface{}
+	var err error
+	if namespace != "" {
+		items, err = informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+		if err != nil {
+			return nil, false
+		}
+	} else {
+		items = informer.GetIndexer().List()
+	}
+
+	list := &unstructured.UnstructuredList{Object: map[string]interface{}{
+		"apiVersion": gvr.GroupVersion().String(),
+		"kind":       kind + "List",
+		"metadata":   map[string]interface{}{"resourceVersion": informer.LastSyncResourceVersion()},
+	}}
+	for _, item := range items {
+		obj := item.(*unstructured.Unstructured)
+		if !selectorsMatch(obj, labelSelector, fieldSelector) {
+			continue
+		}
+		list.Items = append(list.Items, *obj)
+	}
+	// 与 API Server 一致，按命名空间和名称排序
+	sort.Slice(list.Items, func(i, j int) bool {
+		if list.Items[i].GetNamespace() != list.Items[j].GetNamespace() {
+			return list.Items[i].GetNamespace() < list.Items[j].GetNamespace()
+		}
+		return list.Items[i].GetName() < list.Items[j].GetName()
+	})
+	return list, true
+}
+
+// parseCacheSelectors 解析请求中的标签选择器和字段选择器。字段选择器只支持所有资源都有的
+// metadata.name 和 metadata.namespace，其余情况返回 false 交给后端处理
+func parseCacheSelectors(query url.Values) (labels.Selector, fields.Selector, bool) {
+	labelSelector, err := labels.Parse(query.Get("labelSelector"))
+	if err != nil {
+		return nil, nil, false
+	}
+	fieldSelector, err := fields.ParseSelector(query.Get("fieldSelector"))
+	if err != nil {
+		return nil, nil, false
+	}
+	for _, requirement := range fieldSelector.Requirements() {
+		if requirement.Field != "metadata.name" && requirement.Field != "metadata.namespace" {
+			return nil, nil, false
+		}
+	}
+	return labelSelector, fieldSelector, true
+}
+
+func selectorsMatch(obj *unstructured.Unstructured, labelSelector labels.Selector, fieldSelector fields.Selector) bool {
+	return labelSelector.Matches(labels.Set(obj.GetLabels())) &&
+		fieldSelector.Matches(fields.Set{"metadata.name": obj.GetName(), "metadata.namespace": obj.GetNamespace()})
+}
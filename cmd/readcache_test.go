@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestServableResourceVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		cache   string
+		relaxed bool
+		want    bool
+	}{
+		{name: "unset requires latest data", query: "", cache: "100", want: false},
+		{name: "unset served when relaxed", query: "", cache: "100", relaxed: true, want: true},
+		{name: "zero accepts any data", query: "resourceVersion=0", cache: "100", want: true},
+		{name: "older version", query: "resourceVersion=90", cache: "100", want: true},
+		{name: "same version", query: "resourceVersion=100", cache: "100", want: true},
+		{name: "newer version", query: "resourceVersion=101", cache: "100", want: false},
+		{name: "not older than", query: "resourceVersion=90&resourceVersionMatch=NotOlderThan", cache: "100", want: true},
+		{name: "exact match", query: "resourceVersion=90&resourceVersionMatch=Exact", cache: "100", want: false},
+		{name: "legacy paging with limit", query: "resourceVersion=90&limit=10", cache: "100", want: false},
+		{name: "zero with limit", query: "resourceVersion=0&limit=10", cache: "100", want: true},
+		{name: "continue token", query: "resourceVersion=0&continue=abc", cache: "100", want: false},
+		{name: "invalid version", query: "resourceVersion=abc", cache: "100", want: false},
+		{name: "cache not synced", query: "resourceVersion=90", cache: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := servableResourceVersion(query, tt.cache, tt.relaxed); got != tt.want {
+				t.Errorf("servableResourceVersion(%q, %q, %v) = %v, want %v", tt.query, tt.cache, tt.relaxed, got, tt.want)
+			}
+		})
+	}
+}
+
+// startTestReadCache 为集群 readcache-test 的 pods 登记一个已同步的 informer，缓存中有 default/a 和 default/b
+func startTestReadCache(t *testing.T) {
+	t.Helper()
+	list := &unstructured.UnstructuredList{}
+	list.SetAPIVersion("v1")
+	list.SetKind("PodList")
+	list.SetResourceVersion("10")
+	list.Items = []unstructured.Unstructured{*testPod("a", "db", "5"), *testPod("b", "web", "6")}
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc:  func(metav1.ListOptions) (runtime.Object, error) { return list, nil },
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) { return watch.NewFake(), nil },
+	}, &unstructured.Unstructured{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		t.Fatal("informer did not sync")
+	}
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	key := readCacheKey("readcache-test", gvr)
+	readCaches.mu.Lock()
+	readCaches.caches[key] = &resourceCache{clusterName: "readcache-test", gvr: gvr, kind: "Pod", namespaced: true, informer: informer}
+	readCaches.mu.Unlock()
+	t.Cleanup(func() {
+		readCaches.mu.Lock()
+		delete(readCaches.caches, key)
+		readCaches.mu.Unlock()
+	})
+}
+
+func TestServeFromReadCache(t *testing.T) {
+	startTestReadCache(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		// wantServed 为 false 表示请求应转发到后端
+		wantServed bool
+		wantNames  []string
+	}{
+		{name: "get", path: "/api/v1/namespaces/default/pods/a?resourceVersion=0", wantServed: true, wantNames: []string{"a"}},
+		{name: "list", path: "/api/v1/namespaces/default/pods?resourceVersion=0", wantServed: true, wantNames: []string{"a", "b"}},
+		{name: "list with selector", path: "/api/v1/pods?resourceVersion=0&labelSelector=app%3Dweb", wantServed: true, wantNames: []string{"b"}},
+		{name: "latest data required", path: "/api/v1/namespaces/default/pods"},
+		{name: "not in cache", path: "/api/v1/namespaces/default/pods/c?resourceVersion=0"},
+		{name: "table", path: "/api/v1/namespaces/default/pods?resourceVersion=0",
+			headers: map[string]string{"Accept": "application/json;as=Table;v=v1;g=meta.k8s.io"}},
+		{name: "impersonated user", path: "/api/v1/namespaces/default/pods?resourceVersion=0",
+			headers: map[string]string{"Impersonate-User": "restricted"}},
+		{name: "impersonated group", path: "/api/v1/namespaces/default/pods/a?resourceVersion=0",
+			headers: map[string]string{"Impersonate-Group": "viewers"}},
+		{name: "impersonated extra", path: "/api/v1/namespaces/default/pods?resourceVersion=0",
+			headers: map[string]string{"Impersonate-Extra-Scopes": "view"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			info := parseRequestInfo(req)
+			recorder := httptest.NewRecorder()
+			served := serveFromReadCache(recorder, req, "readcache-test", info)
+			if served != tt.wantServed {
+				t.Fatalf("served = %v, want %v", served, tt.wantServed)
+			}
+			if !served {
+				if recorder.Body.Len() != 0 {
+					t.Errorf("a forwarded request must not get a response from the cache, got %s", recorder.Body)
+				}
+				return
+			}
+			object := &unstructured.Unstructured{}
+			if err := object.UnmarshalJSON(recorder.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			if object.IsList() {
+				list, _ := object.ToList()
+				for _, item := range list.Items {
+					names = append(names, item.GetName())
+				}
+			} else {
+				names = append(names, object.GetName())
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("names = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	reportSince  string
+	reportUntil  string
+	reportOutput string
+	reportTop    int
+)
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Generate a usage report per cluster and per token from the audit log",
+	Long: `Generate a usage report per cluster and per token from the audit log.
+
+The report contains request counts, error rates, p50/p95 latency, top resources,
+write operations and the tokens and clusters that were not used in the period.
+
+Example:
+  kube-gateway report --since 720h
+  kube-gateway report --since 2025-01-01 --until 2025-02-01 -o markdown > 2025-01.md`,
+	Args: cobra.NoArgs,
+	Run:  runReport,
+}
+
+func init() {
+	reportCmd.Flags().StringVar(&auditFilePath, "file", "", "审计日志文件路径，默认为 ~/.kube-gateway/logs/audit.log (会同时读取轮转后的备份)")
+	reportCmd.Flags().StringVar(&reportSince, "since", "720h", "统计的起始时间 (RFC3339、2006-01-02 或时长，例如 720h)")
+	reportCmd.Flags().StringVar(&reportUntil, "until", "", "统计的结束时间，默认为现在")
+	reportCmd.Flags().StringVarP(&reportOutput, "output", "o", "table", "输出格式: table、json 或 markdown")
+	reportCmd.Flags().IntVar(&reportTop, "top", 5, "每个集群/Token 显示访问最多的资源个数")
+	rootCmd.AddCommand(reportCmd)
+}
+
+// usageResourceCount 是某个资源被访问的次数
+type usageResourceCount struct {
+	Resource string `json:"resource"`
+	Count    int    `json:"count"`
+}
+
+// usageStats 是一个集群或一个 Token 在统计周期内的使用情况
+type usageStats struct {
+	Name         string               `json:"name"`
+	User         string               `json:"user,omitempty"`
+	Requests     int                  `json:"requests"`
+	Errors       int                  `json:"errors"`
+	ErrorRate    float64              `json:"errorRate"`
+	P50Ms        int64                `json:"p50Ms"`
+	P95Ms        int64                `json:"p95Ms"`
+	Writes       int                  `json:"writes"`
+	TopResources []usageResourceCount `json:"topResources,omitempty"`
+	LastSeen     *time.Time           `json:"lastSeen,omitempty"`
+
+	latencies []int64
+	resources map[string]int
+}
+
+// usageReport 是 report 命令的完整输出
+type usageReport struct {
+	Since          time.Time     `json:"since,omitempty"`
+	Until          time.Time     `json:"until"`
+	Records        int           `json:"records"`
+	Clusters       []*usageStats `json:"clusters"`
+	Tokens         []*usageStats `json:"tokens"`
+	UnusedClusters []string      `json:"unusedClusters"`
+	UnusedTokens   []string      `json:"unusedTokens"`
+}
+
+func (s *usageStats) add(r *auditRecord) {
+	s.Requests++
+	if r.StatusCode >= 400 {
+		s.Errors++
+	}
+	if isWriteVerb(r.Verb) {
+		s.Writes++
+	}
+	s.latencies = append(s.latencies, r.LatencyMs)
+
+	resource := r.Resource
+	if r.Subresource != "" {
+		resource += "/" + r.Subresource
+	}
+	if resource != "" {
+		if s.resources == nil {
+			s.resources = make(map[string]int)
+		}
+		s.resources[resource]++
+	}
+
+	if s.LastSeen == nil || r.Time.After(*s.LastSeen) {
+		t := r.Time
+		s.LastSeen = &t
+	}
+}
+
+// finish 计算错误率、延迟分位数和访问最多的资源
+func (s *usageStats) finish(top int) {
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	s.P50Ms = latencyPercentile(s.latencies, 0.50)
+	s.P95Ms = latencyPercentile(s.latencies, 0.95)
+
+	for resource, count := range s.resources {
+		s.TopResources = append(s.TopResources, usageResourceCount{Resource: resource, Count: count})
+	}
+	sort.Slice(s.TopResources, func(i, j int) bool {
+		if s.TopResources[i].Count != s.TopResources[j].Count {
+			return s.TopResources[i].Count > s.TopResources[j].Count
+		}
+		return s.TopResources[i].Resource < s.TopResources[j].Resource
+	})
+	if len(s.TopResources) > top {
+		s.TopResources = s.TopResources[:top]
+	}
+}
+
+// latencyPercentile 使用最近秩法计算已排序数据的分位数
+func latencyPercentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted))+0.999999) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// configuredClusterNames 返回 ~/.kube-gateway/clusters 下所有带 token 的集群名称。
+// 每个集群目录对应一个 Token，Token 名称即集群名称
+func configuredClusterNames() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("无法获取用户主目录: %w", err)
+	}
+	clustersDir := filepath.Join(home, ".kube-gateway", "clusters")
+	if _, err := os.Stat(clustersDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var names []string
+	err = filepath.WalkDir(clustersDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != clustersDir {
+			if _, err := os.Stat(filepath.Join(path, "token")); err == nil {
+				names = append(names, d.Name())
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("遍历集群目录时出错: %w", err)
+	}
+	return names, nil
+}
+
+// buildUsageReport 汇总审计记录，并与当前配置的集群和别名进行比对找出未使用的集群和 Token
+func buildUsageReport(files []string, filter *auditRecordFilter, configured, aliases []string, top int) (*usageReport, error) {
+	clusters := make(map[string]*usageStats)
+	tokens := make(map[string]*usageStats)
+	report := &usageReport{Since: filter.Since, Until: filter.Until}
+
+	err := scanAuditRecords(files, filter, func(r *auditRecord) {
+		report.Records++
+		if r.Cluster != "" {
+			if clusters[r.Cluster] == nil {
+				clusters[r.Cluster] = &usageStats{Name: r.Cluster}
+			}
+			clusters[r.Cluster].add(r)
+		}
+
+		// 早期的记录没有 token 字段，网关为每个集群签发一个 Token，名称与集群相同
+		token := r.Token
+		if token == "" {
+			token = r.Cluster
+		}
+		if token == "" {
+			token = "(未认证)"
+		}
+		if tokens[token] == nil {
+			tokens[token] = &usageStats{Name: token, User: r.User}
+		}
+		tokens[token].add(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range configured {
+		if clusters[name] == nil {
+			report.UnusedClusters = append(report.UnusedClusters, name)
+		}
+		if tokens[name] == nil {
+			report.UnusedTokens = append(report.UnusedTokens, name)
+		}
+	}
+	for _, name := range aliases {
+		if tokens[name] == nil {
+			report.UnusedTokens = append(report.UnusedTokens, name)
+		}
+	}
+
+	for _, s := range clusters {
+		s.finish(top)
+		report.Clusters = append(report.Clusters, s)
+	}
+	for _, s := range tokens {
+		if s.User == "" {
+			s.User = gatewayUserName(s.Name)
+		}
+		s.finish(top)
+		report.Tokens = append(report.Tokens, s)
+	}
+	byRequests := func(list []*usageStats) func(i, j int) bool {
+		return func(i, j int) bool {
+			if list[i].Requests != list[j].Requests {
+				return list[i].Requests > list[j].Requests
+			}
+			return list[i].Name < list[j].Name
+		}
+	}
+	sort.Slice(report.Clusters, byRequests(report.Clusters))
+	sort.Slice(report.Tokens, byRequests(report.Tokens))
+	sort.Strings(report.UnusedClusters)
+	sort.Strings(report.UnusedTokens)
+	return report, nil
+}
+
+func runReport(cmd *cobra.Command, args []string) {
+	now := time.Now()
+	since, err := parseAuditTime(reportSince, now)
+	if err != nil {
+		log.Fatalf("错误: --since: %v", err)
+	}
+	until, err := parseAuditTime(reportUntil, now)
+	if err != nil {
+		log.Fatalf("错误: --until: %v", err)
+	}
+	if until.IsZero() {
+		until = now
+	}
+
+	files, err := auditLogFiles(defaultAuditLogPath())
+	if err != nil {
+		log.Fatalf("错误: 查找审计日志文件失败: %v", err)
+	}
+	if len(files) == 0 {
+		log.Fatalf("错误: 找不到审计日志文件 %s", defaultAuditLogPath())
+	}
+	configured, err := configuredClusterNames()
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	aliases, err := configuredAliasNames()
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+
+	report, err := buildUsageReport(files, &auditRecordFilter{Since: since, Until: until}, configured, aliases, reportTop)
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+
+	switch reportOutput {
+	case "table":
+		printUsageReportTable(report)
+	case "markdown", "md":
+		printUsageReportMarkdown(report)
+	case "json":
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("错误: 序列化报告失败: %v", err)
+		}
+		fmt.Println(string(data))
+	default:
+		log.Fatalf("错误: 不支持的输出格式 '%s'，可选值为 table、json、markdown", reportOutput)
+	}
+}
+
+// formatUsagePeriod 返回报告覆盖的时间范围
+func formatUsagePeriod(report *usageReport) string {
+	since := "最早的记录"
+	if !report.Since.IsZero() {
+		since = report.Since.Local().Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("%s ~ %s", since, report.Until.Local().Format("2006-01-02 15:04"))
+}
+
+func formatTopResources(resources []usageResourceCount) string {
+	var parts []string
+	for _, r := range resources {
+		parts = append(parts, fmt.Sprintf("%s(%d)", r.Resource, r.Count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatLastSeen(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func printUsageReportTable(report *usageReport) {
+	fmt.Printf("📊 使用报告: %s (共 %d 条审计记录)\n", formatUsagePeriod(report), report.Records)
+
+	printStats := func(title, nameHeader string, list []*usageStats) {
+		fmt.Printf("\n%s\n", title)
+		headerFormat := "%-25s %-10s %-10s %-8s %-8s %-8s %-18s %s\n"
+		fmt.Printf(headerFormat, nameHeader, "请求数", "错误率", "P50", "P95", "写操作", "最后使用", "访问最多的资源")
+		fmt.Printf(headerFormat, strings.Repeat("-", 25), strings.Repeat("-", 10), strings.Repeat("-", 10), strings.Repeat("-", 8),
+			strings.Repeat("-", 8), strings.Repeat("-", 8), strings.Repeat("-", 18), strings.Repeat("-", 30))
+		if len(list) == 0 {
+			fmt.Println("(无)")
+		}
+		for _, s := range list {
+			fmt.Printf(headerFormat, s.Name, fmt.Sprint(s.Requests), fmt.Sprintf("%.1f%%", s.ErrorRate*100),
+				fmt.Sprintf("%dms", s.P50Ms), fmt.Sprintf("%dms", s.P95Ms), fmt.Sprint(s.Writes),
+				formatLastSeen(s.LastSeen), formatTopResources(s.TopResources))
+		}
+	}
+	printStats("按集群统计:", "集群", report.Clusters)
+	printStats("按 Token 统计:", "Token", report.Tokens)
+
+	fmt.Println()
+	if len(report.UnusedClusters) == 0 {
+		fmt.Println("✅ 所有已配置的集群在此期间都有访问。")
+	} else {
+		fmt.Printf("⚠️  此期间没有任何访问的集群: %s\n", strings.Join(report.UnusedClusters, ", "))
+	}
+	if len(report.UnusedTokens) == 0 {
+		fmt.Println("✅ 所有已签发的 Token 在此期间都被使用过。")
+	} else {
+		fmt.Printf("⚠️  此期间从未使用的 Token (可考虑吊销): %s\n", strings.Join(report.UnusedTokens, ", "))
+	}
+}
+
+func printUsageReportMarkdown(report *usageReport) {
+	fmt.Println("# kube-gateway 使用报告")
+	fmt.Println()
+	fmt.Printf("- 统计周期: %s\n", formatUsagePeriod(report))
+	fmt.Printf("- 审计记录数: %d\n", report.Records)
+
+	printStats := func(title, nameHeader string, list []*usageStats, withUser bool) {
+		fmt.Printf("\n## %s\n\n", title)
+		if len(list) == 0 {
+			fmt.Println("(无)")
+			return
+		}
+		if withUser {
+			fmt.Printf("| %s | 用户 | 请求数 | 错误率 | P50 | P95 | 写操作 | 最后使用 | 访问最多的资源 |\n", nameHeader)
+			fmt.Println("|---|---|---:|---:|---:|---:|---:|---|---|")
+		} else {
+			fmt.Printf("| %s | 请求数 | 错误率 | P50 | P95 | 写操作 | 最后使用 | 访问最多的资源 |\n", nameHeader)
+			fmt.Println("|---|---:|---:|---:|---:|---:|---|---|")
+		}
+		for _, s := range list {
+			name := s.Name
+			if withUser {
+				name += " | " + s.User
+			}
+			fmt.Printf("| %s | %d | %.1f%% | %dms | %dms | %d | %s | %s |\n", name, s.Requests, s.ErrorRate*100,
+				s.P50Ms, s.P95Ms, s.Writes, formatLastSeen(s.LastSeen), formatTopResources(s.TopResources))
+		}
+	}
+	printStats("按集群统计", "集群", report.Clusters, false)
+	printStats("按 Token 统计", "Token", report.Tokens, true)
+
+	fmt.Println("\n## 未使用的集群与 Token")
+	fmt.Println()
+	if len(report.UnusedClusters) == 0 && len(report.UnusedTokens) == 0 {
+		fmt.Println("所有已配置的集群和 Token 在此期间都有访问。")
+		return
+	}
+	for _, name := range report.UnusedClusters {
+		fmt.Printf("- 集群 `%s` 没有任何访问\n", name)
+	}
+	for _, name := range report.UnusedTokens {
+		fmt.Printf("- Token `%s` 从未使用，可考虑吊销\n", name)
+	}
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestInfo 描述了一个 K8s API 请求所操作的对象，字段含义与 apiserver 中的 RequestInfo 保持一致
+type RequestInfo struct {
+	IsResourceRequest bool
+	Path              string
+	Verb              string
+	APIPrefix         string
+	APIGroup          string
+	APIVersion        string
+	Namespace         string
+	Resource          string
+	Subresource       string
+	Name              string
+}
+
+// namespaceSubresources 是挂在 namespace 对象自身上的子资源
+var namespaceSubresources = map[string]bool{"status": true, "finalize": true}
+
+// parseRequestInfo 按照 apiserver 的规则将请求路径解析为 RequestInfo
+func parseRequestInfo(req *http.Request) *RequestInfo {
+	info := &RequestInfo{
+		Path: req.URL.Path,
+		Verb: strings.ToLower(req.Method),
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 3 || (parts[0] != "api" && parts[0] != "apis") {
+		// 非资源请求，例如 /api、/apis、/api/v1
+		return info
+	}
+	info.APIPrefix = parts[0]
+	parts = parts[1:]
+
+	if info.APIPrefix == "apis" {
+		info.APIGroup = parts[0]
+		parts = parts[1:]
+	}
+	info.APIVersion = parts[0]
+	parts = parts[1:]
+	if len(parts) == 0 {
+		// 例如 /apis/apps/v1 这样的发现请求
+		return info
+	}
+
+	info.IsResourceRequest = true
+	switch req.Method {
+	case http.MethodPost:
+		info.Verb = "create"
+	case http.MethodGet, http.MethodHead:
+		info.Verb = "get"
+	case http.MethodPut:
+		info.Verb = "update"
+	case http.MethodPatch:
+		info.Verb = "patch"
+	case http.MethodDelete:
+		info.Verb = "delete"
+	default:
+		info.Verb = ""
+	}
+
+	// 兼容旧版的 /watch/ 路径前缀
+	if parts[0] == "watch" {
+		if info.Verb == "get" {
+			info.Verb = "watch"
+		}
+		parts = parts[1:]
+		if len(parts) == 0 {
+			info.IsResourceRequest = false
+			return info
+		}
+	}
+
+	if parts[0] == "namespaces" {
+		if len(parts) > 1 {
+			info.Namespace = parts[1]
+			// namespaces/{name}/status 这类请求的资源仍然是 namespace 本身
+			if len(parts) > 2 && !namespaceSubresources[parts[2]] {
+				parts = parts[2:]
+			}
+		}
+	}
+
+	info.Resource = parts[0]
+	if len(parts) >= 2 {
+		info.Name = parts[1]
+	}
+	if len(parts) >= 3 {
+		info.Subresource = parts[2]
+	}
+
+	if info.Name == "" && info.Verb == "get" {
+		info.Verb = "list"
+	}
+	if info.Name == "" && info.Verb == "delete" {
+		info.Verb = "deletecollection"
+	}
+
+	query := req.URL.Query()
+	if info.Verb == "list" {
+		if watch := query.Get("watch"); watch == "1" || watch == "true" {
+			info.Verb = "watch"
+		}
+	}
+	// 通过 metadata.name 字段选择器访问单个对象时，将其视为该对象的名称
+	if (info.Verb == "list" || info.Verb == "watch") && info.Name == "" {
+		for _, selector := range strings.Split(query.Get("fieldSelector"), ",") {
+			if name, ok := strings.CutPrefix(selector, "metadata.name="); ok {
+				info.Name = name
+			}
+		}
+	}
+
+	return info
+}
+
+// requestInfoFor 返回当前请求的 RequestInfo，同一请求只解析一次
+func requestInfoFor(c *gin.Context) *RequestInfo {
+	if value, exists := c.Get("requestInfo"); exists {
+		if info, ok := value.(*RequestInfo); ok {
+			return info
+		}
+	}
+	info := parseRequestInfo(c.Request)
+	c.Set("requestInfo", info)
+	return info
+}
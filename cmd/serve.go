@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -11,14 +12,15 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -37,10 +39,17 @@ func (t *authHeaderStrippingTransport) RoundTrip(req *http.Request) (*http.Respo
 
 var (
 	proxyMap          map[string]*httputil.ReverseProxy
+	upgradeProxyMap   map[string]*httputil.ReverseProxy
+	endpointPools     map[string]*endpointPool
+	clusterConfigs    map[string]*rest.Config
 	proxyMutex        sync.RWMutex
 	publicAddress     string
 	tokenToClusterMap map[string]string
-	enableAuditLog    bool
+	// tokenNameMap 是 Token 的名称: 集群的 Token 以集群名称命名，别名的 Token 以别名命名
+	tokenNameMap   map[string]string
+	enableAuditLog bool
+	adminAddress   string
+	adminTLS       bool
 )
 
 var serveCmd = &cobra.Command{
@@ -51,7 +60,42 @@ var serveCmd = &cobra.Command{
 
 func init() {
 	serveCmd.Flags().BoolVar(&enableAuditLog, "enable-audit-log", false, "启用 API 请求的审计日志功能")
+	serveCmd.Flags().StringVar(&auditLogFormat, "audit-log-format", auditFormatJSON, "审计日志格式: json (扁平 JSON) 或 k8s-event (audit.k8s.io/v1 Event 对象)")
+	serveCmd.Flags().StringSliceVar(&auditSinks, "audit-sinks", []string{auditSinkFile}, "审计事件的输出，可同时指定多个: file、stdout、webhook、syslog")
+	serveCmd.Flags().IntVar(&auditBufferSize, "audit-buffer-size", 10000, "每个审计输出的缓冲队列长度，队列满时新的事件会被丢弃")
+	serveCmd.Flags().StringVar(&auditWebhookURL, "audit-webhook-url", "", "webhook 审计输出的接收地址")
+	serveCmd.Flags().IntVar(&auditWebhookBatchSize, "audit-webhook-batch-size", 100, "webhook 审计输出每批发送的最大事件数")
+	serveCmd.Flags().DurationVar(&auditWebhookBatchWait, "audit-webhook-batch-wait", time.Second, "webhook 审计输出攒批的最长等待时间")
+	serveCmd.Flags().StringVar(&auditWebhookSpoolDir, "audit-webhook-spool-dir", "", "webhook 发送失败时暂存事件的目录，默认为 ~/.kube-gateway/spool/webhook")
+	serveCmd.Flags().IntVar(&auditWebhookMaxSpoolSize, "audit-webhook-max-spool-batches", 1000, "暂存目录中最多保留的批次数，超出后丢弃新的批次，0 表示不限制")
+	serveCmd.Flags().IntVar(&auditWebhookMaxSpoolMB, "audit-webhook-max-spool-size", 512, "暂存目录中批次的总大小上限 (MB)，超出后丢弃新的批次，0 表示不限制")
+	serveCmd.Flags().StringVar(&auditSyslogAddress, "audit-syslog-address", "", "syslog 审计输出的地址，格式为 udp://host:port 或 tcp://host:port")
+	serveCmd.Flags().StringVar(&auditLogPath, "audit-log-path", "", "审计日志文件路径，默认为 ~/.kube-gateway/logs/audit.log")
+	serveCmd.Flags().IntVar(&auditLogMaxSize, "audit-log-maxsize", 100, "单个审计日志文件的最大大小 (MB)，超出后自动轮转")
+	serveCmd.Flags().IntVar(&auditLogMaxAge, "audit-log-maxage", 30, "轮转后的审计日志最多保留的天数，0 表示不按时间清理")
+	serveCmd.Flags().IntVar(&auditLogMaxBackups, "audit-log-maxbackup", 10, "最多保留的轮转审计日志文件数量，0 表示不限制")
+	serveCmd.Flags().BoolVar(&auditLogCompress, "audit-log-compress", true, "使用 gzip 压缩轮转后的审计日志")
+	serveCmd.Flags().DurationVar(&auditLogRotateInterval, "audit-log-rotate-interval", 0, "按固定时间间隔轮转审计日志 (例如 24h)，0 表示只按大小轮转")
+	serveCmd.Flags().BoolVar(&auditHashChain, "audit-hash-chain", false, "为审计日志文件中的每条记录追加 SHA-256 哈希链，可使用 'audit verify' 校验")
+	serveCmd.Flags().BoolVar(&auditSignChain, "audit-sign", false, "使用 Ed25519 密钥对哈希链签名 (需同时启用 --audit-hash-chain)，密钥会自动生成在证书目录中")
+	serveCmd.Flags().StringVar(&auditPolicyFile, "audit-policy-file", "", "审计策略文件路径 (参照 K8s 审计策略)，未指定时所有请求都按 Metadata 级别记录")
+	serveCmd.Flags().Int64Var(&auditMaxBodyBytes, "audit-max-body-bytes", 64*1024, "审计事件中记录的请求体和响应体的最大字节数，超出时不记录该内容")
+	serveCmd.Flags().BoolVar(&enableSessionRecording, "enable-session-recording", false, "以 asciicast v2 格式录制 kubectl exec/attach 会话的输入和输出")
+	serveCmd.Flags().StringVar(&sessionDir, "session-dir", "", "会话录像的存放目录，默认为 ~/.kube-gateway/sessions")
+	serveCmd.Flags().StringVar(&gatewayConfigFile, "config", "", "网关配置文件 (限速等流量控制)，默认为 ~/.kube-gateway/gateway.yaml，执行 reload 时重新加载")
 	serveCmd.Flags().StringVar(&publicAddress, "public-address", "127.0.0.1", "网关可被外部访问的 IP 地址或域名")
+	serveCmd.Flags().StringVar(&tracingExporter, "tracing-exporter", "none", "链路追踪导出器: none、otlp、stdout 或 file")
+	serveCmd.Flags().StringVar(&tracingOTLPEndpoint, "tracing-otlp-endpoint", "", "OTLP/HTTP 接收端地址 (host:port)，为空时使用 OTEL_EXPORTER_OTLP_ENDPOINT 或 localhost:4318")
+	serveCmd.Flags().BoolVar(&tracingOTLPInsecure, "tracing-otlp-insecure", false, "使用明文 HTTP 连接 OTLP 接收端")
+	serveCmd.Flags().StringVar(&tracingFile, "tracing-file", "", "file 导出器写入 span 的文件路径")
+	serveCmd.Flags().Float64Var(&tracingSampleRatio, "tracing-sample-ratio", 1.0, "没有上游采样决策时的采样比例 (0~1)")
+	serveCmd.Flags().DurationVar(&serverReadHeaderTimeout, "read-header-timeout", 10*time.Second, "读取客户端请求头的超时时间")
+	serveCmd.Flags().DurationVar(&serverReadTimeout, "read-timeout", 5*time.Minute, "读取客户端完整请求 (包括请求体) 的超时时间，0 表示不限制")
+	serveCmd.Flags().DurationVar(&serverIdleTimeout, "idle-timeout", 2*time.Minute, "客户端空闲的 keep-alive 连接的保留时间")
+	serveCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "收到 SIGTERM 后等待处理中的请求结束的最长时间")
+	serveCmd.Flags().StringVar(&adminAddress, "admin-address", "127.0.0.1:8081", "管理端口 (提供 /metrics 等接口) 的监听地址，为空则不启动")
+	serveCmd.Flags().BoolVar(&adminTLS, "admin-tls", false, "管理端口使用与网关相同的 TLS 证书提供 HTTPS 服务。未启用时，只有管理端口绑定到本地回环地址才提供 /audit/stream")
+	serveCmd.Flags().StringVar(&adminTokenFile, "admin-token-file", "", "访问管理端口受保护接口 (例如 /audit/stream) 的 Token 文件，不存在时自动生成，默认为 ~/.kube-gateway/certs/admin-token")
 	rootCmd.AddCommand(serveCmd)
 }
 
@@ -83,16 +127,66 @@ func runServe(cmd *cobra.Command, args []string) {
 	}
 	defer os.Remove(pidFile)
 
+	// 初始化链路追踪，需在构建代理之前完成
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("初始化链路追踪失败: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// 加载网关配置
+	if err := reloadGatewayConfig(); err != nil {
+		log.Fatalf("初始化加载网关配置失败: %v", err)
+	}
+
 	// 初始化加载代理配置
 	if err := loadConfigAndProxies(); err != nil {
 		log.Fatalf("初始化加载配置失败: %v", err)
 	}
+	reconcileResourceCaches()
 
 	// 启动信号监听器以支持热加载
 	go handleSignals()
 
+	// 在独立的管理端口上暴露 Prometheus 指标和审计事件的实时推送
+	if adminAddress != "" {
+		if adminTokenFile == "" {
+			adminTokenFile = filepath.Join(certsDir, "admin-token")
+		}
+		if adminToken, err = ensureAdminToken(adminTokenFile); err != nil {
+			log.Fatalf("错误: %v", err)
+		}
+		adminServer := &http.Server{
+			Addr:              adminAddress,
+			Handler:           newAdminHandler(),
+			ReadHeaderTimeout: serverReadHeaderTimeout,
+		}
+		go func() {
+			var err error
+			if adminTLS {
+				log.Printf("正在启动管理端口 HTTPS 服务器于 %s", adminAddress)
+				err = adminServer.ListenAndServeTLS(certPath, keyPath)
+			} else {
+				log.Printf("正在启动管理端口 HTTP 服务器于 %s", adminAddress)
+				err = adminServer.ListenAndServe()
+			}
+			if err != nil {
+				log.Fatalf("启动管理端口服务失败: %v", err)
+			}
+		}()
+	}
+
 	gin.SetMode(gin.ReleaseMode)
+	// 审计事件输出到标准输出时，将 gin 的访问日志改到标准错误，避免两者混在一起
+	if enableAuditLog && slices.Contains(auditSinks, auditSinkStdout) {
+		gin.DefaultWriter = os.Stderr
+	}
 	router := gin.Default()
+	router.Use(MetricsMiddleware())
+	if tracingExporter != "" && tracingExporter != "none" {
+		log.Printf("链路追踪已启用，导出器: %s", tracingExporter)
+		router.Use(TracingMiddleware())
+	}
 
 	if enableAuditLog {
 		log.Println("审计日志功能已启用。")
@@ -100,14 +194,47 @@ func runServe(cmd *cobra.Command, args []string) {
 	}
 
 	//router.Any("/*proxyPath", handleRequestWithGin)
+	// /api 和 /apis 是发现文档的入口，单独注册以免被重定向到 /api/ 和 /apis/
+	router.GET("/api", handleRequestWithGin)
+	router.GET("/apis", handleRequestWithGin)
 	router.Any("/api/*proxyPath", handleRequestWithGin)
 	router.Any("/apis/*proxyPath", handleRequestWithGin)
+	router.Any("/openapi/*proxyPath", handleRequestWithGin)
+	router.GET("/version", handleRequestWithGin)
+	router.NoRoute(handleUnknownPath)
 
 	listenAddr := "0.0.0.0:8443"
+	// ReadHeaderTimeout 和 ReadTimeout 防止慢速客户端 (slowloris) 长期占用连接。
+	// 不设置 WriteTimeout，否则会截断 watch 等长连接；协议升级后的连接不受这些超时影响
+	server := &http.Server{
+		Addr:              listenAddr,
+		Handler:           router.Handler(),
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+	go handleShutdownSignals(server)
+
 	log.Printf("正在启动 kube-gateway HTTPS 服务器于 %s (PID: %d)", listenAddr, pid)
-	if err := router.RunTLS(listenAddr, certPath, keyPath); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if err := server.ListenAndServeTLS(certPath, keyPath); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("启动 HTTPS 服务失败: %v", err)
 	}
+	log.Println("kube-gateway 已停止。")
+}
+
+// handleShutdownSignals 在收到 SIGTERM 或 SIGINT 时停止接受新连接，并等待处理中的请求结束，
+// 超过 shutdownTimeout 后强制关闭。之后 runServe 返回，链路追踪等资源得以正常刷新和关闭
+func handleShutdownSignals(server *http.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-c
+	log.Printf("收到 %s 信号，正在停止服务 (最多等待 %s)...", sig, shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("等待请求结束超时，强制关闭剩余连接: %v", err)
+		server.Close()
+	}
 }
 
 func loadConfigAndProxies() error {
@@ -121,15 +248,27 @@ func loadConfigAndProxies() error {
 	if _, err := os.Stat(clustersDir); os.IsNotExist(err) {
 		log.Printf("集群目录 %s 不存在。没有加载任何集群。", clustersDir)
 		proxyMutex.Lock()
+		oldPools := endpointPools
 		proxyMap = make(map[string]*httputil.ReverseProxy)
+		upgradeProxyMap = make(map[string]*httputil.ReverseProxy)
+		endpointPools = make(map[string]*endpointPool)
+		clusterConfigs = make(map[string]*rest.Config)
 		tokenToClusterMap = make(map[string]string)
+		tokenNameMap = make(map[string]string)
 		proxyMutex.Unlock()
+		stopEndpointPools(oldPools, nil)
+		clustersLoaded.Set(0)
+		clusterAliasInfo.Reset()
 		return nil
 	}
 
 	newProxyMap := make(map[string]*httputil.ReverseProxy)
+	newUpgradeProxyMap := make(map[string]*httputil.ReverseProxy)
+	newEndpointPools := make(map[string]*endpointPool)
+	newClusterConfigs := make(map[string]*rest.Config)
 
 	newTokenToClusterMap := make(map[string]string)
+	newTokenNameMap := make(map[string]string)
 
 	err = filepath.WalkDir(clustersDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -159,120 +298,305 @@ func loadConfigAndProxies() error {
 				return nil
 			}
 
-			targetUrl, err := url.Parse(restConfig.Host)
+			extraEndpoints, err := readClusterEndpoints(filepath.Join(path, "endpoints"))
+			if err != nil {
+				log.Printf("警告: 无法读取集群 %s 的 endpoints 文件: %v. 已跳过.", clusterName, err)
+				return nil
+			}
+			endpointURLs, err := clusterEndpointURLs(restConfig.Host, extraEndpoints)
 			if err != nil {
 				log.Printf("警告: 无法解析集群 %s 的目标 URL: %v. 已跳过.", clusterName, err)
 				return nil
 			}
+			targetUrl := endpointURLs[0]
 
-			proxy := httputil.NewSingleHostReverseProxy(targetUrl)
-			proxy.Transport = &authHeaderStrippingTransport{underlyingTransport: backendTransport}
+			// exec、attach、port-forward 需要切换协议，而 SPDY 无法在 HTTP/2 连接上升级，
+			// 因此为这类请求单独创建一个只使用 HTTP/1.1 的 transport
+			upgradeConfig := rest.CopyConfig(restConfig)
+			upgradeConfig.TLSClientConfig.NextProtos = []string{"http/1.1"}
+			upgradeTransport, err := rest.TransportFor(upgradeConfig)
+			if err != nil {
+				log.Printf("警告: 无法为集群 %s 创建 transport: %v. 已跳过.", clusterName, err)
+				return nil
+			}
+
+			// 配置了多个 API Server 地址时，在健康的地址之间转发并在连接失败时切换
+			var pool *endpointPool
+			if len(endpointURLs) > 1 {
+				pool = newEndpointPool(clusterName, endpointURLs)
+				pool.startHealthChecks(backendTransport)
+				newEndpointPools[clusterName] = pool
+			}
 
-			newProxyMap[token] = proxy
+			newProxyMap[token] = newClusterProxy(clusterName, targetUrl, backendTransport, pool)
+			newUpgradeProxyMap[token] = newClusterProxy(clusterName, targetUrl, upgradeTransport, pool)
 			newTokenToClusterMap[token] = clusterName
+			newTokenNameMap[token] = clusterName
+			newClusterConfigs[clusterName] = restConfig
 			return filepath.SkipDir
 		}
 		return nil
 	})
 
 	if err != nil {
+		stopEndpointPools(newEndpointPools, endpointPools)
 		return fmt.Errorf("遍历集群目录时出错: %w", err)
 	}
 
+	// 别名的 Token 使用其指向的集群的代理，执行 reload 时与集群配置一起整体替换，切换是原子的
+	clusterCount := len(newProxyMap)
+	clusterTokens := make(map[string]string)
+	for token, clusterName := range newTokenToClusterMap {
+		clusterTokens[clusterName] = token
+	}
+	var aliases []clusterAlias
+	if dir, err := aliasesDir(); err == nil {
+		all, err := readClusterAliases(dir)
+		if err != nil {
+			log.Printf("警告: 读取别名目录时出错: %v", err)
+		}
+		aliases = resolveClusterAliases(all, clusterTokens)
+		for _, alias := range aliases {
+			clusterToken := clusterTokens[alias.target]
+			newProxyMap[alias.token] = newProxyMap[clusterToken]
+			newUpgradeProxyMap[alias.token] = newUpgradeProxyMap[clusterToken]
+			newTokenToClusterMap[alias.token] = alias.target
+			newTokenNameMap[alias.token] = alias.name
+		}
+	}
+
 	proxyMutex.Lock()
+	oldPools := endpointPools
 	proxyMap = newProxyMap
+	upgradeProxyMap = newUpgradeProxyMap
+	endpointPools = newEndpointPools
+	clusterConfigs = newClusterConfigs
 	tokenToClusterMap = newTokenToClusterMap
+	tokenNameMap = newTokenNameMap
 	proxyMutex.Unlock()
+	stopEndpointPools(oldPools, newEndpointPools)
+	clustersLoaded.Set(float64(clusterCount))
+	setClusterAliasInfo(aliases)
 
-	log.Printf("配置加载完毕。当前有 %d 个集群代理处于活动状态。", len(newProxyMap))
+	log.Printf("配置加载完毕。当前有 %d 个集群代理处于活动状态。", clusterCount)
 	return nil
 }
 
-func AuditLogMiddleware() gin.HandlerFunc {
-	// 初始化 logrus
-	auditLogger := logrus.New()
-	auditLogger.SetFormatter(&logrus.JSONFormatter{}) // 设置输出为 JSON 格式
-
-	// 设置日志文件
-	home, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("错误: 无法获取用户主目录以设置审计日志: %v", err)
-	}
-	logDir := filepath.Join(home, ".kube-gateway", "logs")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		log.Fatalf("错误: 无法创建审计日志目录 %s: %v", logDir, err)
-	}
-	logFile := filepath.Join(logDir, "audit.log")
-	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err == nil {
-		auditLogger.SetOutput(file)
-	} else {
-		log.Println("无法打开审计日志文件，日志将输出到标准错误。")
-	}
-
-	return func(c *gin.Context) {
-		startTime := time.Now()
-
-		// 先执行请求处理
-		c.Next()
-
-		// 请求处理完成后记录日志
-		latency := time.Since(startTime)
-		proxyMutex.RLock()
-		proxyMutex.RUnlock()
-
-		// 只记录通过代理的 K8s API 请求
-		if strings.HasPrefix(c.Request.URL.Path, "/api") || strings.HasPrefix(c.Request.URL.Path, "/apis") {
-			var clusterName string
-			if value, exists := c.Get("targetCluster"); exists {
-				if name, ok := value.(string); ok {
-					clusterName = name
-				}
-			}
-
-			entry := auditLogger.WithFields(logrus.Fields{
-				"timestamp":   startTime.Format(time.RFC3339),
-				"source_ip":   c.ClientIP(),
-				"method":      c.Request.Method,
-				"path":        c.Request.URL.Path,
-				"status_code": c.Writer.Status(),
-				"latency_ms":  latency.Milliseconds(),
-				"cluster":     clusterName,
-			})
-			entry.Info("API request processed")
+// newClusterProxy 创建转发到指定集群的反向代理，pool 不为空时在集群的多个 API Server 地址之间转发
+func newClusterProxy(clusterName string, targetUrl *url.URL, backendTransport http.RoundTripper, pool *endpointPool) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(targetUrl)
+	transport := newTracingTransport(clusterName, backendTransport)
+	if pool != nil {
+		transport = &endpointFailoverTransport{pool: pool, underlyingTransport: transport}
+	}
+	transport = &responseHeaderTimeoutTransport{underlyingTransport: transport}
+	proxy.Transport = &authHeaderStrippingTransport{underlyingTransport: &circuitBreakerTransport{underlyingTransport: transport}}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, errRequestBodyTooLarge) {
+			writeStatus(w, newGatewayStatus(http.StatusRequestEntityTooLarge, metav1.StatusReasonRequestEntityTooLarge, "请求体过大: "+err.Error()))
+			return
 		}
+		errorType := classifyBackendError(err)
+		backendErrorsTotal.WithLabelValues(clusterName, errorType).Inc()
+		log.Printf("代理请求到集群 %s 失败 (%s): %v", clusterName, errorType, err)
+		if errorType != "canceled" && serveStaleRead(w, staleReadFromContext(r.Context())) {
+			return
+		}
+		writeStatus(w, backendErrorStatus(clusterName, errorType))
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		recordStaleRead(resp)
+		return nil
 	}
+	return proxy
 }
 
 func handleSignals() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
-	for {
-		<-c
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range c {
+		// SIGUSR1 用于配合外部的 logrotate 重新打开审计日志文件
+		if sig == syscall.SIGUSR1 {
+			log.Println("收到 SIGUSR1 信号，重新打开审计日志文件...")
+			reopenAuditLog()
+			continue
+		}
 		log.Println("收到 SIGHUP 信号，尝试重新加载配置...")
-		if err := loadConfigAndProxies(); err != nil {
+		err := loadConfigAndProxies()
+		if err == nil {
+			err = reloadGatewayConfig()
+		}
+		if err == nil && enableAuditLog {
+			err = reloadAuditPolicy()
+		}
+		// 集群的后端或 CRD 可能已经变化，丢弃缓存的发现文档
+		discoveryCache.purge()
+		reconcileResourceCaches()
+		staleReads.prune()
+		recordReload(err)
+		if err != nil {
 			log.Printf("错误: 重载配置失败: %v", err)
 		}
 	}
 }
 
+// reconcileResourceCaches 按当前的集群和网关配置调整读缓存的 informer 和共享的上游 watch
+func reconcileResourceCaches() {
+	proxyMutex.RLock()
+	configs := clusterConfigs
+	proxyMutex.RUnlock()
+	readCaches.reconcile(configs)
+	watchCaches.reconcile(configs)
+}
+
+// clusterForRequest 根据请求携带的 Token 找到目标集群，Token 无效时返回空字符串
+func clusterForRequest(req *http.Request) string {
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	proxyMutex.RLock()
+	defer proxyMutex.RUnlock()
+	return tokenToClusterMap[token]
+}
+
+// handleUnknownPath 以 Status 的形式拒绝网关不转发的路径
+func handleUnknownPath(c *gin.Context) {
+	message := fmt.Sprintf("路径 %s 不存在: 网关只转发 /api、/apis、/openapi 和 /version 请求", c.Request.URL.Path)
+	writeStatus(c.Writer, newGatewayStatus(http.StatusNotFound, metav1.StatusReasonNotFound, message))
+}
+
 func handleRequestWithGin(c *gin.Context) {
 	authHeader := c.Request.Header.Get("Authorization")
 	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		c.String(http.StatusUnauthorized, "未授权: 缺少 Bearer Token")
+		writeStatus(c.Writer, newGatewayStatus(http.StatusUnauthorized, metav1.StatusReasonUnauthorized, "未授权: 缺少 Bearer Token"))
 		return
 	}
 	token := strings.TrimPrefix(authHeader, "Bearer ")
+	upgrade := isUpgradeRequest(c.Request)
 	proxyMutex.RLock()
 	proxy, found := proxyMap[token]
+	if upgrade {
+		proxy = upgradeProxyMap[token]
+	}
 	clusterName, _ := tokenToClusterMap[token]
+	tokenName := tokenNameMap[token]
 	proxyMutex.RUnlock()
 	if !found {
-		c.String(http.StatusUnauthorized, "未授权: 无效的 Token")
+		writeStatus(c.Writer, newGatewayStatus(http.StatusUnauthorized, metav1.StatusReasonUnauthorized, "未授权: 无效的 Token"))
 		return
 	}
 
 	c.Set("targetCluster", clusterName)
+	// 每个 Token 都是为某个集群或别名签发的，以其名称作为 Token 的名称，避免在日志和指标中暴露 Token 本身
+	c.Set("tokenName", tokenName)
+
+	info := requestInfoFor(c)
+	if rejection := checkBodyLimit(c.Request, clusterName, tokenName, info); rejection != nil {
+		writeStatus(c.Writer, newGatewayStatus(http.StatusRequestEntityTooLarge, metav1.StatusReasonRequestEntityTooLarge, rejection.message(clusterName)))
+		return
+	}
+	if rejection := checkRateLimit(clusterName, tokenName, isWriteVerb(info.Verb)); rejection != nil {
+		status := newGatewayStatus(http.StatusTooManyRequests, metav1.StatusReasonTooManyRequests, rejection.message(clusterName, tokenName))
+		writeStatus(c.Writer, withRetryAfter(status, rejection.retryAfterSeconds()))
+		return
+	}
+
+	longRunning := longRunningKind(c.Request, info)
+	release, rejection := acquireConcurrency(c.Request.Context(), clusterName, tokenName, longRunning != "")
+	if rejection != nil {
+		status := newGatewayStatus(http.StatusTooManyRequests, metav1.StatusReasonTooManyRequests, rejection.message(clusterName, tokenName))
+		writeStatus(c.Writer, withRetryAfter(status, 1))
+		return
+	}
+	defer release()
+
+	switch longRunning {
+	case "":
+		inflightRequests.WithLabelValues(clusterName).Inc()
+		defer inflightRequests.WithLabelValues(clusterName).Dec()
+	case "watch":
+		activeWatches.WithLabelValues(clusterName).Inc()
+		defer activeWatches.WithLabelValues(clusterName).Dec()
+		fallthrough
+	default:
+		longRunningRequests.WithLabelValues(clusterName, longRunning).Inc()
+		defer longRunningRequests.WithLabelValues(clusterName, longRunning).Dec()
+	}
 
-	proxy.ServeHTTP(c.Writer, c.Request)
+	// 按比例把读请求复制一份发往影子集群，在主请求完成后异步进行
+	if mirror := mirrorFor(c.Request, clusterName, info, longRunning); mirror != nil {
+		defer mirror.start(c.Writer)
+	}
+
+	// 发现文档和 OpenAPI 文档命中缓存时不访问后端
+	discoveryTTL := time.Duration(0)
+	if !upgrade && isDiscoveryRequest(c.Request) {
+		discoveryTTL = gatewayConfigSnapshot().DiscoveryCache.ttlFor(clusterName)
+	}
+	if discoveryTTL > 0 && serveCachedDiscovery(c.Writer, c.Request, clusterName, discoveryTTL) {
+		return
+	}
+	// 配置了读缓存的资源由 informer 直接返回 GET/LIST
+	if !upgrade && serveFromReadCache(c.Writer, c.Request, clusterName, info) {
+		return
+	}
+	// 配置了共享 watch 的资源由同一个上游 watch 向所有客户端分发事件
+	if !upgrade && serveFromWatchCache(c.Writer, c.Request, clusterName, info) {
+		return
+	}
+
+	// 无法访问后端时，允许使用旧数据的读请求返回最近一次的成功响应
+	read := staleReadFor(c.Request, clusterName, info)
+	// 后端持续无法连接时直接返回 503，不再等待连接超时
+	ctx, call, circuitRejection := allowCircuit(withStaleRead(c.Request.Context(), read), clusterName, tokenName)
+	if circuitRejection != nil {
+		if serveStaleRead(c.Writer, read) {
+			return
+		}
+		status := newGatewayStatus(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, circuitRejection.message(clusterName))
+		writeStatus(c.Writer, withRetryAfter(status, circuitRejection.retryAfterSeconds()))
+		return
+	}
+	defer call.done()
+
+	timeouts := gatewayConfigSnapshot().Timeouts.settingsFor(clusterName)
+	switch longRunning {
+	case "":
+		// 后端在超时时间内没有返回响应头时返回 504，避免挂起的后端一直占用客户端连接；
+		// 之后的响应体不受限制，较大的 LIST 和日志不会中途被截断
+		ctx = withResponseHeaderTimeout(ctx, timeouts.Request.Duration)
+	case "watch":
+		limitWatchDuration(c.Request, timeouts.WatchMaxDuration.Duration)
+	}
+	c.Request = c.Request.WithContext(ctx)
+
+	if discoveryTTL > 0 {
+		fetchDiscovery(proxy, c.Writer, c.Request, clusterName, discoveryTTL)
+		return
+	}
+	if !upgrade {
+		// 相同的并发 GET 请求只转发一次，共用后端的响应
+		if longRunning == "" && gatewayConfigSnapshot().Coalescing.enabledFor(clusterName) {
+			if key := coalescingKey(c.Request, clusterName); key != "" {
+				serveCoalesced(proxy, c.Writer, c.Request, clusterName, key)
+				return
+			}
+		}
+		proxy.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	writer := &sessionRecordingWriter{ResponseWriter: c.Writer, request: c.Request, idleTimeout: timeouts.StreamIdleTimeout.Duration}
+	if shouldRecordSession(info) {
+		writer.recorder = newSessionRecorder(c, info)
+	}
+	c.Writer = writer
+	// 协议切换成功后 ServeHTTP 会一直阻塞到会话结束
+	proxy.ServeHTTP(writer, c.Request)
+	if writer.recorder != nil && writer.hijacked {
+		writer.recorder.close()
+		c.Set("sessionID", writer.recorder.id())
+		log.Printf("会话 %s 已结束，录像已保存到 %s", writer.recorder.id(), writer.recorder.path)
+	}
 }
@@ -0,0 +1,586 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	enableSessionRecording bool
+	sessionDir             string
+)
+
+// asciicast v2 的事件类型。stderr 没有对应的标准类型，使用扩展类型 "e" 记录，
+// asciinema 等播放器会忽略它，'session play' 会将其输出到标准错误
+const (
+	sessionEventOutput = "o"
+	sessionEventError  = "e"
+	sessionEventInput  = "i"
+	sessionEventResize = "r"
+)
+
+// remotecommand 协议中各个流的编号，与 WebSocket 协议中的 channel 编号一致
+const (
+	sessionStreamStdin  = 0
+	sessionStreamStdout = 1
+	sessionStreamStderr = 2
+	sessionStreamError  = 3
+	sessionStreamResize = 4
+)
+
+// sessionMetadata 是网关附加在 asciicast 文件头中的会话信息
+type sessionMetadata struct {
+	SessionID   string    `json:"session_id"`
+	Cluster     string    `json:"cluster"`
+	User        string    `json:"user"`
+	Token       string    `json:"token"`
+	SourceIP    string    `json:"source_ip"`
+	Subresource string    `json:"subresource"`
+	Namespace   string    `json:"namespace"`
+	Pod         string    `json:"pod"`
+	Container   string    `json:"container,omitempty"`
+	Command     []string  `json:"command,omitempty"`
+	TTY         bool      `json:"tty"`
+	Protocol    string    `json:"protocol"`
+	StartTime   time.Time `json:"start_time"`
+}
+
+// asciicastHeader 是 asciicast v2 文件的第一行
+type asciicastHeader struct {
+	Version     int               `json:"version"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Timestamp   int64             `json:"timestamp"`
+	Command     string            `json:"command,omitempty"`
+	Title       string            `json:"title,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	KubeGateway *sessionMetadata  `json:"kube_gateway,omitempty"`
+}
+
+// defaultSessionDir 返回会话录像的存放目录
+func defaultSessionDir() (string, error) {
+	if sessionDir != "" {
+		return sessionDir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("无法获取用户主目录: %w", err)
+	}
+	return filepath.Join(home, ".kube-gateway", "sessions"), nil
+}
+
+// isUpgradeRequest 判断请求是否要求切换协议 (exec、attach、port-forward 使用 SPDY 或 WebSocket)
+func isUpgradeRequest(req *http.Request) bool {
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return req.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
+// shouldRecordSession 判断是否需要为该请求录制会话，只录制 pods 的 exec 和 attach
+func shouldRecordSession(info *RequestInfo) bool {
+	return enableSessionRecording && info.Resource == "pods" && (info.Subresource == "exec" || info.Subresource == "attach")
+}
+
+// sessionRecorder 将一次 exec/attach 会话的输入输出以 asciicast v2 格式写入文件
+type sessionRecorder struct {
+	mu       sync.Mutex
+	file     *os.File
+	path     string
+	start    time.Time
+	header   asciicastHeader
+	started  bool
+	failed   bool
+	pending  map[string][]byte
+	streamOf func(channel int) string
+}
+
+// newSessionRecorder 根据请求准备录像的元数据，文件在协议切换成功后才会创建
+func newSessionRecorder(c *gin.Context, info *RequestInfo) *sessionRecorder {
+	query := c.Request.URL.Query()
+	tokenName := c.GetString("tokenName")
+	meta := &sessionMetadata{
+		SessionID:   uuid.New().String(),
+		Cluster:     c.GetString("targetCluster"),
+		User:        gatewayUserName(tokenName),
+		Token:       tokenName,
+		SourceIP:    c.ClientIP(),
+		Subresource: info.Subresource,
+		Namespace:   info.Namespace,
+		Pod:         info.Name,
+		Container:   query.Get("container"),
+		Command:     query["command"],
+		TTY:         query.Get("tty") == "true" || query.Get("tty") == "1",
+		Protocol:    c.Request.Header.Get("Upgrade"),
+	}
+	title := fmt.Sprintf("kubectl %s %s/%s", info.Subresource, info.Namespace, info.Name)
+	if meta.Container != "" {
+		title += " -c " + meta.Container
+	}
+	return &sessionRecorder{
+		header: asciicastHeader{
+			Version:     2,
+			Width:       80,
+			Height:      24,
+			Command:     strings.Join(meta.Command, " "),
+			Title:       title + " (" + meta.Cluster + ")",
+			Env:         map[string]string{"TERM": "xterm-256color"},
+			KubeGateway: meta,
+		},
+		pending: make(map[string][]byte),
+	}
+}
+
+// id 返回会话 ID，也是录像文件的名称
+func (r *sessionRecorder) id() string {
+	return r.header.KubeGateway.SessionID
+}
+
+// open 在协议切换成功时创建录像文件
+func (r *sessionRecorder) open() error {
+	dir, err := defaultSessionDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("无法创建会话录像目录 %s: %w", dir, err)
+	}
+	r.path = filepath.Join(dir, r.id()+".cast")
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("无法创建会话录像文件 %s: %w", r.path, err)
+	}
+	r.file = file
+	r.start = time.Now()
+	r.header.Timestamp = r.start.Unix()
+	r.header.KubeGateway.StartTime = r.start
+	return nil
+}
+
+// record 写入一个事件。文件头会推迟到第一个非 resize 事件时写入，
+// 这样可以使用客户端发送的初始终端大小
+func (r *sessionRecorder) record(kind string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil || r.failed {
+		return
+	}
+	elapsed := time.Since(r.start).Seconds()
+
+	var text string
+	if kind == sessionEventResize {
+		text = string(data)
+		if !r.started {
+			var width, height int
+			if _, err := fmt.Sscanf(text, "%dx%d", &width, &height); err == nil {
+				r.header.Width, r.header.Height = width, height
+			}
+			return
+		}
+	} else {
+		// 多字节字符可能被拆分在两个帧中，将不完整的尾部留到下一次输出
+		data = append(r.pending[kind], data...)
+		cut := incompleteUTF8Suffix(data)
+		r.pending[kind] = append([]byte(nil), data[len(data)-cut:]...)
+		data = data[:len(data)-cut]
+		if len(data) == 0 {
+			return
+		}
+		text = string(data)
+	}
+
+	var buf bytes.Buffer
+	if !r.started {
+		header, err := json.Marshal(r.header)
+		if err != nil {
+			r.fail(err)
+			return
+		}
+		buf.Write(header)
+		buf.WriteByte('\n')
+		r.started = true
+	}
+	event, err := json.Marshal([]interface{}{json.Number(fmt.Sprintf("%.6f", elapsed)), kind, text})
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	buf.Write(event)
+	buf.WriteByte('\n')
+	if _, err := r.file.Write(buf.Bytes()); err != nil {
+		r.fail(err)
+	}
+}
+
+func (r *sessionRecorder) fail(err error) {
+	r.failed = true
+	log.Printf("错误: 写入会话录像 %s 失败，停止录制: %v", r.path, err)
+}
+
+// close 写入剩余的内容并关闭录像文件
+func (r *sessionRecorder) close() {
+	r.mu.Lock()
+	if r.file != nil && !r.started && !r.failed {
+		// 会话中没有任何输入输出，也保留一个只有文件头的录像
+		if header, err := json.Marshal(r.header); err == nil {
+			r.file.Write(append(header, '\n'))
+			r.started = true
+		}
+	}
+	r.mu.Unlock()
+
+	for _, kind := range []string{sessionEventInput, sessionEventOutput, sessionEventError} {
+		r.mu.Lock()
+		rest := r.pending[kind]
+		r.pending[kind] = nil
+		r.mu.Unlock()
+		if len(rest) > 0 {
+			r.record(kind, bytes.ToValidUTF8(rest, []byte("�")))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// recordStream 按流的编号写入事件，error 流中只有命令的退出状态，不记录
+func (r *sessionRecorder) recordStream(channel int, data []byte) {
+	switch channel {
+	case sessionStreamStdin:
+		r.record(sessionEventInput, data)
+	case sessionStreamStdout:
+		r.record(sessionEventOutput, data)
+	case sessionStreamStderr:
+		r.record(sessionEventError, data)
+	case sessionStreamResize:
+		// resize 流中是一个或多个 {"Width":80,"Height":24} 对象
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var size struct{ Width, Height uint16 }
+			if err := decoder.Decode(&size); err != nil {
+				return
+			}
+			r.record(sessionEventResize, []byte(fmt.Sprintf("%dx%d", size.Width, size.Height)))
+		}
+	}
+}
+
+// incompleteUTF8Suffix 返回 data 末尾不完整的 UTF-8 字符的字节数
+func incompleteUTF8Suffix(data []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(data); i++ {
+		b := data[len(data)-i]
+		if b < utf8.RuneSelf {
+			return 0
+		}
+		if utf8.RuneStart(b) {
+			if utf8.FullRune(data[len(data)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// sessionRecordingWriter 包装 gin 的 ResponseWriter，在代理接管连接时插入录制逻辑。
+// recorder 为 nil 时只记录连接已被接管，使指标和审计日志中的状态码为 101
+type sessionRecordingWriter struct {
+	gin.ResponseWriter
+	request  *http.Request
+	recorder *sessionRecorder
+	hijacked bool
+	// idleTimeout 大于 0 时，会话双向都没有数据超过该时间后断开连接
+	idleTimeout time.Duration
+}
+
+func (w *sessionRecordingWriter) Status() int {
+	if w.hijacked {
+		return http.StatusSwitchingProtocols
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *sessionRecordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.hijack()
+	if err != nil || w.idleTimeout <= 0 {
+		return conn, brw, err
+	}
+	return newIdleTimeoutConn(conn, w.idleTimeout, func() {
+		log.Printf("%s 会话空闲超过 %s，已断开连接", w.request.URL.Path, w.idleTimeout)
+	}), brw, nil
+}
+
+func (w *sessionRecordingWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.recorder == nil {
+		conn, brw, err := w.ResponseWriter.Hijack()
+		w.hijacked = err == nil
+		return conn, brw, err
+	}
+	// 无法录制时拒绝建立会话，避免出现没有录像的生产环境操作
+	if err := w.recorder.open(); err != nil {
+		return nil, nil, err
+	}
+	conn, brw, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		w.recorder.close()
+		os.Remove(w.recorder.path)
+		return nil, nil, err
+	}
+	w.hijacked = true
+
+	// ReverseProxy 会先通过 brw 写入 101 响应头，之后的数据才经过 conn，此时响应头已经可用
+	recordingConn := &sessionRecordingConn{Conn: conn}
+	header := w.ResponseWriter.Header()
+	if strings.EqualFold(w.request.Header.Get("Upgrade"), "websocket") {
+		recordingConn.fromClient = &webSocketStreamParser{masked: true, recorder: w.recorder, header: header}
+		recordingConn.toClient = &webSocketStreamParser{recorder: w.recorder, header: header}
+	} else {
+		streams := newSPDYStreamTypes()
+		recordingConn.fromClient = &spdyStreamParser{recorder: w.recorder, streams: streams, fromClient: true}
+		recordingConn.toClient = &spdyStreamParser{recorder: w.recorder, streams: streams}
+	}
+	return recordingConn, brw, nil
+}
+
+// sessionRecordingConn 将经过连接的数据同时交给两个方向的协议解析器
+type sessionRecordingConn struct {
+	net.Conn
+	fromClient sessionStreamParser
+	toClient   sessionStreamParser
+}
+
+func (c *sessionRecordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.fromClient.feed(p[:n])
+	}
+	return n, err
+}
+
+func (c *sessionRecordingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.toClient.feed(p[:n])
+	}
+	return n, err
+}
+
+// sessionStreamParser 从连接的字节流中解析出各个流的数据
+type sessionStreamParser interface {
+	feed(p []byte)
+}
+
+// webSocketStreamParser 解析 channel.k8s.io 系列协议的 WebSocket 帧。
+// 每条消息的第一个字节是流的编号，base64 变体使用文本帧并对数据进行 base64 编码
+type webSocketStreamParser struct {
+	masked   bool
+	recorder *sessionRecorder
+	header   http.Header
+	buf      []byte
+	channel  int
+	text     bool
+	broken   bool
+}
+
+func (p *webSocketStreamParser) feed(data []byte) {
+	if p.broken {
+		return
+	}
+	p.buf = append(p.buf, data...)
+	for {
+		consumed, ok := p.next()
+		if !ok {
+			return
+		}
+		p.buf = p.buf[consumed:]
+	}
+}
+
+// next 解析一个完整的帧，数据不足时返回 false
+func (p *webSocketStreamParser) next() (int, bool) {
+	if len(p.buf) < 2 {
+		return 0, false
+	}
+	opcode := p.buf[0] & 0x0f
+	masked := p.buf[1]&0x80 != 0
+	length := uint64(p.buf[1] & 0x7f)
+	offset := 2
+	switch length {
+	case 126:
+		if len(p.buf) < offset+2 {
+			return 0, false
+		}
+		length = uint64(binary.BigEndian.Uint16(p.buf[offset:]))
+		offset += 2
+	case 127:
+		if len(p.buf) < offset+8 {
+			return 0, false
+		}
+		length = binary.BigEndian.Uint64(p.buf[offset:])
+		offset += 8
+	}
+	var mask []byte
+	if masked {
+		if len(p.buf) < offset+4 {
+			return 0, false
+		}
+		mask = p.buf[offset : offset+4]
+		offset += 4
+	}
+	if masked != p.masked || length > 64*1024*1024 {
+		// 不符合协议的数据，停止解析但不影响会话本身
+		p.broken = true
+		log.Printf("警告: 无法解析会话 %s 的 WebSocket 帧，后续内容不再录制", p.recorder.id())
+		return 0, false
+	}
+	if uint64(len(p.buf)-offset) < length {
+		return 0, false
+	}
+	end := offset + int(length)
+	payload := make([]byte, length)
+	copy(payload, p.buf[offset:end])
+	for i := range payload {
+		if mask != nil {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	switch opcode {
+	case 0x1, 0x2:
+		// 新消息的第一个字节是流的编号
+		if len(payload) == 0 {
+			return end, true
+		}
+		p.text = opcode == 0x1
+		if p.text {
+			p.channel = int(payload[0] - '0')
+		} else {
+			p.channel = int(payload[0])
+		}
+		p.emit(payload[1:])
+	case 0x0:
+		p.emit(payload)
+	}
+	return end, true
+}
+
+func (p *webSocketStreamParser) emit(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if p.text && strings.HasPrefix(p.header.Get("Sec-WebSocket-Protocol"), "base64.") {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return
+		}
+		data = decoded
+	}
+	p.recorder.recordStream(p.channel, data)
+}
+
+// spdyStreamTypes 记录 SPDY 流 ID 与流类型的对应关系，两个方向的解析器共享
+type spdyStreamTypes struct {
+	mu      sync.Mutex
+	streams map[uint32]int
+}
+
+func newSPDYStreamTypes() *spdyStreamTypes {
+	return &spdyStreamTypes{streams: make(map[uint32]int)}
+}
+
+func (s *spdyStreamTypes) created(streamID uint32, channel int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[streamID] = channel
+}
+
+func (s *spdyStreamTypes) lookup(streamID uint32) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channel, ok := s.streams[streamID]
+	return channel, ok
+}
+
+// spdyStreamChannels 是 SYN_STREAM 的 streamType 头与流编号的对应关系
+var spdyStreamChannels = map[string]int{
+	"stdin":  sessionStreamStdin,
+	"stdout": sessionStreamStdout,
+	"stderr": sessionStreamStderr,
+	"error":  sessionStreamError,
+	"resize": sessionStreamResize,
+}
+
+// spdyStreamParser 解析 SPDY/3.1 帧，只关心客户端的 SYN_STREAM 和两个方向的数据帧
+type spdyStreamParser struct {
+	recorder   *sessionRecorder
+	streams    *spdyStreamTypes
+	fromClient bool
+	buf        []byte
+	// headers 解压客户端 SYN_STREAM 中的头部，同一方向的所有头部共用一个 zlib 流
+	headers spdyHeaderDecoder
+}
+
+func (p *spdyStreamParser) feed(data []byte) {
+	p.buf = append(p.buf, data...)
+	for len(p.buf) >= 8 {
+		length := int(p.buf[5])<<16 | int(p.buf[6])<<8 | int(p.buf[7])
+		if len(p.buf) < 8+length {
+			return
+		}
+		frame := p.buf[:8+length]
+		p.buf = p.buf[8+length:]
+
+		if frame[0]&0x80 != 0 {
+			// 控制帧: SYN_STREAM (type 1) 中包含新流的 ID，流的类型在头部的 streamType 中
+			frameType := binary.BigEndian.Uint16(frame[2:4])
+			if frameType == 1 && p.fromClient && length >= 10 {
+				p.synStream(binary.BigEndian.Uint32(frame[8:12])&0x7fffffff, frame[18:])
+			}
+			continue
+		}
+		streamID := binary.BigEndian.Uint32(frame[0:4]) & 0x7fffffff
+		if channel, ok := p.streams.lookup(streamID); ok {
+			p.recorder.recordStream(channel, frame[8:])
+		}
+	}
+}
+
+func (p *spdyStreamParser) synStream(streamID uint32, headerBlock []byte) {
+	if p.headers.err != nil {
+		return
+	}
+	header, err := p.headers.decode(headerBlock)
+	if err != nil {
+		log.Printf("警告: 无法解析会话 %s 的 SPDY 头部，之后创建的流不会被录制: %v", p.recorder.id(), err)
+		return
+	}
+	for _, streamType := range header["streamtype"] {
+		if channel, ok := spdyStreamChannels[streamType]; ok {
+			p.streams.created(streamID, channel)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spdyTestClient 按 SPDY/3.1 编码客户端发出的帧，所有 SYN_STREAM 的头部共用一个 zlib 流
+type spdyTestClient struct {
+	t          *testing.T
+	compressed bytes.Buffer
+	zw         *zlib.Writer
+}
+
+func newSPDYTestClient(t *testing.T) *spdyTestClient {
+	c := &spdyTestClient{t: t}
+	zw, err := zlib.NewWriterLevelDict(&c.compressed, zlib.BestCompression, []byte(spdyHeaderDictionary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.zw = zw
+	return c
+}
+
+func (c *spdyTestClient) synStream(streamID uint32, header map[string]string) []byte {
+	var block bytes.Buffer
+	binary.Write(&block, binary.BigEndian, uint32(len(header)))
+	for name, value := range header {
+		binary.Write(&block, binary.BigEndian, uint32(len(name)))
+		block.WriteString(name)
+		binary.Write(&block, binary.BigEndian, uint32(len(value)))
+		block.WriteString(value)
+	}
+	c.compressed.Reset()
+	c.zw.Write(block.Bytes())
+	if err := c.zw.Flush(); err != nil {
+		c.t.Fatal(err)
+	}
+
+	payload := make([]byte, 10)
+	binary.BigEndian.PutUint32(payload[0:4], streamID)
+	payload = append(payload, c.compressed.Bytes()...)
+	frame := []byte{0x80, 0x03, 0x00, 0x01, 0x00, 0, 0, 0}
+	frame[5], frame[6], frame[7] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	return append(frame, payload...)
+}
+
+func spdyDataFrame(streamID uint32, data string) []byte {
+	frame := make([]byte, 8)
+	binary.BigEndian.PutUint32(frame[0:4], streamID)
+	frame[5], frame[6], frame[7] = byte(len(data)>>16), byte(len(data)>>8), byte(len(data))
+	return append(frame, data...)
+}
+
+func TestSPDYStreamParserUsesStreamTypeHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &sessionRecorder{
+		file:    file,
+		path:    path,
+		start:   time.Now(),
+		header:  asciicastHeader{Version: 2, KubeGateway: &sessionMetadata{SessionID: "test"}},
+		pending: make(map[string][]byte),
+	}
+	streams := newSPDYStreamTypes()
+	fromClient := &spdyStreamParser{recorder: recorder, streams: streams, fromClient: true}
+	toClient := &spdyStreamParser{recorder: recorder, streams: streams}
+
+	// 流的创建顺序与 client-go 不同，只能依靠 streamType 头识别
+	client := newSPDYTestClient(t)
+	var stream bytes.Buffer
+	stream.Write(client.synStream(1, map[string]string{"streamtype": "stdout"}))
+	stream.Write(client.synStream(3, map[string]string{"streamtype": "stdin", "port": "80"}))
+	stream.Write(client.synStream(5, map[string]string{"streamtype": "error"}))
+	stream.Write(spdyDataFrame(3, "ls\n"))
+	// 按单个字节送入，覆盖帧被拆分在多次读取中的情况
+	for _, b := range stream.Bytes() {
+		fromClient.feed([]byte{b})
+	}
+	toClient.feed(spdyDataFrame(1, "file.txt\n"))
+	toClient.feed(spdyDataFrame(5, "ignored"))
+	file.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header and 2 events, got %d lines:\n%s", len(lines), data)
+	}
+	for i, want := range []string{`"i","ls\n"`, `"o","file.txt\n"`} {
+		if !strings.Contains(lines[i+1], want) {
+			t.Errorf("event %d = %s, want it to contain %s", i, lines[i+1], want)
+		}
+	}
+}
+
+func TestSPDYHeaderDecoderRejectsGarbage(t *testing.T) {
+	var decoder spdyHeaderDecoder
+	if _, err := decoder.decode([]byte("not a zlib stream")); err == nil {
+		t.Fatal("expected an error for an invalid header block")
+	}
+	if _, err := decoder.decode(nil); err == nil {
+		t.Fatal("expected the decoder to stay failed")
+	}
+}
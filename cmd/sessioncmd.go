@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	sessionListCluster string
+	sessionPlaySpeed   float64
+	sessionPlayIdle    time.Duration
+	sessionPlayInput   bool
+)
+
+var sessionCmd = &cobra.Command{
+	Use:   "session",
+	Short: "List and replay recorded exec/attach sessions",
+}
+
+var sessionListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List recorded exec/attach sessions",
+	Args:  cobra.NoArgs,
+	Run:   runSessionList,
+}
+
+var sessionPlayCmd = &cobra.Command{
+	Use:   "play [session-id]",
+	Short: "Replay a recorded exec/attach session in the terminal",
+	Args:  cobra.ExactArgs(1),
+	Run:   runSessionPlay,
+}
+
+func init() {
+	sessionCmd.PersistentFlags().StringVar(&sessionDir, "dir", "", "会话录像目录，默认为 ~/.kube-gateway/sessions")
+	sessionListCmd.Flags().StringVar(&sessionListCluster, "cluster", "", "只显示指定集群的会话")
+	sessionPlayCmd.Flags().Float64Var(&sessionPlaySpeed, "speed", 1, "回放速度倍数")
+	sessionPlayCmd.Flags().DurationVar(&sessionPlayIdle, "idle-limit", 2*time.Second, "两个事件之间最长的等待时间，0 表示按原始间隔回放")
+	sessionPlayCmd.Flags().BoolVar(&sessionPlayInput, "show-input", false, "在回放中同时显示用户的输入 (tty 会话中输入通常已被回显)")
+	sessionCmd.AddCommand(sessionListCmd)
+	sessionCmd.AddCommand(sessionPlayCmd)
+	rootCmd.AddCommand(sessionCmd)
+}
+
+// sessionFileInfo 是 'session list' 中展示的一个录像
+type sessionFileInfo struct {
+	Path     string
+	Header   asciicastHeader
+	Duration time.Duration
+	Size     int64
+}
+
+// readSessionFile 读取录像的文件头和最后一个事件的时间
+func readSessionFile(path string) (*sessionFileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := &sessionFileInfo{Path: path}
+	if stat, err := file.Stat(); err == nil {
+		info.Size = stat.Size()
+	}
+	scanner := newAuditLogScanner(file)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("录像文件 %s 为空", path)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &info.Header); err != nil || info.Header.Version != 2 {
+		return nil, fmt.Errorf("%s 不是 asciicast v2 格式的录像", path)
+	}
+	for scanner.Scan() {
+		var event []json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) < 1 {
+			continue
+		}
+		var elapsed float64
+		if err := json.Unmarshal(event[0], &elapsed); err == nil {
+			info.Duration = time.Duration(elapsed * float64(time.Second))
+		}
+	}
+	return info, scanner.Err()
+}
+
+// findSessionFile 根据会话 ID (或其前缀) 找到录像文件
+func findSessionFile(dir, id string) (string, error) {
+	if strings.HasSuffix(id, ".cast") {
+		if _, err := os.Stat(id); err == nil {
+			return id, nil
+		}
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, id+"*.cast"))
+	if err != nil {
+		return "", err
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("找不到 ID 为 '%s' 的会话录像", id)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("有 %d 个会话录像的 ID 以 '%s' 开头，请提供更完整的 ID", len(matches), id)
+	}
+}
+
+func runSessionList(cmd *cobra.Command, args []string) {
+	dir, err := defaultSessionDir()
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.cast"))
+	if err != nil {
+		log.Fatalf("错误: 查找会话录像失败: %v", err)
+	}
+
+	var sessions []*sessionFileInfo
+	for _, path := range paths {
+		info, err := readSessionFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "警告: %v\n", err)
+			continue
+		}
+		meta := info.Header.KubeGateway
+		if sessionListCluster != "" && (meta == nil || meta.Cluster != sessionListCluster) {
+			continue
+		}
+		sessions = append(sessions, info)
+	}
+	if len(sessions) == 0 {
+		fmt.Printf("没有找到任何会话录像 (目录: %s)。\n", dir)
+		return
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Header.Timestamp < sessions[j].Header.Timestamp })
+
+	headerFormat := "%-36s %-20s %-15s %-20s %-8s %-40s %-10s %s\n"
+	fmt.Printf(headerFormat, "会话 ID", "开始时间", "集群", "用户", "类型", "目标", "时长", "命令")
+	fmt.Printf(headerFormat, strings.Repeat("-", 36), strings.Repeat("-", 20), strings.Repeat("-", 15), strings.Repeat("-", 20),
+		strings.Repeat("-", 8), strings.Repeat("-", 40), strings.Repeat("-", 10), strings.Repeat("-", 20))
+	for _, s := range sessions {
+		id := strings.TrimSuffix(filepath.Base(s.Path), ".cast")
+		start := time.Unix(s.Header.Timestamp, 0).Format("2006-01-02 15:04:05")
+		meta := s.Header.KubeGateway
+		if meta == nil {
+			meta = &sessionMetadata{}
+		}
+		target := meta.Namespace + "/" + meta.Pod
+		if meta.Container != "" {
+			target += " (" + meta.Container + ")"
+		}
+		fmt.Printf(headerFormat, id, start, meta.Cluster, meta.User, meta.Subresource, target,
+			s.Duration.Round(time.Second).String(), s.Header.Command)
+	}
+}
+
+func runSessionPlay(cmd *cobra.Command, args []string) {
+	if sessionPlaySpeed <= 0 {
+		log.Fatalf("错误: --speed 必须大于 0")
+	}
+	dir, err := defaultSessionDir()
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	path, err := findSessionFile(dir, args[0])
+	if err != nil {
+		log.Fatalf("错误: %v", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("错误: 无法打开会话录像: %v", err)
+	}
+	defer file.Close()
+
+	scanner := newAuditLogScanner(file)
+	if !scanner.Scan() {
+		log.Fatalf("错误: 录像文件 %s 为空", path)
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		log.Fatalf("错误: %s 不是 asciicast v2 格式的录像", path)
+	}
+	fmt.Fprintf(os.Stderr, "▶️  回放会话: %s\n", header.Title)
+	if meta := header.KubeGateway; meta != nil {
+		fmt.Fprintf(os.Stderr, "   用户: %s  来源: %s  开始时间: %s  终端大小: %dx%d\n\n",
+			meta.User, meta.SourceIP, meta.StartTime.Local().Format("2006-01-02 15:04:05"), header.Width, header.Height)
+	}
+
+	stdout := bufio.NewWriter(os.Stdout)
+	defer stdout.Flush()
+	var last float64
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) < 3 {
+			continue
+		}
+		elapsed, _ := event[0].(float64)
+		kind, _ := event[1].(string)
+		data, _ := event[2].(string)
+
+		wait := time.Duration((elapsed - last) / sessionPlaySpeed * float64(time.Second))
+		if sessionPlayIdle > 0 && wait > sessionPlayIdle {
+			wait = sessionPlayIdle
+		}
+		last = elapsed
+		if wait > 0 {
+			stdout.Flush()
+			time.Sleep(wait)
+		}
+
+		switch kind {
+		case sessionEventOutput:
+			stdout.WriteString(data)
+		case sessionEventError:
+			stdout.Flush()
+			os.Stderr.WriteString(data)
+		case sessionEventInput:
+			if sessionPlayInput {
+				// 使用反色显示输入，与回显的输出区分开
+				fmt.Fprintf(stdout, "\x1b[7m%s\x1b[0m", strings.ReplaceAll(data, "\r", "⏎"))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("错误: 读取会话录像失败: %v", err)
+	}
+	stdout.Flush()
+	fmt.Fprintln(os.Stderr, "\n⏹️  回放结束。")
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// spdyMaxHeaderSize 是单个头部名称或值的长度上限，超出时视为无法解析
+const spdyMaxHeaderSize = 64 << 10
+
+// spdyHeaderDictionary 是 SPDY/3 规定的头部压缩字典
+const spdyHeaderDictionary = "\x00\x00\x00\x07options\x00\x00\x00\x04head\x00\x00\x00\x04post\x00\x00\x00\x03put\x00\x00" +
+	"\x00\x06delete\x00\x00\x00\x05trace\x00\x00\x00\x06accept\x00\x00\x00\x0eaccept-charset\x00" +
+	"\x00\x00\x0faccept-encoding\x00\x00\x00\x0faccept-language\x00\x00\x00\x0daccept-ranges\x00" +
+	"\x00\x00\x03age\x00\x00\x00\x05allow\x00\x00\x00\x0dauthorization\x00\x00\x00\x0dcache-co" +
+	"ntrol\x00\x00\x00\x0aconnection\x00\x00\x00\x0ccontent-base\x00\x00\x00\x10content-encodi" +
+	"ng\x00\x00\x00\x10content-language\x00\x00\x00\x0econtent-length\x00\x00\x00\x10content-l" +
+	"ocation\x00\x00\x00\x0bcontent-md5\x00\x00\x00\x0dcontent-range\x00\x00\x00\x0ccontent-ty" +
+	"pe\x00\x00\x00\x04date\x00\x00\x00\x04etag\x00\x00\x00\x06expect\x00\x00\x00\x07expires\x00" +
+	"\x00\x00\x04from\x00\x00\x00\x04host\x00\x00\x00\x08if-match\x00\x00\x00\x11if-modified-s" +
+	"ince\x00\x00\x00\x0dif-none-match\x00\x00\x00\x08if-range\x00\x00\x00\x13if-unmodified-si" +
+	"nce\x00\x00\x00\x0dlast-modified\x00\x00\x00\x08location\x00\x00\x00\x0cmax-forwards\x00\x00" +
+	"\x00\x06pragma\x00\x00\x00\x12proxy-authenticate\x00\x00\x00\x13proxy-authorization\x00\x00" +
+	"\x00\x05range\x00\x00\x00\x07referer\x00\x00\x00\x0bretry-after\x00\x00\x00\x06server\x00" +
+	"\x00\x00\x02te\x00\x00\x00\x07trailer\x00\x00\x00\x11transfer-encoding\x00\x00\x00\x07upg" +
+	"rade\x00\x00\x00\x0auser-agent\x00\x00\x00\x04vary\x00\x00\x00\x03via\x00\x00\x00\x07warn" +
+	"ing\x00\x00\x00\x10www-authenticate\x00\x00\x00\x06method\x00\x00\x00\x03get\x00\x00\x00\x06" +
+	"status\x00\x00\x00\x06200 OK\x00\x00\x00\x07version\x00\x00\x00\x08HTTP/1.1\x00\x00\x00\x03" +
+	"url\x00\x00\x00\x06public\x00\x00\x00\x0aset-cookie\x00\x00\x00\x0akeep-alive\x00\x00\x00" +
+	"\x06origin1001012012022052063003023033043053063074024054064074084094104114124134144154164" +
+	"17502504505203 Non-Authoritative Information204 No Content301 Moved Permanently400 Bad Re" +
+	"quest401 Unauthorized403 Forbidden404 Not Found500 Internal Server Error501 Not Implement" +
+	"ed503 Service UnavailableJan Feb Mar Apr May Jun Jul Aug Sept Oct Nov Dec 00:00:00 Mon, T" +
+	"ue, Wed, Thu, Fri, Sat, Sun, GMTchunked,text/html,image/png,image/jpg,image/gif,applicati" +
+	"on/xml,application/xhtml+xml,text/plain,text/javascript,publicprivatemax-age=gzip,deflate" +
+	",sdchcharset=utf-8charset=iso-8859-1,utf-,*,enq=0."
+
+// spdyHeaderDecoder 解压 SPDY/3 的头部块。同一方向上所有帧的头部属于同一个 zlib 流，
+// 每个头部块以 sync flush 结尾，因此每次只读取一个头部块的内容，剩余的字节留给下一个头部块
+type spdyHeaderDecoder struct {
+	input  spdyHeaderInput
+	reader io.ReadCloser
+	err    error
+}
+
+// decode 解压一个头部块，返回的头部名称均为小写，多个值以 NUL 分隔
+func (d *spdyHeaderDecoder) decode(block []byte) (map[string][]string, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	header, err := d.decodeBlock(block)
+	if err != nil {
+		d.err = err
+		return nil, err
+	}
+	return header, nil
+}
+
+func (d *spdyHeaderDecoder) decodeBlock(block []byte) (map[string][]string, error) {
+	d.input.data = append(d.input.data, block...)
+	if d.reader == nil {
+		reader, err := zlib.NewReaderDict(&d.input, []byte(spdyHeaderDictionary))
+		if err != nil {
+			return nil, err
+		}
+		d.reader = reader
+	}
+	count, err := d.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	header := make(map[string][]string)
+	for i := uint32(0); i < count; i++ {
+		name, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		name = strings.ToLower(name)
+		header[name] = append(header[name], strings.Split(value, "\x00")...)
+	}
+	return header, nil
+}
+
+func (d *spdyHeaderDecoder) readUint32() (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(d.reader, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+func (d *spdyHeaderDecoder) readString() (string, error) {
+	length, err := d.readUint32()
+	if err != nil {
+		return "", err
+	}
+	if length > spdyMaxHeaderSize {
+		return "", fmt.Errorf("头部长度 %d 超出上限", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(d.reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// spdyHeaderInput 是 zlib 流的输入，数据随头部块逐次追加。
+// 实现 io.ByteReader 使 zlib 不再套一层 bufio 预读，不会读走属于下一个头部块的字节
+type spdyHeaderInput struct {
+	data []byte
+}
+
+func (in *spdyHeaderInput) Read(p []byte) (int, error) {
+	if len(in.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, in.data)
+	in.data = in.data[n:]
+	return n, nil
+}
+
+func (in *spdyHeaderInput) ReadByte() (byte, error) {
+	if len(in.data) == 0 {
+		return 0, io.EOF
+	}
+	b := in.data[0]
+	in.data = in.data[1:]
+	return b, nil
+}
@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// maxStaleReadClusterBytes 是每个集群保存的响应体的总大小上限，超出时丢弃最早保存的响应
+	maxStaleReadClusterBytes = 64 << 20
+	// maxStaleReadBytes 是单个响应的大小上限，超出时照常返回但不保存
+	maxStaleReadBytes = 8 << 20
+)
+
+var (
+	staleReadResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_read_responses_total",
+		Help:      "Total number of GET/LIST requests answered with a last-known-good response because the backend was unreachable.",
+	}, []string{"cluster"})
+
+	staleReadEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_read_entries",
+		Help:      "Number of last-known-good responses currently kept for stale reads.",
+	}, []string{"cluster"})
+
+	staleReadBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_read_bytes",
+		Help:      "Total body size in bytes of the last-known-good responses currently kept for stale reads.",
+	}, []string{"cluster"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(staleReadResponses, staleReadEntries, staleReadBytes)
+}
+
+// staleReadSettings 设置一个集群的旧数据读取。maxAge 为 0 表示不启用，超过 maxAge 的响应不再返回；
+// resources 为空表示所有资源，写法与审计策略中的 resources 相同
+type staleReadSettings struct {
+	MaxAge    metav1.Duration      `json:"maxAge,omitempty"`
+	Resources []auditGroupResource `json:"resources,omitempty"`
+}
+
+// staleReadConfig 是 gateway.yaml 中的 staleReads 部分，perCluster 是所有集群的默认值，clusters 中可以按名称单独覆盖
+type staleReadConfig struct {
+	PerCluster staleReadSettings            `json:"perCluster,omitempty"`
+	Clusters   map[string]staleReadSettings `json:"clusters,omitempty"`
+}
+
+// settingsFor 按字段合并默认值和单独的配置
+func (c *staleReadConfig) settingsFor(clusterName string) staleReadSettings {
+	settings := c.PerCluster
+	if override, ok := c.Clusters[clusterName]; ok {
+		if override.MaxAge.Duration != 0 {
+			settings.MaxAge = override.MaxAge
+		}
+		if override.Resources != nil {
+			settings.Resources = override.Resources
+		}
+	}
+	return settings
+}
+
+func (c *staleReadConfig) validate() error {
+	if c.PerCluster.MaxAge.Duration < 0 {
+		return fmt.Errorf("staleReads.perCluster.maxAge 不能为负数")
+	}
+	for name, settings := range c.Clusters {
+		if settings.MaxAge.Duration < 0 {
+			return fmt.Errorf("staleReads.clusters.%s.maxAge 不能为负数", name)
+		}
+	}
+	return nil
+}
+
+// staleReadEntry 是一个保存的成功响应
+type staleReadEntry struct {
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+// staleReadCluster 是一个集群保存的响应，bytes 是其中响应体的总大小
+type staleReadCluster struct {
+	entries map[string]*staleReadEntry
+	bytes   int
+}
+
+// staleReadStore 按集群保存最近的 GET/LIST 成功响应
+type staleReadStore struct {
+	mu       sync.Mutex
+	clusters map[string]*staleReadCluster
+}
+
+var staleReads = &staleReadStore{clusters: make(map[string]*staleReadCluster)}
+
+func (s *staleReadStore) put(clusterName, key string, entry *staleReadEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cluster := s.clusters[clusterName]
+	if cluster == nil {
+		cluster = &staleReadCluster{entries: make(map[string]*staleReadEntry)}
+		s.clusters[clusterName] = cluster
+	}
+	if previous, exists := cluster.entries[key]; exists {
+		cluster.bytes -= len(previous.body)
+		delete(cluster.entries, key)
+	}
+	for cluster.bytes+len(entry.body) > maxStaleReadClusterBytes && len(cluster.entries) > 0 {
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range cluster.entries {
+			if oldestKey == "" || e.storedAt.Before(oldest) {
+				oldestKey, oldest = k, e.storedAt
+			}
+		}
+		cluster.bytes -= len(cluster.entries[oldestKey].body)
+		delete(cluster.entries, oldestKey)
+	}
+	cluster.entries[key] = entry
+	cluster.bytes += len(entry.body)
+	staleReadEntries.WithLabelValues(clusterName).Set(float64(len(cluster.entries)))
+	staleReadBytes.WithLabelValues(clusterName).Set(float64(cluster.bytes))
+}
+
+func (s *staleReadStore) get(clusterName, key string, maxAge time.Duration) *staleReadEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cluster := s.clusters[clusterName]
+	if cluster == nil {
+		return nil
+	}
+	entry := cluster.entries[key]
+	if entry == nil || time.Since(entry.storedAt) > maxAge {
+		return nil
+	}
+	return entry
+}
+
+// prune 丢弃已经不再启用旧数据读取的集群保存的响应，在执行 reload 后调用
+func (s *staleReadStore) prune() {
+	config := &gatewayConfigSnapshot().StaleReads
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for clusterName := range s.clusters {
+		if config.settingsFor(clusterName).MaxAge.Duration <= 0 {
+			delete(s.clusters, clusterName)
+			staleReadEntries.DeleteLabelValues(clusterName)
+			staleReadBytes.DeleteLabelValues(clusterName)
+		}
+	}
+}
+
+// staleReadKey 是保存在请求 context 中的 *staleRead 的键
+type staleReadKey struct{}
+
+// staleRead 记录一个可以使用旧数据的请求，由反向代理在收到成功响应时保存，无法访问后端时返回保存的响应
+type staleRead struct {
+	clusterName string
+	key         string
+	maxAge      time.Duration
+}
+
+// staleReadFor 判断请求能否使用旧数据: 只有启用了旧数据读取的集群中匹配的资源的 get 和 list，
+// 并且与请求合并一样要求 Token 相同、不带 Impersonate-* 头
+func staleReadFor(req *http.Request, clusterName string, info *RequestInfo) *staleRead {
+	if !info.IsResourceRequest || (info.Verb != "get" && info.Verb != "list") {
+		return nil
+	}
+	settings := gatewayConfigSnapshot().StaleReads.settingsFor(clusterName)
+	if settings.MaxAge.Duration <= 0 {
+		return nil
+	}
+	if len(settings.Resources) > 0 && !(&requestMatcher{Resources: settings.Resources}).matches(clusterName, info) {
+		return nil
+	}
+	key := coalescingKey(req, clusterName)
+	if key == "" {
+		return nil
+	}
+	return &staleRead{clusterName: clusterName, key: key, maxAge: settings.MaxAge.Duration}
+}
+
+func withStaleRead(ctx context.Context, read *staleRead) context.Context {
+	if read == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, staleReadKey{}, read)
+}
+
+func staleReadFromContext(ctx context.Context) *staleRead {
+	read, _ := ctx.Value(staleReadKey{}).(*staleRead)
+	return read
+}
+
+// recordStaleRead 在反向代理收到后端的成功响应时调用，响应体读取完毕后保存一份副本
+func recordStaleRead(resp *http.Response) {
+	read := staleReadFromContext(resp.Request.Context())
+	if read == nil || resp.StatusCode != http.StatusOK || resp.ContentLength > maxStaleReadBytes {
+		return
+	}
+	header := resp.Header.Clone()
+	for _, name := range []string{"Audit-Id", "Date", "Content-Length"} {
+		header.Del(name)
+	}
+	resp.Body = &staleRecordingBody{ReadCloser: resp.Body, onComplete: func(body []byte) {
+		staleReads.put(read.clusterName, read.key, &staleReadEntry{header: header, body: body, storedAt: time.Now()})
+	}}
+}
+
+// staleRecordingBody 在转发响应体的同时保存一份副本，完整读取到 EOF 后交给 onComplete
+type staleRecordingBody struct {
+	io.ReadCloser
+	buf        bytes.Buffer
+	overflow   bool
+	onComplete func([]byte)
+}
+
+func (b *staleRecordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if b.buf.Len()+n > maxStaleReadBytes {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow {
+		b.onComplete(bytes.Clone(b.buf.Bytes()))
+		b.overflow = true
+	}
+	return n, err
+}
+
+// serveStaleRead 在无法访问后端时返回保存的响应，并通过 Warning 头提示数据可能已过期，返回值表示是否已处理请求
+func serveStaleRead(w http.ResponseWriter, read *staleRead) bool {
+	if read == nil {
+		return false
+	}
+	entry := staleReads.get(read.clusterName, read.key, read.maxAge)
+	if entry == nil {
+		return false
+	}
+	staleReadResponses.WithLabelValues(read.clusterName).Inc()
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	storedAt := entry.storedAt.UTC().Format(time.RFC3339)
+	w.Header().Set("Warning", fmt.Sprintf(`299 - "集群 %s 的 API Server 当前无法访问，返回的是 %s 的数据"`, read.clusterName, storedAt))
+	w.Header().Set("X-Kube-Gateway-Stale-Since", storedAt)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.storedAt).Seconds())))
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.body)
+	return true
+}
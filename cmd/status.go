@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newGatewayStatus 构建网关自身产生的错误，格式与 API Server 返回的 metav1.Status 一致，
+// kubectl 和 client-go 可以据此给出正确的提示并决定是否重试
+func newGatewayStatus(code int32, reason metav1.StatusReason, message string) *metav1.Status {
+	return &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     code,
+	}
+}
+
+// withRetryAfter 设置客户端应等待的秒数，写入响应时会同时设置 Retry-After 头
+func withRetryAfter(status *metav1.Status, seconds int32) *metav1.Status {
+	if seconds < 1 {
+		seconds = 1
+	}
+	if status.Details == nil {
+		status.Details = &metav1.StatusDetails{}
+	}
+	status.Details.RetryAfterSeconds = seconds
+	return status
+}
+
+// backendErrorStatus 根据 classifyBackendError 的归类构建无法访问后端时返回给客户端的错误。
+// 具体的错误信息可能包含后端地址，只记录在网关日志中
+func backendErrorStatus(clusterName, errorType string) *metav1.Status {
+	switch errorType {
+	case "timeout":
+		return newGatewayStatus(http.StatusGatewayTimeout, metav1.StatusReasonTimeout,
+			fmt.Sprintf("网关超时: 等待集群 %s 的 API Server 响应超时", clusterName))
+	case "dns":
+		return newGatewayStatus(http.StatusBadGateway, metav1.StatusReasonServiceUnavailable,
+			fmt.Sprintf("网关错误: 无法解析集群 %s 的 API Server 地址 (DNS 解析失败)", clusterName))
+	case "tls":
+		return newGatewayStatus(http.StatusBadGateway, metav1.StatusReasonServiceUnavailable,
+			fmt.Sprintf("网关错误: 与集群 %s 的 API Server 建立 TLS 连接失败 (证书校验或握手失败)", clusterName))
+	case "connection_refused":
+		return newGatewayStatus(http.StatusBadGateway, metav1.StatusReasonServiceUnavailable,
+			fmt.Sprintf("网关错误: 集群 %s 的 API Server 拒绝连接", clusterName))
+	case "connection_reset":
+		return newGatewayStatus(http.StatusBadGateway, metav1.StatusReasonServiceUnavailable,
+			fmt.Sprintf("网关错误: 与集群 %s 的 API Server 的连接被意外断开", clusterName))
+	default:
+		return newGatewayStatus(http.StatusBadGateway, metav1.StatusReasonServiceUnavailable,
+			fmt.Sprintf("网关错误: 无法访问集群 %s 的 API Server", clusterName))
+	}
+}
+
+// writeStatus 将 metav1.Status 以 JSON 格式写入响应
+func writeStatus(w http.ResponseWriter, status *metav1.Status) {
+	body, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, status.Message, int(status.Code))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if status.Details != nil && status.Details.RetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(status.Details.RetryAfterSeconds)))
+	}
+	w.WriteHeader(int(status.Code))
+	w.Write(body)
+}
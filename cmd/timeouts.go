@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultRequestTimeout 与 API Server 对普通请求的默认超时时间一致
+const defaultRequestTimeout = 60 * time.Second
+
+var (
+	serverReadHeaderTimeout time.Duration
+	serverReadTimeout       time.Duration
+	serverIdleTimeout       time.Duration
+	shutdownTimeout         time.Duration
+)
+
+// timeoutSettings 设置一个集群的超时时间，0 表示使用默认值:
+// request 限制普通请求等待后端返回响应头的时间 (默认 60s)，响应头到达后响应体的传输不受限制，
+// 较大的 LIST 和不跟踪的日志不会中途被截断；watchMaxDuration 限制单个 watch 的最长时间 (默认不限制)，
+// 到期后由 API Server 正常结束事件流，客户端会重新发起 watch；streamIdleTimeout 在 exec、attach、
+// port-forward 等会话双向都没有数据时断开连接 (默认不限制)
+type timeoutSettings struct {
+	Request           metav1.Duration `json:"request,omitempty"`
+	WatchMaxDuration  metav1.Duration `json:"watchMaxDuration,omitempty"`
+	StreamIdleTimeout metav1.Duration `json:"streamIdleTimeout,omitempty"`
+}
+
+// timeoutConfig 是 gateway.yaml 中的 timeouts 部分，perCluster 是所有集群的默认值，clusters 中可以按名称单独覆盖
+type timeoutConfig struct {
+	PerCluster timeoutSettings            `json:"perCluster,omitempty"`
+	Clusters   map[string]timeoutSettings `json:"clusters,omitempty"`
+}
+
+// settingsFor 按字段合并默认值和单独的配置
+func (c *timeoutConfig) settingsFor(clusterName string) timeoutSettings {
+	settings := c.PerCluster
+	if override, ok := c.Clusters[clusterName]; ok {
+		if override.Request.Duration != 0 {
+			settings.Request = override.Request
+		}
+		if override.WatchMaxDuration.Duration != 0 {
+			settings.WatchMaxDuration = override.WatchMaxDuration
+		}
+		if override.StreamIdleTimeout.Duration != 0 {
+			settings.StreamIdleTimeout = override.StreamIdleTimeout
+		}
+	}
+	if settings.Request.Duration == 0 {
+		settings.Request.Duration = defaultRequestTimeout
+	}
+	return settings
+}
+
+func (c *timeoutConfig) validate() error {
+	check := func(where string, settings timeoutSettings) error {
+		if settings.Request.Duration < 0 || settings.WatchMaxDuration.Duration < 0 || settings.StreamIdleTimeout.Duration < 0 {
+			return fmt.Errorf("timeouts.%s 中的时间不能为负数", where)
+		}
+		if d := settings.WatchMaxDuration.Duration; d > 0 && d < time.Second {
+			return fmt.Errorf("timeouts.%s.watchMaxDuration 不能小于 1s", where)
+		}
+		return nil
+	}
+	if err := check("perCluster", c.PerCluster); err != nil {
+		return err
+	}
+	for name, settings := range c.Clusters {
+		if err := check("clusters."+name, settings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// responseHeaderTimeoutKey 是 context 中等待后端响应头的超时时间
+type responseHeaderTimeoutKey struct{}
+
+// withResponseHeaderTimeout 设置请求等待后端响应头的超时时间，由 responseHeaderTimeoutTransport 执行
+func withResponseHeaderTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, responseHeaderTimeoutKey{}, timeout)
+}
+
+// responseHeaderTimeoutTransport 在后端超过超时时间仍未返回响应头时取消请求，返回的错误包含
+// context.DeadlineExceeded，由代理返回 504。响应头到达后停止计时，响应体按客户端的速度传输完为止
+type responseHeaderTimeoutTransport struct {
+	underlyingTransport http.RoundTripper
+}
+
+func (t *responseHeaderTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout, _ := req.Context().Value(responseHeaderTimeoutKey{}).(time.Duration)
+	if timeout <= 0 {
+		return t.underlyingTransport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	resp, err := t.underlyingTransport.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && timedOut.Load() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("后端在 %s 内没有返回响应头: %w", timeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnCloseBody 在响应体关闭时释放请求的 context
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// limitWatchDuration 通过 timeoutSeconds 参数限制 watch 的最长时间。
+// 由 API Server 在到期时正常结束事件流，而不是由网关中途断开连接；客户端要求的时间更短时保持不变
+func limitWatchDuration(req *http.Request, max time.Duration) {
+	if max <= 0 {
+		return
+	}
+	maxSeconds := int64(max / time.Second)
+	query := req.URL.Query()
+	if requested, err := strconv.ParseInt(query.Get("timeoutSeconds"), 10, 64); err == nil && requested > 0 && requested <= maxSeconds {
+		return
+	}
+	query.Set("timeoutSeconds", strconv.FormatInt(maxSeconds, 10))
+	req.URL.RawQuery = query.Encode()
+}
+
+// idleTimeoutConn 在连接双向都没有数据超过 timeout 时关闭连接，用于协议升级后的 exec、attach、port-forward 会话
+type idleTimeoutConn struct {
+	net.Conn
+	timeout      time.Duration
+	lastActivity atomic.Int64
+	timer        *time.Timer
+	closeOnce    sync.Once
+	onIdle       func()
+}
+
+func newIdleTimeoutConn(conn net.Conn, timeout time.Duration, onIdle func()) *idleTimeoutConn {
+	c := &idleTimeoutConn{Conn: conn, timeout: timeout, onIdle: onIdle}
+	c.lastActivity.Store(time.Now().UnixNano())
+	c.timer = time.AfterFunc(timeout, c.check)
+	return c
+}
+
+// check 在计时器到期时检查最后一次收发数据的时间，期间有数据时重新计时
+func (c *idleTimeoutConn) check() {
+	idle := time.Since(time.Unix(0, c.lastActivity.Load()))
+	if idle < c.timeout {
+		c.timer.Reset(c.timeout - idle)
+		return
+	}
+	if c.onIdle != nil {
+		c.onIdle()
+	}
+	c.Close()
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.timer.Stop()
+		err = c.Conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseHeaderTimeoutTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		// 响应头立即返回，响应体分多次写出，总时间超过超时时间
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{name: "slow body is not cut off", path: "/slow-body", timeout: 100 * time.Millisecond},
+		{name: "slow headers time out", path: "/slow-headers", timeout: 100 * time.Millisecond, wantErr: true},
+		{name: "no timeout", path: "/slow-body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				ctx = withResponseHeaderTimeout(ctx, tt.timeout)
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, backend.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport := &responseHeaderTimeoutTransport{underlyingTransport: &http.Transport{}}
+			start := time.Now()
+			resp, err := transport.RoundTrip(req)
+			if tt.wantErr {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("err = %v, want a deadline exceeded error", err)
+				}
+				if classifyBackendError(err) != "timeout" {
+					t.Errorf("error type = %s, want timeout", classifyBackendError(err))
+				}
+				if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+					t.Errorf("timed out after %s, want about %s", elapsed, tt.timeout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("reading the body failed: %v", err)
+			}
+			if strings.Count(string(body), "chunk") != 5 {
+				t.Errorf("body = %q, want 5 chunks", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/gitlayzer/kube-gateway"
+
+var (
+	tracingExporter     string
+	tracingOTLPEndpoint string
+	tracingOTLPInsecure bool
+	tracingFile         string
+	tracingSampleRatio  float64
+)
+
+// setupTracing 根据命令行参数初始化 OpenTelemetry，返回用于刷新并关闭导出器的函数
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+
+	switch tracingExporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if tracingOTLPEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(tracingOTLPEndpoint))
+		}
+		if tracingOTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("创建 OTLP 导出器失败: %w", err)
+		}
+		exporter = exp
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, fmt.Errorf("创建 stdout 导出器失败: %w", err)
+		}
+		exporter = exp
+	case "file":
+		if tracingFile == "" {
+			return nil, fmt.Errorf("使用 file 导出器时必须指定 --tracing-file")
+		}
+		file, err := os.OpenFile(tracingFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("无法打开链路追踪文件 %s: %w", tracingFile, err)
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("创建文件导出器失败: %w", err)
+		}
+		exporter = exp
+		closer = file
+	default:
+		return nil, fmt.Errorf("不支持的链路追踪导出器 '%s'，可选值为 none、otlp、stdout、file", tracingExporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("kube-gateway"),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("创建链路追踪资源描述失败: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tracingSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	// 接受客户端传入的 W3C traceparent，并继续传播给后端
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// TracingMiddleware 为每个请求创建服务端 span，并将其放入请求的 context 中
+func TracingMiddleware() gin.HandlerFunc {
+	tracer := otel.Tracer(tracerName)
+	propagator := otel.GetTextMapPropagator()
+
+	return func(c *gin.Context) {
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		info := requestInfoFor(c)
+
+		spanName := c.Request.Method + " " + c.FullPath()
+		if info.IsResourceRequest {
+			spanName = info.Verb + " " + info.Resource
+		}
+		ctx, span := tracer.Start(ctx, spanName,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+				semconv.UserAgentOriginal(c.Request.UserAgent()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(status),
+			attribute.String("k8s.cluster", c.GetString("targetCluster")),
+			attribute.String("kube_gateway.token", c.GetString("tokenName")),
+			attribute.String("k8s.verb", info.Verb),
+			attribute.String("k8s.resource", info.Resource),
+			attribute.String("k8s.subresource", info.Subresource),
+			attribute.String("k8s.namespace", info.Namespace),
+		)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// newTracingTransport 为访问后端的 transport 加上客户端 span，
+// 并通过 httptrace 记录 DNS、建连和 TLS 握手各阶段的耗时
+func newTracingTransport(clusterName string, rt http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(rt,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "backend " + clusterName + " " + r.Method
+		}),
+		otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
+			return otelhttptrace.NewClientTrace(ctx)
+		}),
+	)
+}
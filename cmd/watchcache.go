@@ -0,0 +1,791 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// defaultWatchHistorySize 是每个共享 watch 默认保留的事件数，客户端断开重连时可以从中继续
+	defaultWatchHistorySize = 1000
+	// watchCacheLinger 是最后一个客户端断开后保留上游 watch 的时间，便于客户端重新发起 watch 时复用
+	watchCacheLinger = time.Minute
+	// watchCacheSyncWait 是第一个客户端等待上游完成 list 的时间，超时后转发到后端
+	watchCacheSyncWait = 5 * time.Second
+	// watchSubscriberBuffer 是每个客户端缓冲的事件数，客户端读取过慢导致缓冲已满时断开该客户端
+	watchSubscriberBuffer = 100
+	// watchCacheRetryMax 是上游 watch 失败后重试的最长间隔
+	watchCacheRetryMax = 30 * time.Second
+)
+
+var (
+	watchCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "watch_cache_requests_total",
+		Help:      "Total number of watch requests for shared resources by result (hit, bypass).",
+	}, []string{"cluster", "resource", "result"})
+
+	watchCacheUpstreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "watch_cache_upstream_watches",
+		Help:      "Number of upstream watches currently held open by the watch cache.",
+	}, []string{"cluster", "resource"})
+
+	watchCacheClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "watch_cache_clients",
+		Help:      "Number of client watches currently served from shared upstream watches.",
+	}, []string{"cluster", "resource"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(watchCacheRequests, watchCacheUpstreams, watchCacheClients)
+}
+
+// watchCacheSettings 设置一个集群中共享 watch 的资源，historySize 是每个上游 watch 保留的事件数
+type watchCacheSettings struct {
+	Resources   []readCacheResource `json:"resources,omitempty"`
+	HistorySize int                 `json:"historySize,omitempty"`
+}
+
+// watchCacheConfig 是 gateway.yaml 中的 watchCache 部分，perCluster 是所有集群的默认值，
+// clusters 中单独设置的 resources 会替换默认的资源列表
+type watchCacheConfig struct {
+	PerCluster watchCacheSettings            `json:"perCluster,omitempty"`
+	Clusters   map[string]watchCacheSettings `json:"clusters,omitempty"`
+}
+
+func (c *watchCacheConfig) settingsFor(clusterName string) watchCacheSettings {
+	settings := c.PerCluster
+	if override, ok := c.Clusters[clusterName]; ok {
+		if override.Resources != nil {
+			settings.Resources = override.Resources
+		}
+		if override.HistorySize != 0 {
+			settings.HistorySize = override.HistorySize
+		}
+	}
+	if settings.HistorySize == 0 {
+		settings.HistorySize = defaultWatchHistorySize
+	}
+	return settings
+}
+
+// enabledFor 判断集群的某个资源是否配置了共享 watch
+func (c *watchCacheConfig) enabledFor(clusterName string, gvr schema.GroupVersionResource) bool {
+	for _, r := range c.settingsFor(clusterName).Resources {
+		if r.gvr() == gvr {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *watchCacheConfig) validate() error {
+	check := func(where string, settings watchCacheSettings) error {
+		if settings.HistorySize < 0 {
+			return fmt.Errorf("watchCache.%s.historySize 不能为负数", where)
+		}
+		return validateCacheResources("watchCache."+where, settings.Resources)
+	}
+	if err := check("perCluster", c.PerCluster); err != nil {
+		return err
+	}
+	for name, settings := range c.Clusters {
+		if err := check("clusters."+name, settings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchCacheEvent 是上游 watch 收到的一个事件。prevObject 是对象变化之前的状态，
+// 用于判断对象是否因为修改而进入或离开某个客户端的选择器；row 是 Table 格式的上游 watch 中对象所在的行
+type watchCacheEvent struct {
+	eventType       watch.EventType
+	object          *unstructured.Unstructured
+	prevObject      *unstructured.Unstructured
+	row             *watchTableRow
+	resourceVersion uint64
+
+	encodeOnce sync.Once
+	encoded    []byte
+
+	metadataOnce sync.Once
+	metadata     []byte
+}
+
+// encodedObject 返回对象的 JSON，同一个事件发给多个客户端时只编码一次
+func (e *watchCacheEvent) encodedObject() []byte {
+	e.encodeOnce.Do(func() {
+		if e.row != nil {
+			e.encoded = e.row.object
+			return
+		}
+		// 每个事件占一行，去掉编码器在末尾添加的换行
+		encoded, _ := e.object.MarshalJSON()
+		e.encoded = bytes.TrimSpace(encoded)
+	})
+	return e.encoded
+}
+
+// encodedMetadata 返回对象 metadata 的 JSON，用于 Table 中 includeObject=Metadata 的行
+func (e *watchCacheEvent) encodedMetadata() []byte {
+	e.metadataOnce.Do(func() {
+		e.metadata, _ = json.Marshal(e.object.Object["metadata"])
+	})
+	return e.metadata
+}
+
+// watchSubscriber 是一个从共享 watch 接收事件的客户端
+type watchSubscriber struct {
+	events chan *watchCacheEvent
+	// closed 在客户端读取过慢或上游重新 list 时关闭，客户端随后会重新发起 watch
+	closed chan struct{}
+}
+
+// sharedWatch 是一个集群中某个资源在某个命名空间 (空字符串表示所有命名空间) 的上游 watch，
+// 保存对象的当前状态和最近的事件，并把事件分发给所有客户端。
+// table 为 true 时上游以 Table 格式 watch，供 kubectl get -w 等要求表格的客户端共用
+type sharedWatch struct {
+	clusterName string
+	gvr         schema.GroupVersionResource
+	namespace   string
+	table       bool
+	config      *rest.Config
+	historySize int
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu          sync.Mutex
+	ready       chan struct{}
+	lastErr     error
+	kind        string
+	objects     map[string]*unstructured.Unstructured
+	rows        map[string]*watchTableRow
+	columns     json.RawMessage
+	history     []*watchCacheEvent
+	oldestRV    uint64
+	currentRV   uint64
+	subscribers map[*watchSubscriber]bool
+	idleTimer   *time.Timer
+}
+
+// watchCacheManager 按 "集群/资源/命名空间/格式" 管理共享的上游 watch，在第一个客户端发起 watch 时启动
+type watchCacheManager struct {
+	mu      sync.Mutex
+	watches map[string]*sharedWatch
+}
+
+var watchCaches = &watchCacheManager{watches: make(map[string]*sharedWatch)}
+
+func watchCacheKey(clusterName string, gvr schema.GroupVersionResource, namespace string, table bool) string {
+	key := clusterName + "/" + gvr.String() + "/" + namespace
+	if table {
+		key += "/table"
+	}
+	return key
+}
+
+// acquire 返回共享 watch 并登记一个客户端，不存在时启动新的上游 watch
+func (m *watchCacheManager) acquire(clusterName string, gvr schema.GroupVersionResource, namespace string, table bool, config *rest.Config) *sharedWatch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := watchCacheKey(clusterName, gvr, namespace, table)
+	if sw, ok := m.watches[key]; ok {
+		sw.mu.Lock()
+		if sw.idleTimer != nil {
+			sw.idleTimer.Stop()
+			sw.idleTimer = nil
+		}
+		sw.mu.Unlock()
+		return sw
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sw := &sharedWatch{
+		clusterName: clusterName,
+		gvr:         gvr,
+		namespace:   namespace,
+		table:       table,
+		config:      config,
+		historySize: gatewayConfigSnapshot().WatchCache.settingsFor(clusterName).HistorySize,
+		ctx:         ctx,
+		cancel:      cancel,
+		ready:       make(chan struct{}),
+		subscribers: make(map[*watchSubscriber]bool),
+	}
+	m.watches[key] = sw
+	watchCacheUpstreams.WithLabelValues(clusterName, readCacheResourceLabel(gvr)).Inc()
+	go sw.run()
+	return sw
+}
+
+// release 在客户端断开后调用，没有客户端的上游 watch 在 watchCacheLinger 之后停止
+func (m *watchCacheManager) release(sw *sharedWatch) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if len(sw.subscribers) > 0 || sw.idleTimer != nil {
+		return
+	}
+	sw.idleTimer = time.AfterFunc(watchCacheLinger, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		sw.mu.Lock()
+		idle := len(sw.subscribers) == 0 && sw.idleTimer != nil
+		sw.mu.Unlock()
+		if idle {
+			m.stopLocked(sw)
+		}
+	})
+}
+
+// stopLocked 停止上游 watch 并断开它的所有客户端，调用时需持有 m.mu
+func (m *watchCacheManager) stopLocked(sw *sharedWatch) {
+	key := watchCacheKey(sw.clusterName, sw.gvr, sw.namespace, sw.table)
+	if m.watches[key] != sw {
+		return
+	}
+	delete(m.watches, key)
+	sw.cancel()
+	sw.mu.Lock()
+	sw.dropSubscribersLocked()
+	sw.mu.Unlock()
+	watchCacheUpstreams.WithLabelValues(sw.clusterName, readCacheResourceLabel(sw.gvr)).Dec()
+}
+
+// reconcile 停止不再配置共享 watch 的资源以及集群配置发生变化的上游 watch，客户端会重新发起 watch
+func (m *watchCacheManager) reconcile(configs map[string]*rest.Config) {
+	config := &gatewayConfigSnapshot().WatchCache
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sw := range m.watches {
+		restConfig, ok := configs[sw.clusterName]
+		if ok && reflect.DeepEqual(*restConfig, *sw.config) && config.enabledFor(sw.clusterName, sw.gvr) {
+			continue
+		}
+		m.stopLocked(sw)
+		log.Printf("共享 watch: 已停止集群 %s 的 %s", sw.clusterName, sw.describe())
+	}
+}
+
+// describe 返回用于日志的资源和命名空间，例如 pods (命名空间 default)
+func (sw *sharedWatch) describe() string {
+	description := readCacheResourceLabel(sw.gvr)
+	if sw.namespace != "" {
+		description += fmt.Sprintf(" (命名空间 %s)", sw.namespace)
+	}
+	if sw.table {
+		description += " (Table)"
+	}
+	return description
+}
+
+// run 先 list 获取对象的当前状态，再从该版本开始 watch。watch 正常结束时从最后的版本继续，
+// 版本已过期 (410) 时重新 list，直到共享 watch 被停止
+func (sw *sharedWatch) run() {
+	upstream, err := newWatchUpstream(sw.config, sw.gvr, sw.namespace, sw.table)
+	if err != nil {
+		sw.setError(err)
+		log.Printf("警告: 共享 watch: 无法为集群 %s 创建客户端: %v", sw.clusterName, err)
+		return
+	}
+	retry := time.Second
+	needList := true
+	for sw.ctx.Err() == nil {
+		if needList {
+			snapshot, err := upstream.list(sw.ctx)
+			if err != nil {
+				sw.setError(err)
+				log.Printf("警告: 共享 watch: 无法获取集群 %s 的 %s: %v", sw.clusterName, sw.describe(), err)
+				retry = sw.sleep(retry)
+				continue
+			}
+			if err := sw.reset(snapshot); err != nil {
+				sw.setError(err)
+				retry = sw.sleep(retry)
+				continue
+			}
+			needList = false
+			log.Printf("共享 watch: 已开始监听集群 %s 的 %s (%d 个对象)", sw.clusterName, sw.describe(), len(snapshot.objects))
+		}
+
+		sw.mu.Lock()
+		resourceVersion := strconv.FormatUint(sw.currentRV, 10)
+		sw.mu.Unlock()
+		watcher, err := upstream.watch(sw.ctx, resourceVersion)
+		if err != nil {
+			if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+				needList = true
+				continue
+			}
+			if sw.ctx.Err() == nil {
+				log.Printf("警告: 共享 watch: 无法监听集群 %s 的 %s: %v", sw.clusterName, sw.describe(), err)
+			}
+			retry = sw.sleep(retry)
+			continue
+		}
+		retry = time.Second
+		needList = sw.consume(watcher)
+		watcher.stop()
+	}
+}
+
+// consume 处理上游 watch 的事件直到其结束，返回值表示是否需要重新 list
+func (sw *sharedWatch) consume(watcher upstreamWatch) bool {
+	for {
+		event, ok := watcher.next()
+		if !ok {
+			return false
+		}
+		if event.eventType == watch.Error {
+			log.Printf("警告: 共享 watch: 集群 %s 的 %s 返回错误: %v", sw.clusterName, sw.describe(), event.err)
+			return apierrors.IsResourceExpired(event.err) || apierrors.IsGone(event.err)
+		}
+		rv, err := strconv.ParseUint(event.object.GetResourceVersion(), 10, 64)
+		if err != nil {
+			continue
+		}
+		sw.dispatch(event, rv)
+	}
+}
+
+// sleep 等待一段时间后重试，返回下一次等待的时间
+func (sw *sharedWatch) sleep(d time.Duration) time.Duration {
+	select {
+	case <-sw.ctx.Done():
+	case <-time.After(d):
+	}
+	return min(d*2, watchCacheRetryMax)
+}
+
+func (sw *sharedWatch) setError(err error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.lastErr = err
+}
+
+// reset 用 list 的结果替换对象的状态并清空历史事件。之前的事件无法与新的状态衔接，
+// 因此断开所有客户端，由它们重新发起 watch
+func (sw *sharedWatch) reset(snapshot *watchSnapshot) error {
+	rv, err := strconv.ParseUint(snapshot.resourceVersion, 10, 64)
+	if err != nil {
+		return fmt.Errorf("无法解析 resourceVersion '%s'", snapshot.resourceVersion)
+	}
+	objects := make(map[string]*unstructured.Unstructured, len(snapshot.objects))
+	rows := make(map[string]*watchTableRow, len(snapshot.rows))
+	for i, obj := range snapshot.objects {
+		key := obj.GetNamespace() + "/" + obj.GetName()
+		objects[key] = obj
+		if i < len(snapshot.rows) {
+			rows[key] = snapshot.rows[i]
+		}
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.kind = snapshot.kind
+	sw.objects = objects
+	sw.rows = rows
+	sw.columns = snapshot.columns
+	sw.history = nil
+	sw.oldestRV = rv
+	sw.currentRV = rv
+	sw.lastErr = nil
+	sw.dropSubscribersLocked()
+	select {
+	case <-sw.ready:
+	default:
+		close(sw.ready)
+	}
+	return nil
+}
+
+// dispatch 更新对象的状态，记录事件并发给所有客户端
+func (sw *sharedWatch) dispatch(upstream upstreamEvent, rv uint64) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	eventType, obj := upstream.eventType, upstream.object
+	event := &watchCacheEvent{eventType: eventType, object: obj, row: upstream.row, resourceVersion: rv}
+	key := obj.GetNamespace() + "/" + obj.GetName()
+	switch eventType {
+	case watch.Added, watch.Modified:
+		event.prevObject = sw.objects[key]
+		sw.objects[key] = obj
+		if upstream.row != nil {
+			sw.rows[key] = upstream.row
+		}
+	case watch.Deleted:
+		event.prevObject = sw.objects[key]
+		delete(sw.objects, key)
+		delete(sw.rows, key)
+	}
+	if upstream.columns != nil {
+		sw.columns = upstream.columns
+	}
+	sw.currentRV = rv
+	if eventType != watch.Bookmark {
+		sw.history = append(sw.history, event)
+		if len(sw.history) > sw.historySize {
+			sw.oldestRV = sw.history[0].resourceVersion
+			sw.history = sw.history[1:]
+		}
+	}
+	for sub := range sw.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			// 客户端读取过慢，断开后由客户端从最后收到的版本重新发起 watch
+			sw.dropSubscriberLocked(sub)
+		}
+	}
+}
+
+func (sw *sharedWatch) dropSubscriberLocked(sub *watchSubscriber) {
+	if sw.subscribers[sub] {
+		delete(sw.subscribers, sub)
+		close(sub.closed)
+	}
+}
+
+func (sw *sharedWatch) dropSubscribersLocked() {
+	for sub := range sw.subscribers {
+		sw.dropSubscriberLocked(sub)
+	}
+}
+
+// errWatchUnavailable 表示共享 watch 已经停止，或客户端要求的版本早于共享 watch 保存的历史，这类请求转发到后端
+var errWatchUnavailable = fmt.Errorf("共享 watch 无法满足该请求")
+
+// subscribe 登记一个客户端并返回它需要先收到的事件。fromState 为 true (resourceVersion 未指定或为 "0") 时
+// 先以 ADDED 事件返回所有对象的当前状态；否则返回历史中该版本之后的事件。
+// resourceVersion 在所有资源之间递增，客户端刚从后端 list 得到的版本常常比共享 watch 收到的最后一个事件更新，
+// 这种情况同样可以订阅，之后由调用方跳过不晚于该版本的事件
+func (sw *sharedWatch) subscribe(resourceVersion uint64, fromState bool) (*watchSubscriber, []*watchCacheEvent, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	var initial []*watchCacheEvent
+	switch {
+	case sw.ctx.Err() != nil:
+		return nil, nil, errWatchUnavailable
+	case fromState:
+		for key, obj := range sw.objects {
+			rv, _ := strconv.ParseUint(obj.GetResourceVersion(), 10, 64)
+			initial = append(initial, &watchCacheEvent{eventType: watch.Added, object: obj, row: sw.rows[key], resourceVersion: rv})
+		}
+	case resourceVersion < sw.oldestRV:
+		return nil, nil, errWatchUnavailable
+	default:
+		for _, event := range sw.history {
+			if event.resourceVersion > resourceVersion {
+				initial = append(initial, event)
+			}
+		}
+	}
+	sub := &watchSubscriber{events: make(chan *watchCacheEvent, watchSubscriberBuffer), closed: make(chan struct{})}
+	sw.subscribers[sub] = true
+	return sub, initial, nil
+}
+
+func (sw *sharedWatch) unsubscribe(sub *watchSubscriber) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.dropSubscriberLocked(sub)
+}
+
+// waitReady 等待上游完成第一次 list，上游已经出错或等待超时时返回 false
+func (sw *sharedWatch) waitReady(ctx context.Context) bool {
+	sw.mu.Lock()
+	failed := sw.lastErr != nil
+	sw.mu.Unlock()
+	if failed {
+		select {
+		case <-sw.ready:
+			return true
+		default:
+			return false
+		}
+	}
+	timer := time.NewTimer(watchCacheSyncWait)
+	defer timer.Stop()
+	select {
+	case <-sw.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// serveFromWatchCache 尝试由共享的上游 watch 返回 watch 请求，返回值表示是否已处理请求。
+// 处理普通 JSON 和 kubectl 使用的 Table 格式的 watch，两者各用一个上游 watch；
+// 其他格式、sendInitialEvents、不支持的字段选择器、早于共享 watch 历史的 resourceVersion
+// 以及带有 Impersonate-* 头 (需要后端按被模拟的身份检查权限) 的请求转发到后端
+func serveFromWatchCache(w http.ResponseWriter, req *http.Request, clusterName string, info *RequestInfo) bool {
+	if !info.IsResourceRequest || info.Verb != "watch" || info.Subresource != "" || info.Name != "" {
+		return false
+	}
+	gvr := schema.GroupVersionResource{Group: info.APIGroup, Version: info.APIVersion, Resource: info.Resource}
+	if !gatewayConfigSnapshot().WatchCache.enabledFor(clusterName, gvr) {
+		return false
+	}
+	resourceLabel := readCacheResourceLabel(gvr)
+	query := req.URL.Query()
+	labelSelector, fieldSelector, ok := parseCacheSelectors(query)
+	rv, rvErr := strconv.ParseUint(query.Get("resourceVersion"), 10, 64)
+	fromState := query.Get("resourceVersion") == "" || rv == 0
+	table, tableOK := watchTableFormatFor(req.Header.Get("Accept"), query.Get("includeObject"))
+	if !ok || (!fromState && rvErr != nil) || query.Get("sendInitialEvents") != "" || query.Get("resourceVersionMatch") != "" ||
+		(!tableOK && !acceptsPlainJSON(req.Header.Get("Accept"))) || hasImpersonationHeaders(req) {
+		watchCacheRequests.WithLabelValues(clusterName, resourceLabel, "bypass").Inc()
+		return false
+	}
+	proxyMutex.RLock()
+	restConfig := clusterConfigs[clusterName]
+	proxyMutex.RUnlock()
+	if restConfig == nil {
+		return false
+	}
+
+	sw := watchCaches.acquire(clusterName, gvr, info.Namespace, table != nil, restConfig)
+	defer watchCaches.release(sw)
+	if !sw.waitReady(req.Context()) {
+		watchCacheRequests.WithLabelValues(clusterName, resourceLabel, "bypass").Inc()
+		return false
+	}
+	sub, initial, err := sw.subscribe(rv, fromState)
+	if err == errWatchUnavailable {
+		watchCacheRequests.WithLabelValues(clusterName, resourceLabel, "bypass").Inc()
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, private")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	sw.mu.Lock()
+	apiVersion, kind := gvr.GroupVersion().String(), sw.kind
+	if table != nil {
+		table.columns = sw.columns
+	}
+	sw.mu.Unlock()
+	stream := &watchStream{
+		w:             w,
+		flusher:       flusher,
+		labelSelector: labelSelector,
+		fieldSelector: fieldSelector,
+		bookmarks:     query.Get("allowWatchBookmarks") == "true",
+		apiVersion:    apiVersion,
+		kind:          kind,
+		table:         table,
+	}
+	watchCacheRequests.WithLabelValues(clusterName, resourceLabel, "hit").Inc()
+	clients := watchCacheClients.WithLabelValues(clusterName, resourceLabel)
+	clients.Inc()
+	defer clients.Dec()
+	defer sw.unsubscribe(sub)
+
+	for _, event := range initial {
+		if !stream.send(event) {
+			return true
+		}
+	}
+	stream.flush()
+
+	timer := time.NewTimer(watchTimeout(query, clusterName))
+	defer timer.Stop()
+	for {
+		select {
+		case event := <-sub.events:
+			// 客户端的版本可能比订阅时共享 watch 收到的最后一个事件更新，它已经包含了之后到达的部分事件
+			if !fromState && event.resourceVersion <= rv {
+				continue
+			}
+			if !stream.send(event) {
+				return true
+			}
+			// 已经缓冲的事件一起写出后再刷新
+			if len(sub.events) == 0 {
+				stream.flush()
+			}
+		case <-sub.closed:
+			return true
+		case <-timer.C:
+			return true
+		case <-req.Context().Done():
+			return true
+		}
+	}
+}
+
+// watchTimeout 返回 watch 的持续时间: 优先使用客户端的 timeoutSeconds，未指定时与 API Server 一致取 30 到 60 分钟之间的随机值，
+// 并受 timeouts.watchMaxDuration 限制
+func watchTimeout(query url.Values, clusterName string) time.Duration {
+	timeout := time.Duration(30+rand.Intn(30)) * time.Minute
+	if seconds, err := strconv.ParseInt(query.Get("timeoutSeconds"), 10, 64); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if max := gatewayConfigSnapshot().Timeouts.settingsFor(clusterName).WatchMaxDuration.Duration; max > 0 && max < timeout {
+		timeout = max
+	}
+	return timeout
+}
+
+// watchStream 按客户端的选择器过滤事件并以 API Server 的 watch 格式写出
+type watchStream struct {
+	w             http.ResponseWriter
+	flusher       http.Flusher
+	labelSelector labels.Selector
+	fieldSelector fields.Selector
+	bookmarks     bool
+	apiVersion    string
+	kind          string
+	table         *watchTableFormat
+}
+
+// send 写出一个事件，写入失败时返回 false。对象因修改进入选择器时发送 ADDED，离开选择器时发送 DELETED
+func (s *watchStream) send(event *watchCacheEvent) bool {
+	eventType := event.eventType
+	switch eventType {
+	case watch.Bookmark:
+		// Table 格式的 watch 不发送书签，API Server 同样可以省略书签
+		if !s.bookmarks || s.table != nil {
+			return true
+		}
+		return s.write(watch.Bookmark, s.bookmarkObject(event.resourceVersion))
+	case watch.Added, watch.Deleted:
+		if !selectorsMatch(event.object, s.labelSelector, s.fieldSelector) {
+			return true
+		}
+	case watch.Modified:
+		matches := selectorsMatch(event.object, s.labelSelector, s.fieldSelector)
+		matched := event.prevObject != nil && selectorsMatch(event.prevObject, s.labelSelector, s.fieldSelector)
+		switch {
+		case matches && !matched:
+			eventType = watch.Added
+		case !matches && matched:
+			eventType = watch.Deleted
+		case !matches:
+			return true
+		}
+	}
+	if s.table != nil {
+		return s.write(eventType, s.table.encode(event))
+	}
+	return s.write(eventType, event.encodedObject())
+}
+
+func (s *watchStream) bookmarkObject(rv uint64) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": s.apiVersion,
+		"kind":       s.kind,
+		"metadata":   map[string]interface{}{"resourceVersion": strconv.FormatUint(rv, 10)},
+	})
+	return body
+}
+
+func (s *watchStream) write(eventType watch.EventType, object []byte) bool {
+	line := make([]byte, 0, len(object)+32)
+	line = append(line, `{"type":"`...)
+	line = append(line, eventType...)
+	line = append(line, `","object":`...)
+	line = append(line, object...)
+	line = append(line, "}\n"...)
+	_, err := s.w.Write(line)
+	return err == nil
+}
+
+func (s *watchStream) flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// watchTableFormat 是客户端要求的 Table 格式: apiVersion 是 Table 的版本 (meta.k8s.io/v1 或 v1beta1)，
+// includeObject 决定行中的对象 (None、Metadata 或 Object)。与 API Server 一致，列定义只在第一个事件中发送
+type watchTableFormat struct {
+	apiVersion    string
+	includeObject metav1.IncludeObjectPolicy
+	columns       json.RawMessage
+}
+
+// watchTableFormatFor 解析 Accept 中首选的 Table 格式，客户端不要求 Table 时返回 nil 和 false
+func watchTableFormatFor(accept, includeObject string) (*watchTableFormat, bool) {
+	first := strings.Split(accept, ",")[0]
+	mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(first))
+	if err != nil || mediaType != "application/json" || params["as"] != "Table" || params["g"] != metav1.GroupName {
+		return nil, false
+	}
+	if params["v"] != "v1" && params["v"] != "v1beta1" {
+		return nil, false
+	}
+	policy := metav1.IncludeObjectPolicy(includeObject)
+	switch policy {
+	case "":
+		policy = metav1.IncludeMetadata
+	case metav1.IncludeNone, metav1.IncludeMetadata, metav1.IncludeObject:
+	default:
+		return nil, false
+	}
+	return &watchTableFormat{apiVersion: metav1.GroupName + "/" + params["v"], includeObject: policy}, true
+}
+
+type watchTableObject struct {
+	Kind       string `json:"kind"`
+	APIVersion string `json:"apiVersion"`
+	Metadata   struct {
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	ColumnDefinitions json.RawMessage  `json:"columnDefinitions"`
+	Rows              []watchTableLine `json:"rows"`
+}
+
+type watchTableLine struct {
+	Cells      json.RawMessage `json:"cells"`
+	Conditions json.RawMessage `json:"conditions,omitempty"`
+	Object     json.RawMessage `json:"object,omitempty"`
+}
+
+// encode 把事件编码为只有一行的 Table
+func (f *watchTableFormat) encode(event *watchCacheEvent) []byte {
+	var line watchTableLine
+	if event.row != nil {
+		line.Cells, line.Conditions = event.row.cells, event.row.conditions
+	}
+	switch f.includeObject {
+	case metav1.IncludeObject:
+		line.Object = event.encodedObject()
+	case metav1.IncludeMetadata:
+		line.Object, _ = json.Marshal(map[string]json.RawMessage{
+			"kind":       json.RawMessage(`"PartialObjectMetadata"`),
+			"apiVersion": json.RawMessage(strconv.Quote(f.apiVersion)),
+			"metadata":   event.encodedMetadata(),
+		})
+	}
+	table := watchTableObject{Kind: "Table", APIVersion: f.apiVersion, ColumnDefinitions: f.columns, Rows: []watchTableLine{line}}
+	table.Metadata.ResourceVersion = event.object.GetResourceVersion()
+	f.columns = nil
+	body, _ := json.Marshal(table)
+	return body
+}
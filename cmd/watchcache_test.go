@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+func testPod(name, app, resourceVersion string) *unstructured.Unstructured {
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName(name)
+	pod.SetResourceVersion(resourceVersion)
+	pod.SetLabels(map[string]string{"app": app})
+	return pod
+}
+
+// watchEventLines 解析 watch 响应中的事件
+func watchEventLines(t *testing.T, body string) []map[string]interface{} {
+	t.Helper()
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if line == "" {
+			continue
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid watch event %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestWatchStreamSendSelectorTransitions(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType watch.EventType
+		prev      *unstructured.Unstructured
+		object    *unstructured.Unstructured
+		bookmarks bool
+		// want 为空表示客户端不应收到事件
+		want watch.EventType
+	}{
+		{name: "added matching", eventType: watch.Added, object: testPod("a", "db", "2"), want: watch.Added},
+		{name: "added not matching", eventType: watch.Added, object: testPod("a", "web", "2")},
+		{name: "modified matching", eventType: watch.Modified, prev: testPod("a", "db", "1"), object: testPod("a", "db", "2"), want: watch.Modified},
+		{name: "modified into selector", eventType: watch.Modified, prev: testPod("a", "web", "1"), object: testPod("a", "db", "2"), want: watch.Added},
+		{name: "modified out of selector", eventType: watch.Modified, prev: testPod("a", "db", "1"), object: testPod("a", "web", "2"), want: watch.Deleted},
+		{name: "modified outside selector", eventType: watch.Modified, prev: testPod("a", "web", "1"), object: testPod("a", "web", "2")},
+		{name: "modified without previous state", eventType: watch.Modified, object: testPod("a", "db", "2"), want: watch.Added},
+		{name: "deleted matching", eventType: watch.Deleted, prev: testPod("a", "db", "1"), object: testPod("a", "db", "2"), want: watch.Deleted},
+		{name: "deleted not matching", eventType: watch.Deleted, prev: testPod("a", "web", "1"), object: testPod("a", "web", "2")},
+		{name: "bookmark not requested", eventType: watch.Bookmark, object: testPod("", "", "3")},
+		{name: "bookmark requested", eventType: watch.Bookmark, object: testPod("", "", "3"), bookmarks: true, want: watch.Bookmark},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			stream := &watchStream{
+				w:             recorder,
+				labelSelector: labels.SelectorFromSet(labels.Set{"app": "db"}),
+				fieldSelector: fields.Everything(),
+				bookmarks:     tt.bookmarks,
+				apiVersion:    "v1",
+				kind:          "Pod",
+			}
+			event := &watchCacheEvent{eventType: tt.eventType, object: tt.object, prevObject: tt.prev, resourceVersion: 3}
+			if !stream.send(event) {
+				t.Fatal("send reported a write failure")
+			}
+			events := watchEventLines(t, recorder.Body.String())
+			if tt.want == "" {
+				if len(events) != 0 {
+					t.Fatalf("expected no event, got %v", events)
+				}
+				return
+			}
+			if len(events) != 1 {
+				t.Fatalf("expected one event, got %v", events)
+			}
+			if events[0]["type"] != string(tt.want) {
+				t.Errorf("event type = %v, want %s", events[0]["type"], tt.want)
+			}
+			object := events[0]["object"].(map[string]interface{})
+			if tt.want == watch.Bookmark {
+				if object["kind"] != "Pod" || object["metadata"].(map[string]interface{})["resourceVersion"] != "3" {
+					t.Errorf("unexpected bookmark object %v", object)
+				}
+				return
+			}
+			if object["metadata"].(map[string]interface{})["resourceVersion"] != tt.object.GetResourceVersion() {
+				t.Errorf("expected the current object, got %v", object)
+			}
+		})
+	}
+}
+
+func TestWatchTableFormatFor(t *testing.T) {
+	kubectlAccept := "application/json;as=Table;v=v1;g=meta.k8s.io,application/json;as=Table;v=v1beta1;g=meta.k8s.io,application/json"
+	tests := []struct {
+		name          string
+		accept        string
+		includeObject string
+		wantOK        bool
+		wantVersion   string
+		wantInclude   string
+	}{
+		{name: "kubectl", accept: kubectlAccept, wantOK: true, wantVersion: "meta.k8s.io/v1", wantInclude: "Metadata"},
+		{name: "v1beta1", accept: "application/json;as=Table;v=v1beta1;g=meta.k8s.io", includeObject: "None", wantOK: true, wantVersion: "meta.k8s.io/v1beta1", wantInclude: "None"},
+		{name: "include object", accept: kubectlAccept, includeObject: "Object", wantOK: true, wantVersion: "meta.k8s.io/v1", wantInclude: "Object"},
+		{name: "invalid includeObject", accept: kubectlAccept, includeObject: "All"},
+		{name: "plain json", accept: "application/json"},
+		{name: "empty accept", accept: ""},
+		{name: "protobuf table", accept: "application/vnd.kubernetes.protobuf;as=Table;v=v1;g=meta.k8s.io"},
+		{name: "unknown version", accept: "application/json;as=Table;v=v2;g=meta.k8s.io"},
+		{name: "partial object metadata", accept: "application/json;as=PartialObjectMetadata;v=v1;g=meta.k8s.io"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, ok := watchTableFormatFor(tt.accept, tt.includeObject)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if format.apiVersion != tt.wantVersion || string(format.includeObject) != tt.wantInclude {
+				t.Errorf("got %s/%s, want %s/%s", format.apiVersion, format.includeObject, tt.wantVersion, tt.wantInclude)
+			}
+		})
+	}
+}
+
+func TestWatchStreamSendTable(t *testing.T) {
+	rawObject, _ := testPod("a", "db", "2").MarshalJSON()
+	row := &watchTableRow{cells: json.RawMessage(`["a","Running"]`), object: rawObject}
+	columns := json.RawMessage(`[{"name":"Name","type":"string"},{"name":"Status","type":"string"}]`)
+
+	tests := []struct {
+		name          string
+		includeObject string
+		wantKind      string
+	}{
+		{name: "metadata", includeObject: "", wantKind: "PartialObjectMetadata"},
+		{name: "object", includeObject: "Object", wantKind: "Pod"},
+		{name: "none", includeObject: "None"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, ok := watchTableFormatFor("application/json;as=Table;v=v1beta1;g=meta.k8s.io", tt.includeObject)
+			if !ok {
+				t.Fatal("expected a Table format")
+			}
+			format.columns = columns
+			recorder := httptest.NewRecorder()
+			stream := &watchStream{
+				w:             recorder,
+				labelSelector: labels.Everything(),
+				fieldSelector: fields.Everything(),
+				table:         format,
+			}
+			for _, eventType := range []watch.EventType{watch.Added, watch.Modified} {
+				event := &watchCacheEvent{eventType: eventType, object: testPod("a", "db", "2"), row: row, resourceVersion: 2}
+				if !stream.send(event) {
+					t.Fatal("send reported a write failure")
+				}
+			}
+			// 书签不会发给 Table 格式的客户端
+			stream.send(&watchCacheEvent{eventType: watch.Bookmark, object: testPod("", "", "3"), resourceVersion: 3})
+
+			events := watchEventLines(t, recorder.Body.String())
+			if len(events) != 2 {
+				t.Fatalf("expected 2 events, got %v", events)
+			}
+			for i, event := range events {
+				table := event["object"].(map[string]interface{})
+				if table["kind"] != "Table" || table["apiVersion"] != "meta.k8s.io/v1beta1" {
+					t.Errorf("event %d is not a v1beta1 Table: %v", i, table)
+				}
+				// 与 API Server 一致，列定义只在第一个事件中发送
+				if hasColumns := table["columnDefinitions"] != nil; hasColumns != (i == 0) {
+					t.Errorf("event %d columnDefinitions = %v", i, table["columnDefinitions"])
+				}
+				rows := table["rows"].([]interface{})
+				if len(rows) != 1 {
+					t.Fatalf("event %d has %d rows", i, len(rows))
+				}
+				rowObject, _ := rows[0].(map[string]interface{})["object"].(map[string]interface{})
+				if tt.wantKind == "" {
+					if rowObject != nil {
+						t.Errorf("event %d: expected no object, got %v", i, rowObject)
+					}
+					continue
+				}
+				if rowObject["kind"] != tt.wantKind {
+					t.Errorf("event %d: row object kind = %v, want %s", i, rowObject["kind"], tt.wantKind)
+				}
+				if rowObject["metadata"].(map[string]interface{})["name"] != "a" {
+					t.Errorf("event %d: row object %v has no metadata", i, rowObject)
+				}
+			}
+		})
+	}
+}
+
+// startTestWatchCache 为集群 watchcache-test 启用 pods 的共享 watch，上游是只返回一个 Pod 的 API Server
+func startTestWatchCache(t *testing.T) {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(`{"apiVersion":"v1","kind":"PodList","metadata":{"resourceVersion":"10"},"items":[` +
+			`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"a","namespace":"default","resourceVersion":"5"}}]}`))
+	}))
+	t.Cleanup(backend.Close)
+
+	previous := currentGatewayConfig.Load()
+	config := &gatewayConfig{}
+	config.WatchCache.PerCluster.Resources = []readCacheResource{{Version: "v1", Resource: "pods"}}
+	currentGatewayConfig.Store(config)
+	proxyMutex.Lock()
+	previousConfigs := clusterConfigs
+	clusterConfigs = map[string]*rest.Config{"watchcache-test": {Host: backend.URL}}
+	proxyMutex.Unlock()
+	t.Cleanup(func() {
+		watchCaches.mu.Lock()
+		for _, sw := range watchCaches.watches {
+			if sw.clusterName == "watchcache-test" {
+				watchCaches.stopLocked(sw)
+			}
+		}
+		watchCaches.mu.Unlock()
+		proxyMutex.Lock()
+		clusterConfigs = previousConfigs
+		proxyMutex.Unlock()
+		currentGatewayConfig.Store(previous)
+	})
+}
+
+func TestServeFromWatchCacheBypass(t *testing.T) {
+	startTestWatchCache(t)
+
+	tests := []struct {
+		name    string
+		query   string
+		headers map[string]string
+		// wantServed 为 false 表示请求应转发到后端
+		wantServed bool
+	}{
+		{name: "watch", wantServed: true},
+		{name: "send initial events", query: "&sendInitialEvents=true&resourceVersionMatch=NotOlderThan"},
+		{name: "unsupported field selector", query: "&fieldSelector=spec.nodeName%3Dnode-1"},
+		{name: "protobuf", headers: map[string]string{"Accept": "application/vnd.kubernetes.protobuf;type=watch"}},
+		{name: "impersonated user", headers: map[string]string{"Impersonate-User": "restricted"}},
+		{name: "impersonated group", headers: map[string]string{"Impersonate-Group": "viewers"}},
+		{name: "impersonated uid", headers: map[string]string{"Impersonate-Uid": "1234"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods?watch=true"+tt.query, nil).WithContext(ctx)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			recorder := httptest.NewRecorder()
+			served := serveFromWatchCache(recorder, req, "watchcache-test", parseRequestInfo(req))
+			if served != tt.wantServed {
+				t.Fatalf("served = %v, want %v", served, tt.wantServed)
+			}
+			events := watchEventLines(t, recorder.Body.String())
+			if !served {
+				if len(events) != 0 {
+					t.Errorf("a forwarded request must not get events from the shared watch, got %v", events)
+				}
+				return
+			}
+			if len(events) != 1 || events[0]["type"] != string(watch.Added) {
+				t.Errorf("expected the initial ADDED event, got %v", events)
+			}
+		})
+	}
+	watchCaches.mu.Lock()
+	_, shared := watchCaches.watches[watchCacheKey("watchcache-test", schema.GroupVersionResource{Version: "v1", Resource: "pods"}, "default", false)]
+	watchCaches.mu.Unlock()
+	if !shared {
+		t.Error("expected the plain watch to use a shared upstream watch")
+	}
+}
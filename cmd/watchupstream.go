@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// watchTableAccept 是 Table 格式的上游 watch 使用的 Accept，客户端要求的 v1beta1 由网关改写
+const watchTableAccept = "application/json;as=Table;v=v1;g=meta.k8s.io"
+
+// watchSnapshot 是上游 list 的结果。rows 与 objects 一一对应，只在 Table 格式时使用
+type watchSnapshot struct {
+	kind            string
+	resourceVersion string
+	objects         []*unstructured.Unstructured
+	rows            []*watchTableRow
+	columns         json.RawMessage
+}
+
+// upstreamEvent 是上游 watch 的一个事件。Table 格式时 row 是对象所在的行，
+// columns 是 API Server 在该 watch 的第一个事件中附带的列定义
+type upstreamEvent struct {
+	eventType watch.EventType
+	object    *unstructured.Unstructured
+	row       *watchTableRow
+	columns   json.RawMessage
+	err       error
+}
+
+// watchTableRow 是 Table 中的一行，object 是行中完整对象的 JSON
+type watchTableRow struct {
+	cells      json.RawMessage
+	conditions json.RawMessage
+	object     []byte
+}
+
+// watchUpstream 对共享 watch 屏蔽上游的格式: 普通 JSON 由 dynamic 客户端处理，Table 格式直接发送 HTTP 请求
+type watchUpstream interface {
+	list(ctx context.Context) (*watchSnapshot, error)
+	watch(ctx context.Context, resourceVersion string) (upstreamWatch, error)
+}
+
+// upstreamWatch 是一个进行中的上游 watch，next 在 watch 结束时返回 false
+type upstreamWatch interface {
+	next() (upstreamEvent, bool)
+	stop()
+}
+
+func newWatchUpstream(config *rest.Config, gvr schema.GroupVersionResource, namespace string, table bool) (watchUpstream, error) {
+	if table {
+		return newTableWatchUpstream(config, gvr, namespace)
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamicWatchUpstream{resource: client.Resource(gvr).Namespace(namespace)}, nil
+}
+
+type dynamicWatchUpstream struct {
+	resource dynamic.ResourceInterface
+}
+
+func (u *dynamicWatchUpstream) list(ctx context.Context) (*watchSnapshot, error) {
+	list, err := u.resource.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &watchSnapshot{
+		kind:            strings.TrimSuffix(list.GetKind(), "List"),
+		resourceVersion: list.GetResourceVersion(),
+	}
+	for i := range list.Items {
+		snapshot.objects = append(snapshot.objects, &list.Items[i])
+	}
+	return snapshot, nil
+}
+
+func (u *dynamicWatchUpstream) watch(ctx context.Context, resourceVersion string) (upstreamWatch, error) {
+	watcher, err := u.resource.Watch(ctx, metav1.ListOptions{ResourceVersion: resourceVersion, AllowWatchBookmarks: true})
+	if err != nil {
+		return nil, err
+	}
+	return &dynamicUpstreamWatch{watcher: watcher}, nil
+}
+
+type dynamicUpstreamWatch struct {
+	watcher watch.Interface
+}
+
+func (w *dynamicUpstreamWatch) next() (upstreamEvent, bool) {
+	for event := range w.watcher.ResultChan() {
+		if event.Type == watch.Error {
+			return upstreamEvent{eventType: watch.Error, err: apierrors.FromObject(event.Object)}, true
+		}
+		if obj, ok := event.Object.(*unstructured.Unstructured); ok {
+			return upstreamEvent{eventType: event.Type, object: obj}, true
+		}
+	}
+	return upstreamEvent{}, false
+}
+
+func (w *dynamicUpstreamWatch) stop() {
+	w.watcher.Stop()
+}
+
+// tableWatchUpstream 以 Table 格式 list 和 watch，并要求每行带有完整的对象 (includeObject=Object)。
+// 表格的单元格由 API Server 生成，网关按对象过滤选择器，并按客户端的 includeObject 改写行中的对象
+type tableWatchUpstream struct {
+	client *http.Client
+	url    string
+}
+
+func newTableWatchUpstream(config *rest.Config, gvr schema.GroupVersionResource, namespace string) (*tableWatchUpstream, error) {
+	client, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, err
+	}
+	segments := []string{"apis", gvr.Group, gvr.Version}
+	if gvr.Group == "" {
+		segments = []string{"api", gvr.Version}
+	}
+	if namespace != "" {
+		segments = append(segments, "namespaces", namespace)
+	}
+	segments = append(segments, gvr.Resource)
+	return &tableWatchUpstream{client: client, url: base.JoinPath(segments...).String()}, nil
+}
+
+// watchTable 是上游返回的 Table，watch 事件中的 Table 只有一行
+type watchTable struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	ColumnDefinitions json.RawMessage `json:"columnDefinitions"`
+	Rows              []struct {
+		Cells      json.RawMessage `json:"cells"`
+		Conditions json.RawMessage `json:"conditions"`
+		Object     json.RawMessage `json:"object"`
+	} `json:"rows"`
+}
+
+func (u *tableWatchUpstream) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	query.Set("includeObject", "Object")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", watchTableAccept)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		var status metav1.Status
+		if json.Unmarshal(body, &status) == nil && status.Kind == "Status" {
+			return nil, &apierrors.StatusError{ErrStatus: status}
+		}
+		return nil, fmt.Errorf("后端返回状态码 %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func (u *tableWatchUpstream) list(ctx context.Context) (*watchSnapshot, error) {
+	resp, err := u.get(ctx, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var table watchTable
+	if err := json.NewDecoder(resp.Body).Decode(&table); err != nil {
+		return nil, fmt.Errorf("无法解析 Table: %v", err)
+	}
+	snapshot := &watchSnapshot{resourceVersion: table.Metadata.ResourceVersion, columns: nonNullJSON(table.ColumnDefinitions)}
+	for _, row := range table.Rows {
+		obj := &unstructured.Unstructured{}
+		if err := json.Unmarshal(row.Object, &obj.Object); err != nil || obj.Object == nil {
+			return nil, fmt.Errorf("Table 的行中没有对象")
+		}
+		snapshot.objects = append(snapshot.objects, obj)
+		snapshot.rows = append(snapshot.rows, &watchTableRow{cells: row.Cells, conditions: nonNullJSON(row.Conditions), object: row.Object})
+	}
+	return snapshot, nil
+}
+
+func (u *tableWatchUpstream) watch(ctx context.Context, resourceVersion string) (upstreamWatch, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	query := url.Values{"watch": {"true"}, "resourceVersion": {resourceVersion}, "allowWatchBookmarks": {"true"}}
+	resp, err := u.get(ctx, query)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &tableUpstreamWatch{body: resp.Body, decoder: json.NewDecoder(resp.Body), cancel: cancel}, nil
+}
+
+type tableUpstreamWatch struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+	cancel  context.CancelFunc
+}
+
+func (w *tableUpstreamWatch) next() (upstreamEvent, bool) {
+	for {
+		var raw struct {
+			Type   watch.EventType `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := w.decoder.Decode(&raw); err != nil {
+			return upstreamEvent{}, false
+		}
+		if raw.Type == watch.Error {
+			var status metav1.Status
+			json.Unmarshal(raw.Object, &status)
+			return upstreamEvent{eventType: watch.Error, err: &apierrors.StatusError{ErrStatus: status}}, true
+		}
+		var table watchTable
+		if err := json.Unmarshal(raw.Object, &table); err != nil {
+			continue
+		}
+		if raw.Type == watch.Bookmark {
+			// 书签只用于推进版本，Table 和普通对象的 resourceVersion 都在 metadata 中
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetResourceVersion(table.Metadata.ResourceVersion)
+			return upstreamEvent{eventType: watch.Bookmark, object: obj}, true
+		}
+		if len(table.Rows) == 0 {
+			continue
+		}
+		row := table.Rows[0]
+		obj := &unstructured.Unstructured{}
+		if err := json.Unmarshal(row.Object, &obj.Object); err != nil || obj.Object == nil {
+			continue
+		}
+		return upstreamEvent{
+			eventType: raw.Type,
+			object:    obj,
+			row:       &watchTableRow{cells: row.Cells, conditions: nonNullJSON(row.Conditions), object: row.Object},
+			columns:   nonNullJSON(table.ColumnDefinitions),
+		}, true
+	}
+}
+
+func (w *tableUpstreamWatch) stop() {
+	w.cancel()
+	w.body.Close()
+}
+
+// nonNullJSON 把 JSON 中的 null 视为未设置。API Server 在 watch 的第一个事件之后不再附带列定义
+func nonNullJSON(raw json.RawMessage) json.RawMessage {
+	if string(raw) == "null" {
+		return nil
+	}
+	return raw
+}